@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var AuditLogFile = "audit.log"
+
+// AuditCaller identifies the notify connection a call was received on.
+type AuditCaller struct {
+	Addr        string
+	Subject     string
+	Fingerprint string
+}
+
+func NewAuditCaller(conn *tls.Conn) *AuditCaller {
+	caller := &AuditCaller{Addr: conn.RemoteAddr().String()}
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		caller.Subject = cert.Subject.String()
+		h := sha1.Sum(cert.Raw)
+		caller.Fingerprint = hex.EncodeToString(h[:])
+	}
+	return caller
+}
+
+type AuditEntry struct {
+	Seq      int64
+	Time     time.Time
+	Caller   *AuditCaller
+	Method   string
+	Args     interface{}
+	Error    string `json:",omitempty"`
+	Rows     int64
+	Duration float64
+	Prev     string
+}
+
+// auditLine is one line of the audit log. Hash is the SHA-256 of the Entry
+// bytes as written, and every Entry carries the Hash of the line before,
+// so a changed, removed or inserted line breaks the chain.
+type auditLine struct {
+	Entry json.RawMessage
+	Hash  string
+}
+
+type auditLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	seq    int64
+	last   string
+	redact map[string]bool
+}
+
+var Audit = new(auditLog)
+
+// Open opens filename for append and continues the chain of its last line.
+// If the chain is already broken a new chain is started, verification keeps
+// reporting the break.
+func (a *auditLog) Open(filename string) error {
+	seq, last, err := readAuditLog(filename, nil)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR audit log '%s': %v, start new chain", filename, err)
+		seq, last = 0, ""
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0600)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.f, a.seq, a.last = f, seq, last
+	a.mu.Unlock()
+	return nil
+}
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+// SetRedact sets the redaction options, a comma separated list of "params"
+// (query parameters), "literals" (string literals in SQL) and "messages"
+// (server message texts).
+func (a *auditLog) SetRedact(options string) {
+	redact := make(map[string]bool)
+	for _, v := range strings.Split(options, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			redact[v] = true
+		}
+	}
+	a.mu.Lock()
+	a.redact = redact
+	a.mu.Unlock()
+}
+
+// Record writes an entry for a call which started at stime. Failures are
+// logged, the call itself is not affected.
+func (a *auditLog) Record(caller *AuditCaller, method string, args interface{}, stime time.Time, err error, rows int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return
+	}
+
+	e := AuditEntry{
+		Seq:      a.seq + 1,
+		Time:     stime,
+		Caller:   caller,
+		Method:   method,
+		Args:     a.redactArgs(args),
+		Rows:     rows,
+		Duration: time.Since(stime).Seconds() * 1000,
+		Prev:     a.last,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	entry, errj := json.Marshal(&e)
+	if errj != nil {
+		log.Printf("ERROR audit %s: %v", method, errj)
+		return
+	}
+	h := sha256.Sum256(entry)
+	line, _ := json.Marshal(auditLine{entry, hex.EncodeToString(h[:])})
+	if _, errw := a.f.Write(append(line, '\n')); errw != nil {
+		log.Printf("ERROR audit %s: %v", method, errw)
+		return
+	}
+	a.seq = e.Seq
+	a.last = hex.EncodeToString(h[:])
+}
+
+func (a *auditLog) redactArgs(args interface{}) interface{} {
+	switch v := args.(type) {
+	case *DBQueryArgs:
+		c := *v
+		if a.redact["literals"] {
+			c.Command = redactSQLLiterals(c.Command)
+		}
+		if a.redact["params"] && len(c.Params) > 0 {
+			c.Params = []interface{}{fmt.Sprintf("(%d redacted)", len(c.Params))}
+		}
+		return &c
+	case *ClientMessageArgs:
+		c := *v
+		if a.redact["messages"] {
+			c.Message = "(redacted)"
+		}
+		return &c
+	}
+	return args
+}
+
+// redactSQLLiterals replaces quoted strings in s with '?'.
+func redactSQLLiterals(s string) string {
+	var sb strings.Builder
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote == 0 {
+			if c == '\'' || c == '"' {
+				quote = c
+				sb.WriteString("'?'")
+			} else {
+				sb.WriteByte(c)
+			}
+			continue
+		}
+		if c == '\\' {
+			i++
+		} else if c == quote {
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+			} else {
+				quote = 0
+			}
+		}
+	}
+	return sb.String()
+}
+
+// VerifyAuditLog checks the hash chain of filename and returns the number
+// of entries.
+func VerifyAuditLog(filename string) (int64, error) {
+	var count int64
+	_, _, err := readAuditLog(filename, func(e *AuditEntry) {
+		count++
+	})
+	return count, err
+}
+
+func readAuditLog(filename string, fn func(e *AuditEntry)) (seq int64, last string, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return seq, last, err
+		}
+		if err == io.EOF {
+			return seq, last, fmt.Errorf("line %d: truncated", n)
+		}
+
+		var line auditLine
+		if err := json.Unmarshal(b, &line); err != nil {
+			return seq, last, fmt.Errorf("line %d: %v", n, err)
+		}
+		h := sha256.Sum256(line.Entry)
+		if hex.EncodeToString(h[:]) != line.Hash {
+			return seq, last, fmt.Errorf("line %d: hash mismatch", n)
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(line.Entry, &e); err != nil {
+			return seq, last, fmt.Errorf("line %d: %v", n, err)
+		}
+		if e.Prev != last || e.Seq != seq+1 {
+			return seq, last, fmt.Errorf("line %d: chain broken at seq %d", n, e.Seq)
+		}
+		if fn != nil {
+			fn(&e)
+		}
+		seq, last = e.Seq, line.Hash
+	}
+	return seq, last, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// BundleMagic starts an offline bundle file, it is followed by a gob
+// encoded bundleFile. The Payload of it is the flate compressed gob of a
+// Bundle, signed with the key of the server certificate.
+const BundleMagic = "GDBBNDL1"
+const BundleVersion = 1
+
+// ValueBundleCheckpoint is the checkpoint of the last imported bundle,
+// bundles with changes apply only after it.
+const ValueBundleCheckpoint = "bundle_checkpoint"
+
+// ValueBundleCreated is the creation time of the last imported bundle, a
+// full bundle must be newer so an old one can not roll the client back.
+const ValueBundleCreated = "bundle_created"
+
+type BundleHeader struct {
+	Version  int
+	ClientID string
+	Table    string
+	Created  time.Time
+	// Full bundles replace the rows of the client, others apply the
+	// changes after checkpoint From and must be imported in sequence.
+	Full bool
+	From string
+	// To is the checkpoint of the client after the import.
+	To string
+}
+
+// Bundle is the statements which sync a client without network.
+type Bundle struct {
+	Header     BundleHeader
+	Statements []string
+}
+
+type bundleFile struct {
+	// Certs is the certificate chain of the signing key, DER encoded.
+	Certs     [][]byte
+	Signature []byte
+	Payload   []byte
+}
+
+// ReadBundle reads a bundle signed by the server certificate of serverName
+// issued by roots.
+func ReadBundle(r io.Reader, roots *x509.CertPool, serverName string) (*Bundle, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(BundleMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != BundleMagic {
+		return nil, errors.New("not a bundle file")
+	}
+	var bf bundleFile
+	if err := gob.NewDecoder(br).Decode(&bf); err != nil {
+		return nil, fmt.Errorf("decode: %v", err)
+	}
+	if len(bf.Certs) == 0 {
+		return nil, errors.New("bundle not signed")
+	}
+
+	certs := make([]*x509.Certificate, len(bf.Certs))
+	for i := range bf.Certs {
+		cert, err := x509.ParseCertificate(bf.Certs[i])
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("verify certificate: %v", err)
+	}
+	digest := sha256.Sum256(bf.Payload)
+	switch pub := certs[0].PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], bf.Signature) {
+			err = errors.New("bad signature")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], bf.Signature)
+	default:
+		err = fmt.Errorf("unsupported key %T", pub)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("verify signature: %v", err)
+	}
+
+	b := new(Bundle)
+	zr := flate.NewReader(bytes.NewReader(bf.Payload))
+	defer zr.Close()
+	if err := gob.NewDecoder(zr).Decode(b); err != nil {
+		return nil, fmt.Errorf("decode payload: %v", err)
+	}
+	if b.Header.Version != BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.Header.Version)
+	}
+	return b, nil
+}
+
+// checkBundle returns an error if b is not for this client or does not
+// apply at its checkpoint. A full bundle not newer than the last import is
+// rejected unless force is set.
+func (db *db) checkBundle(b *Bundle, force bool) error {
+	clientUUID, err := db.GetValue(ValueClientID)
+	if err != nil {
+		return err
+	}
+	if clientUUID != "" && clientUUID != b.Header.ClientID {
+		return fmt.Errorf("bundle of client %s, this is %s", b.Header.ClientID, clientUUID)
+	}
+	checkpoint, err := db.GetValue(ValueBundleCheckpoint)
+	if err != nil {
+		return err
+	}
+	if !b.Header.Full && b.Header.From != checkpoint {
+		return fmt.Errorf("bundle applies after checkpoint %q, client is at %q", b.Header.From, checkpoint)
+	}
+	created, err := db.GetValue(ValueBundleCreated)
+	if err != nil {
+		return err
+	}
+	if b.Header.Full && created != "" && !force {
+		last, err := time.Parse(time.RFC3339Nano, created)
+		if err != nil {
+			return fmt.Errorf("parse '%s': %v", ValueBundleCreated, err)
+		}
+		if !b.Header.Created.After(last) {
+			return fmt.Errorf("full bundle created %s, not newer than the last import of %s",
+				b.Header.Created.Format(time.RFC3339), last.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// ImportBundle runs the statements of b in one transaction and advances
+// the checkpoint. The client takes the UUID of the first bundle. Like the
+// statements of a notify connection they must pass the SQL policy, nothing
+// is run if one does not. force imports a full bundle older than the last
+// import.
+func (db *db) ImportBundle(b *Bundle, force bool) error {
+	clientUUID, err := db.GetValue(ValueClientID)
+	if err != nil {
+		return err
+	}
+	if err := db.checkBundle(b, force); err != nil {
+		return err
+	}
+	p := currentPolicy()
+	for i, stmt := range b.Statements {
+		if err := p.Check(stmt); err != nil {
+			return fmt.Errorf("statement %d: %v", i+1, err)
+		}
+	}
+	if err := db.CreateConflictTable(); err != nil {
+		return fmt.Errorf("create table '%s': %v", ConflictTable, err)
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	exec := func(query string, params ...interface{}) error {
+		qs := db.BeforeQuery(query, params...)
+		_, err := tx.Exec(qs.SQL, qs.Params...)
+		qs.EndQuery(err)
+		return err
+	}
+	for i, stmt := range b.Statements {
+		if err := exec(stmt); err != nil {
+			return fmt.Errorf("statement %d: %v", i+1, err)
+		}
+	}
+	setValue := "INSERT INTO sync_vars(name, value) VALUES (?,?) ON DUPLICATE KEY UPDATE value=VALUES(value)"
+	if err := exec(setValue, ValueBundleCheckpoint, b.Header.To); err != nil {
+		return err
+	}
+	if err := exec(setValue, ValueBundleCreated, b.Header.Created.Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	if clientUUID == "" {
+		if err := exec(setValue, ValueClientID, b.Header.ClientID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckBundleReplay(t *testing.T) {
+	d, cleanup := newFileVarsDB(t)
+	defer cleanup()
+
+	created := time.Date(2019, 3, 1, 8, 0, 0, 0, time.UTC)
+	full := &Bundle{Header: BundleHeader{Version: BundleVersion, ClientID: "c1", Full: true, Created: created, To: "5"}}
+	if err := d.checkBundle(full, false); err != nil {
+		t.Fatalf("first full bundle: %v", err)
+	}
+	// what ImportBundle stores
+	d.SetValue(ValueBundleCheckpoint, "5")
+	d.SetValue(ValueBundleCreated, created.Format(time.RFC3339Nano))
+
+	if err := d.checkBundle(full, false); err == nil {
+		t.Error("replayed full bundle accepted")
+	}
+	old := *full
+	old.Header.Created = created.Add(-time.Hour)
+	if err := d.checkBundle(&old, false); err == nil {
+		t.Error("older full bundle accepted")
+	}
+	if err := d.checkBundle(&old, true); err != nil {
+		t.Errorf("older full bundle with force: %v", err)
+	}
+	newer := *full
+	newer.Header.Created = created.Add(time.Second)
+	if err := d.checkBundle(&newer, false); err != nil {
+		t.Errorf("newer full bundle: %v", err)
+	}
+
+	changes := &Bundle{Header: BundleHeader{Version: BundleVersion, ClientID: "c1", Created: created.Add(time.Hour), From: "4", To: "6"}}
+	if err := d.checkBundle(changes, false); err == nil {
+		t.Error("changes after another checkpoint accepted")
+	}
+	changes.Header.From = "5"
+	if err := d.checkBundle(changes, false); err != nil {
+		t.Errorf("changes: %v", err)
+	}
+	other := *full
+	other.Header.ClientID = "c2"
+	other.Header.Created = created.Add(time.Hour)
+	d.SetValue(ValueClientID, "c1")
+	if err := d.checkBundle(&other, true); err == nil {
+		t.Error("bundle of another client accepted")
+	}
+}
@@ -25,6 +25,11 @@ type Client struct {
 	serverName string
 	certHash   string
 	timeout    *util.TimeoutConfig
+	// sink receives synced rows if the client has no database.
+	sink *FileSink
+	// readOnly keeps sync_vars unchanged, for commands which only check
+	// the config.
+	readOnly bool
 
 	rpcClient *rpc.Client
 }
@@ -94,7 +99,9 @@ func (c *Client) PrepareTLS() error {
 	}
 	c.certHash = hex.EncodeToString(h.Sum(nil))
 	log.Printf("info: cert fingerprint: %s", c.certHash)
-	DB.SetValue("cert_fingerprint", c.certHash)
+	if !c.readOnly {
+		DB.SetValue(ValueCertFingerprint, c.certHash)
+	}
 	return nil
 }
 
@@ -137,7 +144,9 @@ func (c *Client) ConnectServer() error {
 	if c.SeverConnected() {
 		log.Printf("server: Client.Connect response, serverVersion='%d'", reply.ServerVersion)
 		log.Printf("server: client.Connect message: %s", reply.Message)
-		DB.SetValue("server_message", reply.Message)
+		if !c.readOnly {
+			DB.SetValue(ValueServerMessage, reply.Message)
+		}
 	}
 	if err != nil {
 		c.rpcClient.Close()
@@ -158,6 +167,20 @@ func (c *Client) ConnectNotify() error {
 
 	log.Printf("info: notify server addr: %s", addr)
 
+	if c.sink == nil {
+		if err := LoadSQLPolicy(); err != nil {
+			return fmt.Errorf("load sql policy: %v", err)
+		}
+		if err := DB.CreateConflictTable(); err != nil {
+			return fmt.Errorf("create table '%s': %v", ConflictTable, err)
+		}
+	}
+	redact, err := DB.GetValue(ValueAuditRedact)
+	if err != nil {
+		return fmt.Errorf("DB.GetValue '%s': %v", ValueAuditRedact, err)
+	}
+	Audit.SetRedact(redact)
+
 	serverName := c.serverName
 	if pos := strings.IndexByte(addr, '<'); pos != -1 {
 		serverName = strings.TrimSuffix(addr[pos+1:], ">")
@@ -186,9 +209,17 @@ func (c *Client) ConnectNotify() error {
 	}
 
 	log.Printf("info: notify server connected")
+	caller := NewAuditCaller(conn)
+	cursorTTL, _ := c.timeout.Get("cursor", DefaultCursorTTL)
+	sess := newSession(caller, cursorTTL)
+	defer sess.Close()
 	rpcServ := rpc.NewServer()
-	rpcServ.RegisterName("client", new(RpcClient))
-	rpcServ.RegisterName("db", new(RpcDB))
+	rpcServ.RegisterName("client", &RpcClient{caller: caller, sink: c.sink})
+	if c.sink != nil {
+		rpcServ.RegisterName("sink", &RpcSink{caller: caller, sink: c.sink})
+	} else {
+		rpcServ.RegisterName("db", &RpcDB{caller: caller, s: sess})
+	}
 	tc := util.NewTimeoutConn(conn)
 	tc.ReadTimeout, _ = c.timeout.Get("read", DefaultReadTimeout)
 	tc.WriteTimeout, _ = c.timeout.Get("write", DefaultWriteTimeout)
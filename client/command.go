@@ -0,0 +1,484 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"util"
+)
+
+var commands = map[string]func(args []string) error{
+	"audit-verify": cmdAuditVerify,
+	"check":        cmdCheck,
+	"history":      cmdHistory,
+	"import":       cmdImport,
+	"init":         cmdInit,
+	"run":          cmdRun,
+	"status":       cmdStatus,
+}
+
+// newFlagSet returns the flags of command name, every command takes the
+// paths of the client files.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&DSNFile, "dsn", DSNFile, "database DSN file")
+	fs.StringVar(&LogFile, "log", LogFile, "log file")
+	fs.StringVar(&QueryLogFile, "query-log", QueryLogFile, "query log file")
+	fs.StringVar(&AuditLogFile, "audit-log", AuditLogFile, "audit log file")
+	fs.StringVar(&SinkConfigFile, "sink", SinkConfigFile, "file sink config, the client has no database if it exists")
+	fs.StringVar(&PolicyFile, "policy", PolicyFile, "SQL policy file")
+	fs.StringVar(&StatusFile, "status", StatusFile, "status file of the running client")
+	return fs
+}
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string     { return strings.Join(*l, ",") }
+func (l *listFlag) Set(s string) error { *l = append(*l, s); return nil }
+
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", name)
+		return 2
+	}
+	if err := cmd(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func cmdAuditVerify(args []string) error {
+	fs := newFlagSet("audit-verify")
+	fs.Parse(args)
+	filename := AuditLogFile
+	if fs.NArg() > 0 {
+		filename = fs.Arg(0)
+	}
+	count, err := VerifyAuditLog(filename)
+	if err != nil {
+		return fmt.Errorf("'%s' after %d entries: %v", filename, count, err)
+	}
+	fmt.Printf("%s: %d entries, chain OK\n", filename, count)
+	return nil
+}
+
+// cmdRun runs the client, like the client without command.
+func cmdRun(args []string) error {
+	fs := newFlagSet("run")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: run [flags]")
+	}
+	run()
+	return nil
+}
+
+// cmdInit creates sync_vars and sets the server address and the
+// certificates from PEM files, values of flags not given are kept.
+func cmdInit(args []string) error {
+	fs := newFlagSet("init")
+	server := fs.String("server", "", "server address, host:port")
+	serverName := fs.String("server-name", "", "server name in its certificate, the host of -server if empty")
+	certFile := fs.String("cert", "", "client certificate PEM file")
+	keyFile := fs.String("key", "", "client key PEM file")
+	var caFiles listFlag
+	fs.Var(&caFiles, "ca", "server CA PEM file, repeated for more CAs")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: init [-server host:port] [-server-name name] [-ca file]... [-cert file -key file]")
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		return errors.New("-cert and -key go together")
+	}
+	if *server != "" {
+		if _, _, err := net.SplitHostPort(*server); err != nil {
+			return fmt.Errorf("-server should be 'host:port' format")
+		}
+	}
+
+	values := make(map[string]string)
+	for i, fname := range caFiles {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		if err := appendCertsFromPEM(x509.NewCertPool(), data); err != nil {
+			return fmt.Errorf("load CA '%s': %v", fname, err)
+		}
+		name := "server_ca"
+		if i > 0 {
+			name = fmt.Sprintf("server_ca_%d", i+1)
+		}
+		values[name] = string(data)
+	}
+	if *certFile != "" {
+		cert, err := ioutil.ReadFile(*certFile)
+		if err != nil {
+			return err
+		}
+		key, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		if _, err := tls.X509KeyPair(cert, key); err != nil {
+			return fmt.Errorf("load client cert: %v", err)
+		}
+		values[ValueCert], values[ValueCertKey] = string(cert), string(key)
+	}
+	if *server != "" {
+		values[ValueServerAddr] = *server
+	}
+	if *serverName != "" {
+		values[ValueServerName] = *serverName
+	}
+
+	closeStore, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	if err := DB.CreateVarsTable(); err != nil {
+		return fmt.Errorf("create table 'sync_vars': %v", err)
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := DB.SetValue(name, values[name]); err != nil {
+			return fmt.Errorf("DB.SetValue '%s': %v", name, err)
+		}
+		fmt.Printf("%s set\n", name)
+	}
+	if len(caFiles) > 0 {
+		// CAs of an earlier init beyond the ones given
+		cas, err := DB.GetValues(ValueServerCA)
+		if err != nil {
+			return fmt.Errorf("DB.GetValues '%s': %v", ValueServerCA, err)
+		}
+		for _, ca := range cas {
+			if _, ok := values[ca.Name]; ok {
+				continue
+			}
+			if err := DB.DeleteValue(ca.Name); err != nil {
+				return fmt.Errorf("DB.DeleteValue '%s': %v", ca.Name, err)
+			}
+			fmt.Printf("%s deleted\n", ca.Name)
+		}
+	}
+	fmt.Println("sync_vars ready")
+	return nil
+}
+
+// cmdCheck tests the database, the certificates and the connection to the
+// server with the config in sync_vars.
+func cmdCheck(args []string) error {
+	fs := newFlagSet("check")
+	fs.Parse(args)
+	closeStore, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	if err := DB.CheckConn(); err != nil {
+		return fmt.Errorf("database: %v", err)
+	}
+	fmt.Println("database: OK")
+
+	client := &Client{readOnly: true}
+	if err := client.PrepareTLS(); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	cert, err := x509.ParseCertificate(client.cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parse client cert: %v", err)
+	}
+	fmt.Printf("client cert: %s, fingerprint %s\n", cert.Subject.CommonName, client.certHash)
+	left := time.Until(cert.NotAfter)
+	fmt.Printf("client cert expires %s (%d days)\n", cert.NotAfter.Format(time.RFC3339), int(left.Hours()/24))
+	if left <= 0 {
+		return errors.New("client cert expired")
+	}
+
+	if err := client.ConnectServer(); err != nil {
+		return fmt.Errorf("server: %v", err)
+	}
+	defer client.rpcClient.Close()
+	fmt.Printf("server: OK %s (%s)\n", client.serverAddr, client.serverName)
+	return nil
+}
+
+// cmdStatus shows the state written by the running client and the values
+// of sync_vars it keeps about the server.
+func cmdStatus(args []string) error {
+	fs := newFlagSet("status")
+	fs.Parse(args)
+	if closeStore, err := openStore(); err != nil {
+		fmt.Printf("sync_vars: %v\n", err)
+	} else {
+		defer closeStore()
+		for _, name := range []string{ValueServerAddr, ValueServerMessage, ValueBundleCheckpoint} {
+			value, err := DB.GetValue(name)
+			if err != nil {
+				value = err.Error()
+			}
+			fmt.Printf("%s: %s\n", name, value)
+		}
+	}
+
+	st, err := readStatus()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("updated %s (pid %d)\n", st.Time.Format(time.RFC3339), st.Pid)
+	if st.LastSync.IsZero() {
+		fmt.Println("last sync: none since start")
+	} else {
+		fmt.Printf("last sync: %s\n", st.LastSync.Format(time.RFC3339))
+	}
+	if len(st.Sessions) == 0 {
+		fmt.Println("no notify connection")
+	}
+	for _, ss := range st.Sessions {
+		fmt.Printf("notify connection from %s since %s\n", ss.Caller.Addr, ss.Started.Format(time.RFC3339))
+		fmt.Printf("  server cert: %s (%s)\n", ss.Caller.Subject, ss.Caller.Fingerprint)
+		for _, h := range ss.Handles {
+			fmt.Printf("  %-6s %4d  idle %-10s %q\n", h.Kind, h.ID, st.Time.Sub(h.LastUse).Truncate(time.Second), h.SQL)
+		}
+	}
+	return nil
+}
+
+// openStore opens the database of DSNFile, or the sync_vars files of the
+// sink of SinkConfigFile, for commands run beside the client.
+func openStore() (func(), error) {
+	sinkConfig, err := LoadSinkConfig(SinkConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	qlog, err := os.OpenFile(QueryLogFile, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	if err != nil {
+		return nil, err
+	}
+	DB.SetLogger(log.New(qlog, "", log.LstdFlags))
+	if sinkConfig != nil {
+		DB.UseFileVars(sinkConfig.Dir)
+		return func() { qlog.Close() }, nil
+	}
+	dsn, err := util.ReadDSN(DSNFile)
+	if err != nil {
+		qlog.Close()
+		return nil, fmt.Errorf("open %s: %v", DSNFile, err)
+	}
+	if err := DB.Open(dsn); err != nil {
+		qlog.Close()
+		return nil, err
+	}
+	return func() {
+		DB.conn.Close()
+		qlog.Close()
+	}, nil
+}
+
+const historyUsage = `usage: history list
+       history diff <generation> [<generation>]
+       history rollback <generation>`
+
+// cmdHistory lists, compares and restores generations of sync_vars, diff
+// compares with the current sync_vars without a second generation.
+func cmdHistory(args []string) error {
+	fs := newFlagSet("history")
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) == 0 {
+		return errors.New(historyUsage)
+	}
+	var ids []int64
+	for _, arg := range args[1:] {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return errors.New(historyUsage)
+		}
+		ids = append(ids, id)
+	}
+	closeStore, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	if err := DB.CreateHistoryTable(); err != nil {
+		return fmt.Errorf("create table '%s': %v", HistoryTable, err)
+	}
+
+	switch {
+	case args[0] == "list" && len(ids) == 0:
+		gens, err := DB.Generations()
+		if err != nil {
+			return err
+		}
+		current, err := DB.readVars("sync_vars")
+		if err != nil {
+			return err
+		}
+		for _, g := range gens {
+			mark := ""
+			if equalVars(g.Vars, current) {
+				mark = " (current)"
+			}
+			fmt.Printf("%4d  %s  %-7s %3d values%s\n", g.ID, g.Created.Local().Format(time.RFC3339), g.Outcome, len(g.Vars), mark)
+		}
+		return nil
+
+	case args[0] == "diff" && (len(ids) == 1 || len(ids) == 2):
+		a, err := DB.Generation(ids[0])
+		if err != nil {
+			return err
+		}
+		var b map[string]string
+		if len(ids) == 2 {
+			g, err := DB.Generation(ids[1])
+			if err != nil {
+				return err
+			}
+			b = g.Vars
+		} else if b, err = DB.readVars("sync_vars"); err != nil {
+			return err
+		}
+		printVarsDiff(a.Vars, b)
+		return nil
+
+	case args[0] == "rollback" && len(ids) == 1:
+		g, err := DB.Generation(ids[0])
+		if err != nil {
+			return err
+		}
+		// keep the replaced config, the rollback can be undone
+		saved, err := DB.SaveGeneration(OutcomeUnknown)
+		if err != nil {
+			return fmt.Errorf("save current config: %v", err)
+		}
+		if err := DB.RestoreGeneration(g); err != nil {
+			return err
+		}
+		fmt.Printf("sync_vars restored from generation %d, previous config is generation %d\n", g.ID, saved.ID)
+		return nil
+	}
+	return errors.New(historyUsage)
+}
+
+// printVarsDiff prints the values removed, added and changed from a to b.
+func printVarsDiff(a, b map[string]string) {
+	names := make(map[string]bool)
+	for name := range a {
+		names[name] = true
+	}
+	for name := range b {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		va, inA := a[name]
+		vb, inB := b[name]
+		switch {
+		case !inB:
+			fmt.Printf("- %s = %s\n", name, shortValue(va))
+		case !inA:
+			fmt.Printf("+ %s = %s\n", name, shortValue(vb))
+		case va != vb:
+			fmt.Printf("- %s = %s\n", name, shortValue(va))
+			fmt.Printf("+ %s = %s\n", name, shortValue(vb))
+		}
+	}
+}
+
+// shortValue quotes v, long values like certificates are cut.
+func shortValue(v string) string {
+	const max = 60
+	if len(v) > max {
+		return fmt.Sprintf("%q... (%d bytes)", v[:max], len(v))
+	}
+	return fmt.Sprintf("%q", v)
+}
+
+// cmdImport applies an offline bundle exported by the server, it is
+// verified against the server CAs of sync_vars.
+func cmdImport(args []string) error {
+	fs := newFlagSet("import")
+	force := fs.Bool("force", false, "import a full bundle not newer than the last import")
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) != 1 {
+		return errors.New("usage: import [-force] <bundle-file>")
+	}
+	closeStore, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	if DB.conn == nil {
+		return fmt.Errorf("bundles need a database, %s found", SinkConfigFile)
+	}
+	if err := LoadSQLPolicy(); err != nil {
+		return fmt.Errorf("load sql policy: %v", err)
+	}
+
+	// bundles are signed by the server the client connects to
+	serverName, err := DB.GetValue(ValueServerName)
+	if err != nil {
+		return fmt.Errorf("DB.GetValue '%s': %v", ValueServerName, err)
+	}
+	if serverName == "" {
+		serverAddr, err := DB.RequireValue(ValueServerAddr)
+		if err != nil {
+			return fmt.Errorf("DB.RequireValue '%s': %v", ValueServerAddr, err)
+		}
+		if serverName, _, err = net.SplitHostPort(serverAddr); err != nil {
+			return fmt.Errorf("parse '%s': should be 'host:port' format", ValueServerAddr)
+		}
+	}
+
+	caStrList, err := DB.GetValues(ValueServerCA)
+	if err != nil {
+		return fmt.Errorf("DB.GetValues '%s': %v", ValueServerCA, err)
+	}
+	pool := x509.NewCertPool()
+	for i := range caStrList {
+		if err := appendCertsFromPEM(pool, []byte(caStrList[i].Value)); err != nil {
+			return fmt.Errorf("load CA '%s': %v", caStrList[i].Name, err)
+		}
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, err := ReadBundle(f, pool, serverName)
+	if err != nil {
+		return fmt.Errorf("'%s': %v", args[0], err)
+	}
+	if err := DB.ImportBundle(b, *force); err != nil {
+		return fmt.Errorf("'%s': %v", args[0], err)
+	}
+	fmt.Printf("%s: %d statements applied, checkpoint %q\n", args[0], len(b.Statements), b.Header.To)
+	return nil
+}
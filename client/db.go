@@ -4,18 +4,21 @@ import (
 	"database/sql"
 	"errors"
 	"log"
-	"strings"
 	"time"
+	"util"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
 type db struct {
-	logger *log.Logger
-	conn   *sql.DB
+	logger  *log.Logger
+	conn    *sql.DB
+	dialect util.Dialect
+	// vars keeps sync_vars in files if the client has no database.
+	vars *fileVars
 }
 
-var DB = new(db)
+var DB = &db{dialect: util.MySQL}
 
 func (db *db) SetLogger(logger *log.Logger) {
 	db.logger = logger
@@ -25,15 +28,58 @@ func (db *db) Open(dsn string) error {
 	db.conn, err = sql.Open("mysql", dsn)
 	return err
 }
+
+// UseFileVars keeps sync_vars in JSON files of dir instead of the
+// database.
+func (db *db) UseFileVars(dir string) {
+	db.vars = &fileVars{dir: dir}
+}
 func (db *db) Conn() *sql.DB {
 	return db.conn
 }
 func (db *db) CheckConn() error {
+	if db.conn == nil && db.vars != nil {
+		return nil
+	}
 	_sql := "SELECT 'ping'"
 	var out string
 	return db.conn.QueryRow(_sql).Scan(&out)
 }
 func (db *db) CopyTable(dst, src string) error {
+	if db.vars != nil {
+		return db.vars.CopyTable(dst, src)
+	}
+	return db.execTable(src, func(createTable string) ([]string, error) {
+		return db.dialect.CopyTable(dst, src, createTable)
+	})
+}
+
+// ShadowSuffix names the table a staged full sync loads before it replaces
+// the live table, which is renamed with OldSuffix and dropped.
+const (
+	ShadowSuffix = "__shadow"
+	OldSuffix    = "__old"
+)
+
+// CreateShadowTable creates the empty shadow of table and returns its
+// name.
+func (db *db) CreateShadowTable(table string) (string, error) {
+	shadow := table + ShadowSuffix
+	return shadow, db.execTable(table, func(createTable string) ([]string, error) {
+		return db.dialect.CreateTableLike(shadow, table, createTable)
+	})
+}
+
+// SwapShadowTable replaces table by its shadow.
+func (db *db) SwapShadowTable(table string) error {
+	return db.execTable("", func(string) ([]string, error) {
+		return db.dialect.SwapTables(table, table+ShadowSuffix, table+OldSuffix), nil
+	})
+}
+
+// execTable runs the statements of stmts in a transaction, they are
+// passed the create statement of table src if it is not empty.
+func (db *db) execTable(src string, stmts func(createTable string) ([]string, error)) error {
 	tx, err := db.conn.Begin()
 	if err != nil {
 		return err
@@ -46,40 +92,28 @@ func (db *db) CopyTable(dst, src string) error {
 	}()
 
 	// Step 0. Get source table struct
-	qs := db.BeforeQuery("SHOW CREATE TABLE `" + src + "`")
-	var table, createTable string
-	err = tx.QueryRow(qs.SQL).Scan(&table, &createTable)
-	qs.EndQuery(err)
-	if err != nil {
-		return err
-	}
-	// replace table name with dst table
-	pos := strings.IndexByte(createTable, '(')
-	if pos < 12 { /* length of "CREATE TABLE" */
-		return errors.New("bad create table syntax")
-	}
-	createTable = "CREATE TABLE `" + dst + "` " + createTable[pos:]
-
-	// Step 1. Drop target table
-	qs = db.BeforeQuery("DROP TABLE IF EXISTS `" + dst + "`")
-	_, err = tx.Exec(qs.SQL)
-	qs.EndQuery(err)
-	if err != nil {
-		return err
+	var createTable string
+	if q := db.dialect.ShowCreateTable(src); src != "" && q != "" {
+		qs := db.BeforeQuery(q)
+		var table string
+		err = tx.QueryRow(qs.SQL).Scan(&table, &createTable)
+		qs.EndQuery(err)
+		if err != nil {
+			return err
+		}
 	}
-	// Step 2. Create target table
-	qs = db.BeforeQuery(createTable)
-	_, err = tx.Exec(qs.SQL)
-	qs.EndQuery(err)
+	// Step 1. Run statements on target table
+	list, err := stmts(createTable)
 	if err != nil {
 		return err
 	}
-	// Step 3. Copy data
-	qs = db.BeforeQuery("INSERT INTO `" + dst + "` SELECT * FROM `" + src + "`")
-	_, err = tx.Exec(qs.SQL)
-	qs.EndQuery(err)
-	if err != nil {
-		return err
+	for _, stmt := range list {
+		qs := db.BeforeQuery(stmt)
+		_, err = tx.Exec(qs.SQL)
+		qs.EndQuery(err)
+		if err != nil {
+			return err
+		}
 	}
 	rollback = false
 	if err = tx.Commit(); err != nil {
@@ -87,7 +121,45 @@ func (db *db) CopyTable(dst, src string) error {
 	}
 	return nil
 }
+
+// CreateVarsTable creates sync_vars, which holds the config of the client.
+func (db *db) CreateVarsTable() error {
+	if db.conn == nil {
+		return nil
+	}
+	qs := db.BeforeQuery("CREATE TABLE IF NOT EXISTS sync_vars (" +
+		"name VARCHAR(64) NOT NULL PRIMARY KEY, " +
+		"value MEDIUMTEXT NOT NULL)")
+	_, err := db.conn.Exec(qs.SQL)
+	qs.EndQuery(err)
+	return err
+}
+
+// ConflictTable records server rows whose lww columns were not applied
+// because the client row has a newer version, the server fills it.
+const ConflictTable = "sync_conflicts"
+
+func (db *db) CreateConflictTable() error {
+	if db.conn == nil {
+		return nil
+	}
+	qs := db.BeforeQuery("CREATE TABLE IF NOT EXISTS `" + ConflictTable + "` (" +
+		"id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"table_name VARCHAR(64) NOT NULL, " +
+		"row_key VARCHAR(255) NOT NULL, " +
+		"column_names VARCHAR(1024) NOT NULL, " +
+		"server_version VARCHAR(64) NULL, " +
+		"client_version VARCHAR(64) NULL, " +
+		"resolution VARCHAR(16) NOT NULL, " +
+		"detected_at DATETIME NOT NULL)")
+	_, err := db.conn.Exec(qs.SQL)
+	qs.EndQuery(err)
+	return err
+}
 func (db *db) GetValue(name string) (string, error) {
+	if db.vars != nil {
+		return db.vars.GetValue(name)
+	}
 	qs := db.BeforeQuery("SELECT value FROM sync_vars WHERE name=?", name)
 	row := DB.conn.QueryRow(qs.SQL, qs.Params...)
 	var value string
@@ -106,11 +178,23 @@ func (db *db) RequireValue(name string) (string, error) {
 	return val, err
 }
 func (db *db) SetValue(name string, value string) error {
+	if db.vars != nil {
+		return db.vars.SetValue(name, value)
+	}
 	qs := db.BeforeQuery("INSERT INTO sync_vars(name, value) VALUES (?,?) ON DUPLICATE KEY UPDATE value=VALUES(value)", name, value)
 	_, err := DB.conn.Exec(qs.SQL, qs.Params...)
 	qs.EndQuery(err)
 	return err
 }
+func (db *db) DeleteValue(name string) error {
+	if db.vars != nil {
+		return db.vars.DeleteValue(name)
+	}
+	qs := db.BeforeQuery("DELETE FROM sync_vars WHERE name=?", name)
+	_, err := DB.conn.Exec(qs.SQL, qs.Params...)
+	qs.EndQuery(err)
+	return err
+}
 
 type KeyValuePair struct {
 	Name  string
@@ -118,12 +202,20 @@ type KeyValuePair struct {
 }
 
 func (db *db) GetValues(name string) ([]KeyValuePair, error) {
-	qs := db.BeforeQuery("SELECT name,value FROM sync_vars WHERE name LIKE ?", name)
+	if db.vars != nil {
+		return db.vars.GetValues(name)
+	}
+	return db.queryValues("SELECT name,value FROM sync_vars WHERE name LIKE ?", name)
+}
+
+func (db *db) queryValues(query string, params ...interface{}) ([]KeyValuePair, error) {
+	qs := db.BeforeQuery(query, params...)
 	res, err := DB.conn.Query(qs.SQL, qs.Params...)
 	qs.EndQuery(err)
 	if err != nil {
 		return nil, err
 	}
+	defer res.Close()
 	var values []KeyValuePair
 	for res.Next() {
 		var name, val string
@@ -179,11 +271,16 @@ func (qs QueryStat) EndQuery(err error) {
 }
 
 const (
-	ValueClientID      = "client_uuid"
-	ValueServerAddr    = "server"
-	ValueServerName    = "server_name"
-	ValueServerCA      = "server_ca%"
-	ValueCert          = "cert"
-	ValueCertKey       = "cert_key"
-	ValueTimeoutConfig = "timeout_config"
+	ValueClientID        = "client_uuid"
+	ValueServerAddr      = "server"
+	ValueServerName      = "server_name"
+	ValueServerCA        = "server_ca%"
+	ValueCert            = "cert"
+	ValueCertKey         = "cert_key"
+	ValueTimeoutConfig   = "timeout_config"
+	ValueSQLPolicy       = "sql_policy"
+	ValueAuditRedact     = "audit_redact"
+	ValueUpstream        = "upstream"
+	ValueServerMessage   = "server_message"
+	ValueCertFingerprint = "cert_fingerprint"
 )
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// HistoryTable keeps generations of sync_vars with the outcome of the
+// connection made with each, a failed config is replaced by the newest
+// generation known to work. It replaces the single backup sync_vars__1.
+const HistoryTable = "sync_vars_history"
+
+// HistoryKeep is how many generations are kept, the newest known good
+// generation is kept even if it is older.
+const HistoryKeep = 10
+
+const (
+	OutcomeOK      = "ok"
+	OutcomeFailed  = "failed"
+	OutcomeUnknown = "unknown"
+)
+
+// historyExcluded are sync_vars values which are state rather than
+// config, they are not saved in generations and survive a restore. The
+// UUID is set after the first generation is saved.
+var historyExcluded = map[string]bool{
+	ValueClientID:         true,
+	ValueServerMessage:    true,
+	ValueCertFingerprint:  true,
+	ValueBundleCheckpoint: true,
+	ValueBundleCreated:    true,
+}
+
+const historyTimeFormat = "2006-01-02 15:04:05"
+
+// Generation is a saved copy of sync_vars.
+type Generation struct {
+	ID      int64
+	Created time.Time
+	Outcome string
+	Vars    map[string]string
+}
+
+// CreateHistoryTable creates HistoryTable, an empty history starts with
+// the backup sync_vars__1 of older clients.
+func (db *db) CreateHistoryTable() error {
+	if db.vars != nil {
+		return nil
+	}
+	qs := db.BeforeQuery("CREATE TABLE IF NOT EXISTS `" + HistoryTable + "` (" +
+		"id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, " +
+		"created DATETIME NOT NULL, " +
+		"outcome VARCHAR(16) NOT NULL, " +
+		"vars MEDIUMTEXT NOT NULL)")
+	_, err := db.conn.Exec(qs.SQL)
+	qs.EndQuery(err)
+	if err != nil {
+		return err
+	}
+
+	gens, err := db.Generations()
+	if err != nil || len(gens) > 0 {
+		return err
+	}
+	qs = db.BeforeQuery("SHOW TABLES LIKE 'sync\\_vars\\_\\_1'")
+	var name string
+	err = db.conn.QueryRow(qs.SQL).Scan(&name)
+	qs.EndQuery(err)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	vars, err := db.readVars("sync_vars__1")
+	if err != nil {
+		return fmt.Errorf("read sync_vars__1: %v", err)
+	}
+	// sync_vars__1 was saved after a successful connect
+	g := &Generation{Created: time.Now(), Outcome: OutcomeOK, Vars: vars}
+	if err := db.putGeneration(g); err != nil {
+		return err
+	}
+	log.Printf("info: sync_vars__1 migrated to %s generation %d", HistoryTable, g.ID)
+	return nil
+}
+
+// Generations returns the saved generations, newest first.
+func (db *db) Generations() ([]*Generation, error) {
+	if db.vars != nil {
+		return db.vars.Generations()
+	}
+	qs := db.BeforeQuery("SELECT id,created,outcome,vars FROM `" + HistoryTable + "` ORDER BY id DESC")
+	rows, err := db.conn.Query(qs.SQL)
+	qs.EndQuery(err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var gens []*Generation
+	for rows.Next() {
+		g := new(Generation)
+		var created, vars string
+		if err := rows.Scan(&g.ID, &created, &g.Outcome, &vars); err != nil {
+			return nil, err
+		}
+		g.Created, _ = time.ParseInLocation(historyTimeFormat, created, time.UTC)
+		if err := json.Unmarshal([]byte(vars), &g.Vars); err != nil {
+			return nil, fmt.Errorf("generation %d: %v", g.ID, err)
+		}
+		gens = append(gens, g)
+	}
+	return gens, rows.Err()
+}
+
+// Generation returns the generation with id.
+func (db *db) Generation(id int64) (*Generation, error) {
+	gens, err := db.Generations()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range gens {
+		if g.ID == id {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("generation %d not found", id)
+}
+
+// SaveGeneration saves sync_vars with outcome. If they equal the newest
+// generation, its outcome and time are updated instead, but a generation
+// known good is never downgraded: a failure with a config which worked is
+// not caused by the config. The generation returned has outcome OK then.
+func (db *db) SaveGeneration(outcome string) (*Generation, error) {
+	vars, err := db.readVars("sync_vars")
+	if err != nil {
+		return nil, err
+	}
+	gens, err := db.Generations()
+	if err != nil {
+		return nil, err
+	}
+	g := &Generation{Vars: vars}
+	if len(gens) > 0 && equalVars(gens[0].Vars, vars) {
+		g = gens[0]
+		if g.Outcome == OutcomeOK && outcome != OutcomeOK {
+			return g, nil
+		}
+	} else {
+		gens = append([]*Generation{g}, gens...)
+	}
+	g.Created, g.Outcome = time.Now(), outcome
+	if err := db.putGeneration(g); err != nil {
+		return nil, err
+	}
+
+	// prune old generations, the newest known good one stays
+	good := false
+	for i, old := range gens {
+		keep := i < HistoryKeep
+		if old.Outcome == OutcomeOK && !good {
+			keep, good = true, true
+		}
+		if !keep {
+			if err := db.deleteGeneration(old.ID); err != nil {
+				return g, err
+			}
+		}
+	}
+	return g, nil
+}
+
+// RestoreKnownGood restores the newest good generation which differs from
+// sync_vars, it returns nil if there is none or sync_vars is known good.
+func (db *db) RestoreKnownGood() (*Generation, error) {
+	vars, err := db.readVars("sync_vars")
+	if err != nil {
+		return nil, err
+	}
+	gens, err := db.Generations()
+	if err != nil {
+		return nil, err
+	}
+	var good *Generation
+	for _, g := range gens {
+		if g.Outcome != OutcomeOK {
+			continue
+		}
+		if equalVars(g.Vars, vars) {
+			return nil, nil
+		}
+		if good == nil {
+			good = g
+		}
+	}
+	if good == nil {
+		return nil, nil
+	}
+	return good, db.RestoreGeneration(good)
+}
+
+// RestoreGeneration replaces sync_vars by g, values in historyExcluded
+// keep their current value.
+func (db *db) RestoreGeneration(g *Generation) error {
+	if db.vars != nil {
+		return db.vars.RestoreGeneration(g)
+	}
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	exec := func(query string, params ...interface{}) error {
+		qs := db.BeforeQuery(query, params...)
+		_, err := tx.Exec(qs.SQL, qs.Params...)
+		qs.EndQuery(err)
+		return err
+	}
+	var names []interface{}
+	query := "DELETE FROM sync_vars"
+	for name := range historyExcluded {
+		if len(names) == 0 {
+			query += " WHERE name NOT IN (?"
+		} else {
+			query += ",?"
+		}
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		query += ")"
+	}
+	if err := exec(query, names...); err != nil {
+		return err
+	}
+	for name, value := range g.Vars {
+		if historyExcluded[name] {
+			continue
+		}
+		if err := exec("INSERT INTO sync_vars(name, value) VALUES (?,?)", name, value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// readVars reads the config values of table, a copy of sync_vars.
+func (db *db) readVars(table string) (map[string]string, error) {
+	var values []KeyValuePair
+	var err error
+	if db.vars != nil {
+		if table != "sync_vars" {
+			return nil, errors.New("only sync_vars without database")
+		}
+		values, err = db.vars.GetValues("%")
+	} else {
+		values, err = db.queryValues("SELECT name,value FROM `" + table + "`")
+	}
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string, len(values))
+	for _, kv := range values {
+		if !historyExcluded[kv.Name] {
+			vars[kv.Name] = kv.Value
+		}
+	}
+	return vars, nil
+}
+
+func (db *db) putGeneration(g *Generation) error {
+	if db.vars != nil {
+		return db.vars.putGeneration(g)
+	}
+	vars, err := json.Marshal(g.Vars)
+	if err != nil {
+		return err
+	}
+	created := g.Created.UTC().Format(historyTimeFormat)
+	if g.ID != 0 {
+		qs := db.BeforeQuery("UPDATE `"+HistoryTable+"` SET created=?, outcome=? WHERE id=?", created, g.Outcome, g.ID)
+		_, err := db.conn.Exec(qs.SQL, qs.Params...)
+		qs.EndQuery(err)
+		return err
+	}
+	qs := db.BeforeQuery("INSERT INTO `"+HistoryTable+"`(created, outcome, vars) VALUES (?,?,?)", created, g.Outcome, string(vars))
+	res, err := db.conn.Exec(qs.SQL, qs.Params...)
+	qs.EndQuery(err)
+	if err != nil {
+		return err
+	}
+	g.ID, err = res.LastInsertId()
+	return err
+}
+
+func (db *db) deleteGeneration(id int64) error {
+	if db.vars != nil {
+		return db.vars.deleteGeneration(id)
+	}
+	qs := db.BeforeQuery("DELETE FROM `"+HistoryTable+"` WHERE id=?", id)
+	_, err := db.conn.Exec(qs.SQL, qs.Params...)
+	qs.EndQuery(err)
+	return err
+}
+
+// Generations of fileVars are kept in "sync_vars_history.json", newest
+// first.
+func (fv *fileVars) Generations() ([]*Generation, error) {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	return fv.loadHistory()
+}
+
+func (fv *fileVars) loadHistory() ([]*Generation, error) {
+	var gens []*Generation
+	data, err := ioutil.ReadFile(fv.filename(HistoryTable))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gens, json.Unmarshal(data, &gens)
+}
+
+func (fv *fileVars) saveHistory(gens []*Generation) error {
+	sort.Slice(gens, func(i, j int) bool { return gens[i].ID > gens[j].ID })
+	data, err := json.MarshalIndent(gens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fv.filename(HistoryTable), data)
+}
+
+func (fv *fileVars) putGeneration(g *Generation) error {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	gens, err := fv.loadHistory()
+	if err != nil {
+		return err
+	}
+	if g.ID == 0 {
+		g.ID = 1
+		if len(gens) > 0 {
+			g.ID = gens[0].ID + 1
+		}
+		gens = append(gens, g)
+	}
+	for i := range gens {
+		if gens[i].ID == g.ID {
+			gens[i] = g
+		}
+	}
+	return fv.saveHistory(gens)
+}
+
+func (fv *fileVars) deleteGeneration(id int64) error {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	gens, err := fv.loadHistory()
+	if err != nil {
+		return err
+	}
+	res := gens[:0]
+	for _, g := range gens {
+		if g.ID != id {
+			res = append(res, g)
+		}
+	}
+	return fv.saveHistory(res)
+}
+
+func (fv *fileVars) RestoreGeneration(g *Generation) error {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	values, err := fv.load("sync_vars")
+	if err != nil {
+		return err
+	}
+	res := make(map[string]string, len(g.Vars))
+	for name, value := range values {
+		if historyExcluded[name] {
+			res[name] = value
+		}
+	}
+	for name, value := range g.Vars {
+		if !historyExcluded[name] {
+			res[name] = value
+		}
+	}
+	return fv.save("sync_vars", res)
+}
+
+func equalVars(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
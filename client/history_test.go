@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newFileVarsDB(t *testing.T) (*db, func()) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &db{}
+	d.UseFileVars(dir)
+	return d, func() { os.RemoveAll(dir) }
+}
+
+func outcomes(t *testing.T, d *db) []string {
+	gens, err := d.Generations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, g := range gens {
+		res = append(res, fmt.Sprintf("%s=%s", g.Vars["server_addr"], g.Outcome))
+	}
+	return res
+}
+
+func TestSaveGenerationKeepsKnownGood(t *testing.T) {
+	d, cleanup := newFileVarsDB(t)
+	defer cleanup()
+
+	d.SetValue("server_addr", "a:1")
+	if _, err := d.SaveGeneration(OutcomeOK); err != nil {
+		t.Fatal(err)
+	}
+	// a server outage with the same config
+	g, err := d.SaveGeneration(OutcomeFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Outcome != OutcomeOK {
+		t.Errorf("known good generation saved as %s", g.Outcome)
+	}
+	if _, err := d.SaveGeneration(OutcomeUnknown); err != nil {
+		t.Fatal(err)
+	}
+	if res := fmt.Sprint(outcomes(t, d)); res != "[a:1=ok]" {
+		t.Errorf("generations %s", res)
+	}
+	g, err = d.RestoreKnownGood()
+	if err != nil || g != nil {
+		t.Errorf("known good config restored: %v, %v", g, err)
+	}
+
+	// a failed config is upgraded once it works
+	d.SetValue("server_addr", "b:1")
+	d.SaveGeneration(OutcomeFailed)
+	d.SaveGeneration(OutcomeOK)
+	if res := fmt.Sprint(outcomes(t, d)); res != "[b:1=ok a:1=ok]" {
+		t.Errorf("generations %s", res)
+	}
+}
+
+func TestRestoreKnownGood(t *testing.T) {
+	d, cleanup := newFileVarsDB(t)
+	defer cleanup()
+
+	d.SetValue("server_addr", "a:1")
+	d.SetValue(ValueBundleCheckpoint, "10")
+	d.SaveGeneration(OutcomeOK)
+	d.SetValue("server_addr", "b:1")
+	d.SaveGeneration(OutcomeFailed)
+	d.SetValue(ValueBundleCheckpoint, "20")
+
+	g, err := d.RestoreKnownGood()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g == nil || g.Vars["server_addr"] != "a:1" {
+		t.Fatalf("restored %v", g)
+	}
+	if v, _ := d.GetValue("server_addr"); v != "a:1" {
+		t.Errorf("server_addr %s after restore", v)
+	}
+	if v, _ := d.GetValue(ValueBundleCheckpoint); v != "20" {
+		t.Errorf("%s %s after restore, want 20", ValueBundleCheckpoint, v)
+	}
+
+	// a config known good by an older generation is kept
+	d.SetValue("server_addr", "c:1")
+	d.SaveGeneration(OutcomeOK)
+	d.SetValue("server_addr", "a:1")
+	d.SaveGeneration(OutcomeFailed)
+	if g, err := d.RestoreKnownGood(); err != nil || g != nil {
+		t.Errorf("known good config replaced by %v, %v", g, err)
+	}
+}
+
+func TestRestoreGenerationKeepsState(t *testing.T) {
+	d, cleanup := newFileVarsDB(t)
+	defer cleanup()
+
+	// the first generation is saved before the server assigns the UUID
+	d.SetValue("server_addr", "a:1")
+	g, err := d.SaveGeneration(OutcomeOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetValue(ValueClientID, "uuid-1")
+	d.SetValue(ValueCertFingerprint, "fp")
+	d.SetValue(ValueServerMessage, "hello")
+	d.SetValue("server_addr", "b:1")
+
+	if err := d.RestoreGeneration(g); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"server_addr":        "a:1",
+		ValueClientID:        "uuid-1",
+		ValueCertFingerprint: "fp",
+		ValueServerMessage:   "hello",
+	} {
+		if v, _ := d.GetValue(name); v != want {
+			t.Errorf("%s %q after restore, want %q", name, v, want)
+		}
+	}
+}
+
+func TestSaveGenerationPrune(t *testing.T) {
+	d, cleanup := newFileVarsDB(t)
+	defer cleanup()
+
+	d.SetValue("server_addr", "good:1")
+	d.SaveGeneration(OutcomeOK)
+	for i := 0; i < HistoryKeep+3; i++ {
+		d.SetValue("server_addr", fmt.Sprintf("bad:%d", i))
+		if _, err := d.SaveGeneration(OutcomeFailed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := outcomes(t, d)
+	if len(res) != HistoryKeep+1 {
+		t.Fatalf("%d generations kept, want %d: %v", len(res), HistoryKeep+1, res)
+	}
+	if res[0] != fmt.Sprintf("bad:%d=failed", HistoryKeep+2) || res[len(res)-1] != "good:1=ok" {
+		t.Errorf("generations %v", res)
+	}
+
+	// without an older good generation the newest HistoryKeep stay
+	d.SetValue("server_addr", "good:2")
+	d.SaveGeneration(OutcomeOK)
+	d.SetValue("server_addr", "bad:x")
+	d.SaveGeneration(OutcomeFailed)
+	res = outcomes(t, d)
+	if len(res) != HistoryKeep || res[1] != "good:2=ok" {
+		t.Errorf("generations %v", res)
+	}
+}
@@ -4,11 +4,30 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
+	"util"
+)
+
+// Files of the client in the working directory, commands override them
+// by flags.
+var (
+	DSNFile      = "db.dsn"
+	LogFile      = "dbsync.log"
+	QueryLogFile = "query.log"
 )
 
 func main() {
-	flog, err := os.OpenFile("dbsync.log", os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0755)
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		os.Exit(runCommand(args[0], args[1:]))
+	}
+	os.Exit(runCommand("run", args))
+}
+
+// run connects to the server and serves it until the process is killed.
+func run() {
+	flog, err := os.OpenFile(LogFile, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0755)
 	if err != nil {
 		log.Fatalf("FAILED write log: %v", err)
 		return
@@ -17,7 +36,7 @@ func main() {
 	log.SetOutput(io.MultiWriter(os.Stderr, flog))
 	log.Println("info: app started")
 
-	qlog, err := os.OpenFile("query.log", os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0755)
+	qlog, err := os.OpenFile(QueryLogFile, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0755)
 	if err != nil {
 		log.Fatalf("FAILED write query log: %v", err)
 		return
@@ -25,19 +44,36 @@ func main() {
 	defer qlog.Close()
 	DB.SetLogger(log.New(qlog, "", log.LstdFlags))
 
-	dsn, err := readDSN("db.dsn")
-	if err != nil {
-		log.Fatalf("FAILED open db.dsn: %v", err)
+	if err := Audit.Open(AuditLogFile); err != nil {
+		log.Fatalf("FAILED open audit log: %v", err)
 		return
 	}
-	log.Printf("dsn: %s", dsn)
+	defer Audit.Close()
 
-	if err = DB.Open(dsn); err != nil {
-		log.Fatalf("FAILED connect to database: %v", err)
+	sinkConfig, err := LoadSinkConfig(SinkConfigFile)
+	if err != nil {
+		log.Fatalf("FAILED load sink config: %v", err)
 		return
 	}
-
 	client := new(Client)
+	if sinkConfig != nil {
+		log.Printf("info: %s sink in '%s', no database", sinkConfig.Format, sinkConfig.Dir)
+		DB.UseFileVars(sinkConfig.Dir)
+		client.sink = NewFileSink(sinkConfig)
+	} else {
+		dsn, err := util.ReadDSN(DSNFile)
+		if err != nil {
+			log.Fatalf("FAILED open %s: %v", DSNFile, err)
+			return
+		}
+		log.Printf("dsn: %s", util.MaskDSN(dsn))
+
+		if err = DB.Open(dsn); err != nil {
+			log.Fatalf("FAILED connect to database: %v", err)
+			return
+		}
+	}
+
 	var prepareTLS = func(maxTry int) (err error) {
 		for retry := 0; maxTry < 0 || retry < maxTry; retry++ {
 			err = DB.CheckConn()
@@ -83,25 +119,34 @@ func main() {
 		return
 	}
 
+	if err := DB.CreateHistoryTable(); err != nil {
+		log.Printf("ERROR create table '%s': %v", HistoryTable, err)
+	}
 	err = connectServer(6)
 	if err != nil {
 		log.Printf("info: max retry reached, try recover last config")
-		err = DB.CopyTable("sync_vars", "sync_vars__1")
+		if _, err := DB.SaveGeneration(OutcomeFailed); err != nil {
+			log.Printf("ERROR save failed config: %v", err)
+		}
+		g, err := DB.RestoreKnownGood()
 		if err != nil {
-			log.Printf("ERROR recover config from `sync_vars__1`: %v", err)
+			log.Printf("ERROR recover config from '%s': %v", HistoryTable, err)
+		} else if g == nil {
+			log.Printf("info: config is known good or no known good config to recover")
 		} else {
-			log.Printf("info: config recovered")
+			log.Printf("info: config recovered from generation %d of %s", g.ID, g.Created.Format(time.RFC3339))
 		}
 	} else {
-		err = DB.CopyTable("sync_vars__1", "sync_vars")
+		g, err := DB.SaveGeneration(OutcomeOK)
 		if err != nil {
-			log.Printf("ERROR save config to 'sync_vars__1': %v", err)
+			log.Printf("ERROR save config to '%s': %v", HistoryTable, err)
 		} else {
-			log.Printf("info: config saved")
+			log.Printf("info: config saved as generation %d", g.ID)
 		}
 	}
 
 	heartbeatStarted := false
+	upstreamStarted := false
 	notifyConnected := false
 	log.Printf("info: start monitoring")
 	for {
@@ -117,6 +162,14 @@ func main() {
 				log.Printf("ERROR client.SetupHeartbeat: %v", err)
 			}()
 		}
+		if !upstreamStarted && client.SeverConnected() {
+			go func() {
+				upstreamStarted = true
+				err := client.RunUpstream()
+				upstreamStarted = false
+				log.Printf("ERROR client.RunUpstream: %v", err)
+			}()
+		}
 		if !notifyConnected && client.SeverConnected() {
 			log.Printf("info: connect notify server")
 			go func() {
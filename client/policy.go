@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"util"
+)
+
+// SQLPolicy restricts the SQL the server may run through RpcDB. It is read
+// from the local file PolicyFile if present, otherwise from the sync_vars
+// value ValueSQLPolicy, both in JSON.
+type SQLPolicy struct {
+	// ReadOnly allows only statements in ReadOnlyStatements.
+	ReadOnly bool
+	// Statements lists allowed statement types, DefaultPolicyStatements if
+	// empty.
+	Statements []string
+	// Tables lists allowed tables as "table", "schema.table" or a pattern
+	// like "schema.*". Tables without schema refer to the current
+	// database. An empty list allows every table not in DenyTables.
+	Tables []string
+	// DenyTables is checked before Tables, DefaultPolicyDenyTables if nil.
+	DenyTables []string
+
+	database string
+}
+
+var DefaultPolicyStatements = []string{"SELECT", "SHOW", "DESC", "DESCRIBE", "EXPLAIN", "INSERT", "REPLACE", "UPDATE", "DELETE"}
+var DefaultPolicyDenyTables = []string{"sync_vars*"}
+var ReadOnlyStatements = []string{"SELECT", "SHOW", "DESC", "DESCRIBE", "EXPLAIN"}
+
+var PolicyFile = "sql_policy.json"
+
+var policyMu sync.RWMutex
+var policy = &SQLPolicy{}
+
+func currentPolicy() *SQLPolicy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return policy
+}
+
+// LoadSQLPolicy reads the policy and makes it current, on error the previous
+// policy is kept.
+func LoadSQLPolicy() error {
+	var data []byte
+	var source string
+	if _, err := os.Stat(PolicyFile); err == nil {
+		data, err = ioutil.ReadFile(PolicyFile)
+		if err != nil {
+			return err
+		}
+		source = PolicyFile
+	} else {
+		v, err := DB.GetValue(ValueSQLPolicy)
+		if err != nil {
+			return err
+		}
+		data = []byte(v)
+		source = "sync_vars." + ValueSQLPolicy
+	}
+
+	p := new(SQLPolicy)
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, p); err != nil {
+			return fmt.Errorf("parse %s: %v", source, err)
+		}
+	} else {
+		source = "default"
+	}
+
+	qs := DB.BeforeQuery("SELECT IFNULL(DATABASE(), '')")
+	err := DB.conn.QueryRow(qs.SQL).Scan(&p.database)
+	qs.EndQuery(err)
+	if err != nil {
+		return err
+	}
+
+	policyMu.Lock()
+	policy = p
+	policyMu.Unlock()
+	log.Printf("info: sql policy loaded from %s, readOnly=%v", source, p.ReadOnly)
+	return nil
+}
+
+type PolicyError struct {
+	SQL    string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return "policy: " + e.Reason
+}
+
+// Check returns a *PolicyError if query is not allowed. Rejections are
+// logged here so every caller reports them the same way.
+func (p *SQLPolicy) Check(query string) error {
+	err := p.check(query)
+	if err != nil {
+		log.Printf("ERROR policy rejected %q: %v", query, err)
+	}
+	return err
+}
+
+func (p *SQLPolicy) check(query string) error {
+	st, err := util.ScanSQL(query)
+	if err != nil {
+		return &PolicyError{query, err.Error()}
+	}
+	if st.Multi {
+		return &PolicyError{query, "multiple statements not allowed"}
+	}
+	if st.File {
+		return &PolicyError{query, "file access not allowed"}
+	}
+	if st.Incomplete {
+		return &PolicyError{query, "table references not understood"}
+	}
+
+	statements := p.Statements
+	if len(statements) == 0 {
+		statements = DefaultPolicyStatements
+	}
+	if !util.ContainsFold(statements, st.Type) || (p.ReadOnly && !util.ContainsFold(ReadOnlyStatements, st.Type)) {
+		return &PolicyError{query, fmt.Sprintf("statement %s not allowed", st.Type)}
+	}
+
+	for _, table := range st.Tables {
+		if !p.allowTable(table) {
+			return &PolicyError{query, fmt.Sprintf("table %s not allowed", p.qualify(table))}
+		}
+	}
+	return nil
+}
+
+// CheckWrite returns a *PolicyError if table can not be written, like
+// Check it logs rejections.
+func (p *SQLPolicy) CheckWrite(table string) error {
+	var err error
+	switch {
+	case p.ReadOnly:
+		err = &PolicyError{table, "read-only"}
+	case !isTableName(table):
+		err = &PolicyError{table, "bad table name"}
+	case !p.allowTable(table):
+		err = &PolicyError{table, fmt.Sprintf("table %s not allowed", p.qualify(table))}
+	}
+	if err != nil {
+		log.Printf("ERROR policy rejected %q: %v", table, err)
+	}
+	return err
+}
+
+// allowTable checks table against DenyTables and Tables. The shadow of a
+// staged full sync is allowed if its live table is.
+func (p *SQLPolicy) allowTable(table string) bool {
+	deny := p.DenyTables
+	if deny == nil {
+		deny = DefaultPolicyDenyTables
+	}
+	table = p.qualify(table)
+	live := strings.TrimSuffix(table, ShadowSuffix)
+	if p.matchTable(deny, table) || p.matchTable(deny, live) {
+		return false
+	}
+	return len(p.Tables) == 0 || p.matchTable(p.Tables, live)
+}
+
+func (p *SQLPolicy) qualify(table string) string {
+	return util.QualifyTable(p.database, table)
+}
+
+func (p *SQLPolicy) matchTable(patterns []string, table string) bool {
+	return util.MatchTable(p.database, patterns, table)
+}
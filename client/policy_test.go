@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestSQLPolicyCheck(t *testing.T) {
+	p := &SQLPolicy{Tables: []string{"bus_*"}, database: "branch"}
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"SELECT * FROM bus_authorized", true},
+		{"INSERT INTO bus_authorized(id) VALUES (1)", true},
+		{"SELECT * FROM sync_vars", false},
+		{"SELECT * FROM bus_a, (sync_vars)", false},
+		{"SELECT * FROM bus_a /* sync_vars */", true},
+		{"SELECT * FROM bus_a /*!, sync_vars */", false},
+		{"SELECT * FROM bus_a /*M!, sync_vars */", false},
+		{"SELECT * FROM bus_a /*M!100000 , sync_vars */", false},
+		{"DELETE FROM bus_a /*M! USING bus_a, sync_vars */", false},
+		{"SELECT * FROM other", false},
+		{"DROP TABLE bus_authorized", false},
+	}
+	for _, test := range tests {
+		err := p.check(test.query)
+		if (err == nil) != test.ok {
+			t.Errorf("check(%q) = %v", test.query, err)
+		}
+	}
+}
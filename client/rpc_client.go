@@ -3,13 +3,22 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 	"util"
 )
 
-type RpcClient int
+type RpcClient struct {
+	caller *AuditCaller
+	sink   *FileSink
+}
+
+func (r *RpcClient) audit(method string, args interface{}, stime time.Time, err error) {
+	Audit.Record(r.caller, method, args, stime, err, 0)
+}
 
 type ClientConnectArgs struct {
 	ClientID     string
@@ -30,12 +39,25 @@ type ClientRestartArgs struct {
 	Message string
 }
 
-func (*RpcClient) Connect(args *ClientConnectArgs, reply *ClientConnectReply) error {
+func (r *RpcClient) Connect(args *ClientConnectArgs, reply *ClientConnectReply) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("client.Connect", args, stime, err) }()
 	return errors.New("not supported")
 }
-func (*RpcClient) GetValue(key string, value *string) (err error) {
-	if strings.HasPrefix(key, "sql_") && !strings.Contains(key, "%") && !strings.Contains(key, "'") {
-		qs := DB.BeforeQuery("SHOW GLOBAL VARIABLES LIKE '" + strings.TrimPrefix(key, "sql_") + "'")
+func (r *RpcClient) GetValue(key string, value *string) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("client.GetValue", key, stime, err) }()
+	if strings.HasPrefix(key, "sql_") {
+		name := strings.TrimPrefix(key, "sql_")
+		if !isVariableName(name) {
+			return errors.New("bad variable name")
+		}
+		if DB.conn == nil {
+			// no database, the server keeps its defaults
+			return nil
+		}
+		// '_' is a wildcard of LIKE
+		qs := DB.BeforeQuery("SHOW GLOBAL VARIABLES LIKE '" + strings.Replace(name, "_", "\\_", -1) + "'")
 		row := DB.conn.QueryRow(qs.SQL)
 		var _dummy string
 		err := row.Scan(&_dummy, value)
@@ -49,6 +71,11 @@ func (*RpcClient) GetValue(key string, value *string) (err error) {
 	switch key {
 	case "client_uuid":
 		*value, err = DB.GetValue(ValueClientID)
+	case "sink":
+		// empty if rows are applied by SQL through the "db" service
+		if r.sink != nil {
+			*value = r.sink.config.Format
+		}
 	case "timeout_config":
 		var v string
 		v, err = DB.GetValue(ValueTimeoutConfig)
@@ -68,16 +95,60 @@ func (*RpcClient) GetValue(key string, value *string) (err error) {
 	}
 	return
 }
-func (*RpcClient) Message(args *ClientMessageArgs, reply *int32) error {
+func isVariableName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '_' && (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// SetClientID stores the UUID assigned by the server, a UUID already set
+// is never replaced.
+func (r *RpcClient) SetClientID(clientUUID string, reply *int32) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("client.SetClientID", clientUUID, stime, err) }()
+	if clientUUID == "" {
+		return errors.New("client uuid required")
+	}
+	current, err := DB.GetValue(ValueClientID)
+	if err != nil {
+		return err
+	}
+	if current != "" {
+		if current != clientUUID {
+			return fmt.Errorf("client uuid already set to '%s'", current)
+		}
+		return nil
+	}
+	if err = DB.SetValue(ValueClientID, clientUUID); err != nil {
+		return err
+	}
+	log.Printf("info: client UUID set to '%s'", clientUUID)
+	return nil
+}
+
+func (r *RpcClient) Message(args *ClientMessageArgs, reply *int32) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("client.Message", args, stime, err) }()
 	log.Print("server message: ", args.Message)
 	return nil
 }
-func (*RpcClient) Ping(args int64, reply *int64) error {
+func (r *RpcClient) Ping(args int64, reply *int64) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("client.Ping", args, stime, err) }()
 	*reply = args
 	return nil
 }
 
-func (*RpcClient) Restart(args *ClientRestartArgs, reply *int64) error {
+func (r *RpcClient) Restart(args *ClientRestartArgs, reply *int64) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("client.Restart", args, stime, err) }()
 	if args.Magic != 0x1122334455667788 {
 		return errors.New("code mismatch")
 	}
@@ -85,6 +156,7 @@ func (*RpcClient) Restart(args *ClientRestartArgs, reply *int64) error {
 		return errors.New("message required")
 	}
 	log.Printf("server claim restart: %s", args.Message)
+	r.audit("client.Restart", args, stime, nil)
 	// TODO: some clean up
 	os.Exit(-127)
 	return nil
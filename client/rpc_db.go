@@ -2,12 +2,27 @@ package main
 
 import (
 	"database/sql"
+	"encoding/gob"
 	"errors"
-	"sync"
-	"sync/atomic"
+	"time"
+	"util"
 )
 
-type RpcDB int
+func init() {
+	// query parameters may be time.Time
+	gob.Register(time.Time{})
+}
+
+// RpcDB serves one notify connection, cursors, transactions and statements
+// it opens are owned by its session.
+type RpcDB struct {
+	caller *AuditCaller
+	s      *session
+}
+
+func (r *RpcDB) audit(method string, args interface{}, stime time.Time, err error, rows int64) {
+	Audit.Record(r.caller, method, args, stime, err, rows)
+}
 
 type DBQueryArgs struct {
 	Command string
@@ -15,6 +30,9 @@ type DBQueryArgs struct {
 	Stmt    int64
 	Tx      int64
 	Columns bool
+	// Typed requests results in Cells and column metadata in ColumnTypes
+	// instead of Results.
+	Typed bool
 }
 
 type DBExecReply struct {
@@ -22,12 +40,15 @@ type DBExecReply struct {
 	RowsAffected int64
 }
 type DBQueryReply struct {
-	Columns []string
-	Cursor  int64
+	Columns     []string
+	ColumnTypes []util.Column
+	Cursor      int64
 }
 type DBQueryAllReply struct {
-	Columns []string
-	Results [][]string
+	Columns     []string
+	ColumnTypes []util.Column
+	Results     [][]string
+	Cells       [][]util.Cell
 }
 type DBFetchArgs struct {
 	Cursor int64
@@ -36,6 +57,7 @@ type DBFetchArgs struct {
 type DBFetchReply struct {
 	End     bool
 	Results [][]string
+	Cells   [][]util.Cell
 }
 type DBBeginReply struct {
 	Tx int64
@@ -44,75 +66,29 @@ type DBPrepareReply struct {
 	Stmt int64
 }
 
-type openfile struct {
-	tx          *sql.Tx
-	stmt        *sql.Stmt
-	rows        *sql.Rows
-	columnCount int
-}
-
-var openfileIDGenerator int64
-var openfileCount int64
-var openfileMap map[int64]*openfile
-var openfileMu sync.RWMutex
-
-var MaxOpenfileCount int64 = 32
-
-func createOpenfile(of *openfile) (int64, error) {
-	count := atomic.AddInt64(&openfileCount, 1)
-	if count > MaxOpenfileCount {
-		atomic.AddInt64(&openfileCount, -1)
-		return 0, errors.New("too many open files")
-	}
-
-	id := atomic.AddInt64(&openfileIDGenerator, 1)
-	openfileMu.Lock()
-	openfileMap[id] = of
-	openfileMu.Unlock()
-	return id, nil
-}
-func retrieveOpenfile(id int64) (*openfile, error) {
-	var of *openfile
-	var ok bool
-
-	openfileMu.RLock()
-	of, ok = openfileMap[id]
-	openfileMu.RUnlock()
-	if ok {
-		return of, nil
-	}
-	return nil, errors.New("file not found")
-}
-func closeOpenfile(id int64) {
-	var countBefore, countAfter int
-	openfileMu.Lock()
-	countBefore = len(openfileMap)
-	delete(openfileMap, id)
-	countAfter = len(openfileMap)
-	openfileMu.Unlock()
-	if countAfter < countBefore {
-		atomic.AddInt64(&openfileCount, -1)
-	}
-}
-
-func (*RpcDB) Exec(args *DBQueryArgs, reply *DBExecReply) error {
-	q, err := getQuerier(args)
+func (r *RpcDB) Exec(args *DBQueryArgs, reply *DBExecReply) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.Exec", args, stime, err, reply.RowsAffected) }()
+	q, err := r.getQuerier(args)
 	if err != nil {
 		return err
 	}
 
-	qs := DB.BeforeQuery(args.Command, args.Params...)	
+	qs := DB.BeforeQuery(args.Command, args.Params...)
 	result, err := q.Exec(qs.SQL, qs.Params...)
 	qs.EndQuery(err)
 	if err != nil {
 		return err
 	}
+	markSynced()
 	reply.LastInsertID, _ = result.LastInsertId()
 	reply.RowsAffected, _ = result.RowsAffected()
 	return nil
 }
-func (*RpcDB) Query(args *DBQueryArgs, reply *DBQueryReply) error {
-	q, err := getQuerier(args)
+func (r *RpcDB) Query(args *DBQueryArgs, reply *DBQueryReply) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.Query", args, stime, err, 0) }()
+	q, err := r.getQuerier(args)
 	if err != nil {
 		return err
 	}
@@ -124,12 +100,22 @@ func (*RpcDB) Query(args *DBQueryArgs, reply *DBQueryReply) error {
 	}
 	columns, err := rows.Columns()
 	if err != nil {
+		rows.Close()
 		return err
 	}
 	if args.Columns {
 		reply.Columns = columns
 	}
-	id, err := createOpenfile(&openfile{rows: rows, columnCount: len(columns)})
+	of := &util.Handle{Rows: rows, ColumnCount: len(columns), SQL: args.Command}
+	if args.Typed {
+		of.ColumnTypes, err = util.ScanColumns(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		reply.ColumnTypes = of.ColumnTypes
+	}
+	id, err := r.s.Create(of)
 	if err != nil {
 		rows.Close()
 		return err
@@ -137,8 +123,10 @@ func (*RpcDB) Query(args *DBQueryArgs, reply *DBQueryReply) error {
 	reply.Cursor = id
 	return nil
 }
-func (*RpcDB) QueryAll(args *DBQueryArgs, reply *DBQueryAllReply) error {
-	q, err := getQuerier(args)
+func (r *RpcDB) QueryAll(args *DBQueryArgs, reply *DBQueryAllReply) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.QueryAll", args, stime, err, int64(len(reply.Results)+len(reply.Cells))) }()
+	q, err := r.getQuerier(args)
 	if err != nil {
 		return err
 	}
@@ -148,6 +136,7 @@ func (*RpcDB) QueryAll(args *DBQueryArgs, reply *DBQueryAllReply) error {
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 	columns, err := rows.Columns()
 	if err != nil {
 		return err
@@ -156,15 +145,25 @@ func (*RpcDB) QueryAll(args *DBQueryArgs, reply *DBQueryAllReply) error {
 		reply.Columns = columns
 	}
 
-	results, _, err := fetch(rows, len(columns), -1)
+	if args.Typed {
+		reply.ColumnTypes, err = util.ScanColumns(rows)
+		if err != nil {
+			return err
+		}
+		reply.Cells, _, err = util.ScanCells(rows, reply.ColumnTypes, -1)
+		return err
+	}
+	results, _, err := util.Fetch(rows, len(columns), -1)
 	if err != nil {
 		return err
 	}
 	reply.Results = results
 	return nil
 }
-func (*RpcDB) QueryScalar(args *DBQueryArgs, reply *int64) error {
-	q, err := getQuerier(args)
+func (r *RpcDB) QueryScalar(args *DBQueryArgs, reply *int64) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.QueryScalar", args, stime, err, 0) }()
+	q, err := r.getQuerier(args)
 	if err != nil {
 		return err
 	}
@@ -180,129 +179,90 @@ func (*RpcDB) QueryScalar(args *DBQueryArgs, reply *int64) error {
 	return nil
 }
 
-type querier interface {
-	Exec(query string, args ...interface{}) (sql.Result, error)
-	Query(query string, args ...interface{}) (*sql.Rows, error)
-	QueryRow(query string, args ...interface{}) *sql.Row
-}
-type stmtQuerier struct {
-	stmt *sql.Stmt
-}
-
-func (q stmtQuerier) Exec(query string, args ...interface{}) (sql.Result, error) {
-	return q.stmt.Exec(args...)
-}
-func (q stmtQuerier) Query(query string, args ...interface{}) (*sql.Rows, error) {
-	return q.stmt.Query(args...)
-}
-func (q stmtQuerier) QueryRow(query string, args ...interface{}) *sql.Row {
-	return q.stmt.QueryRow(args...)
-}
-
-func getQuerier(args *DBQueryArgs) (querier, error) {
+func (r *RpcDB) getQuerier(args *DBQueryArgs) (util.Querier, error) {
+	if args.Stmt == 0 {
+		if err := currentPolicy().Check(args.Command); err != nil {
+			return nil, err
+		}
+	}
 	if args.Stmt != 0 {
-		of, errof := retrieveOpenfile(args.Stmt)
+		of, errof := r.s.Retrieve(args.Stmt)
 		if errof != nil {
 			return nil, errof
 		}
-		if of.stmt == nil {
+		if of.Stmt == nil {
 			return nil, errors.New("resource is not statement")
 		}
-		return stmtQuerier{of.stmt}, nil
+		return util.StmtQuerier{Stmt: of.Stmt}, nil
 	}
 	if args.Tx != 0 {
-		of, errof := retrieveOpenfile(args.Tx)
+		of, errof := r.s.Retrieve(args.Tx)
 		if errof != nil {
 			return nil, errof
 		}
-		if of.tx == nil {
+		if of.Tx == nil {
 			return nil, errors.New("resource is not transaction")
 		}
-		return of.tx, nil
+		return of.Tx, nil
 	}
 	return DB.Conn(), nil
 }
 
-func (*RpcDB) Fetch(args *DBFetchArgs, reply *DBFetchReply) (err error) {
-	of, errof := retrieveOpenfile(args.Cursor)
+func (r *RpcDB) Fetch(args *DBFetchArgs, reply *DBFetchReply) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.Fetch", args, stime, err, int64(len(reply.Results)+len(reply.Cells))) }()
+	of, errof := r.s.Retrieve(args.Cursor)
 	if errof != nil {
-		return err
+		return errof
 	}
-	if of.rows == nil {
+	if of.Rows == nil {
 		return errors.New("resource is not cursor")
 	}
 
-	results, end, err := fetch(of.rows, of.columnCount, args.Rows)
+	var results [][]string
+	var cells [][]util.Cell
+	var end bool
+	if of.ColumnTypes != nil {
+		cells, end, err = util.ScanCells(of.Rows, of.ColumnTypes, args.Rows)
+	} else {
+		results, end, err = util.Fetch(of.Rows, of.ColumnCount, args.Rows)
+	}
 	if err != nil || end {
 		reply.End = true
-		of.rows.Close()
-		closeOpenfile(args.Cursor)
+		of.Rows.Close()
+		r.s.Release(args.Cursor)
 	}
 	if err != nil {
 		return err
 	}
 	reply.End = end
 	reply.Results = results
+	reply.Cells = cells
 	return
 }
-func fetch(rows *sql.Rows, columns int, count int) (results [][]string, end bool, err error) {
-	if count <= 0 {
-		count = 1 << 31
-	}
-	var sbuf []string
-	makeColumn := func() (s []string) {
-		if len(sbuf) < columns {
-			batch := count
-			if batch > 32 {
-				batch = 32
-			}
-			sbuf = make([]string, batch*columns)
-		}
-		s = sbuf[:columns]
-		sbuf = sbuf[columns:]
-		return
-	}
-	scan := make([]interface{}, columns)
-	for count > 0 {
-		if !rows.Next() {
-			end = true
-			return
-		}
-		column := makeColumn()
-		for i := range scan {
-			scan[i] = &column[i]
-		}
-		if err = rows.Scan(scan...); err != nil {
-			return
-		}
-		if results == nil {
-			results = make([][]string, 0, count)
-		}
-		results = append(results, column)
-		count--
-	}
-	return
-}
-
-func (*RpcDB) CloseCursor(id int64, reply *int) error {
-	of, err := retrieveOpenfile(id)
+func (r *RpcDB) CloseCursor(id int64, reply *int) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.CloseCursor", id, stime, err, 0) }()
+	of, err := r.s.Retrieve(id)
 	if err != nil {
 		return err
 	}
-	if of.rows == nil {
+	if of.Rows == nil {
 		return errors.New("resource is not cursor")
 	}
 	*reply = 1
-	closeOpenfile(id)
-	return of.rows.Close()
+	r.s.Release(id)
+	return of.Rows.Close()
 }
-func (*RpcDB) Begin(args int, reply *DBBeginReply) error {
+func (r *RpcDB) Begin(args int, reply *DBBeginReply) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.Begin", args, stime, err, 0) }()
 	tx, err := DB.Conn().Begin()
 	if err != nil {
 		return err
 	}
 
-	id, err := createOpenfile(&openfile{tx: tx})
+	id, err := r.s.Create(&util.Handle{Tx: tx})
 	if err != nil {
 		if tx != nil {
 			tx.Rollback()
@@ -313,41 +273,50 @@ func (*RpcDB) Begin(args int, reply *DBBeginReply) error {
 	reply.Tx = id
 	return nil
 }
-func (*RpcDB) Commit(id int64, reply *int) error {
-	of, err := retrieveOpenfile(id)
+func (r *RpcDB) Commit(id int64, reply *int) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.Commit", id, stime, err, 0) }()
+	of, err := r.s.Retrieve(id)
 	if err != nil {
 		return err
 	}
-	if of.tx == nil {
+	if of.Tx == nil {
 		return errors.New("resource is not transaction")
 	}
 	*reply = 1
-	closeOpenfile(id)
-	return of.tx.Commit()
+	r.s.Release(id)
+	return of.Tx.Commit()
 }
-func (*RpcDB) Rollback(id int64, reply *int) error {
-	of, err := retrieveOpenfile(id)
+func (r *RpcDB) Rollback(id int64, reply *int) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.Rollback", id, stime, err, 0) }()
+	of, err := r.s.Retrieve(id)
 	if err != nil {
 		return err
 	}
-	if of.tx == nil {
+	if of.Tx == nil {
 		return errors.New("resource is not transaction")
 	}
 	*reply = 1
-	closeOpenfile(id)
-	return of.tx.Rollback()
+	r.s.Release(id)
+	return of.Tx.Rollback()
 }
-func (*RpcDB) Prepare(args DBQueryArgs, reply *DBPrepareReply) (err error) {
+func (r *RpcDB) Prepare(args DBQueryArgs, reply *DBPrepareReply) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.Prepare", &args, stime, err, 0) }()
+	if err := currentPolicy().Check(args.Command); err != nil {
+		return err
+	}
 	var stmt *sql.Stmt
 	if args.Tx != 0 {
-		of, errof := retrieveOpenfile(args.Tx)
+		of, errof := r.s.Retrieve(args.Tx)
 		if errof != nil {
 			return errof
 		}
-		if of.tx == nil {
+		if of.Tx == nil {
 			return errors.New("resource is not transaction")
 		}
-		stmt, err = of.tx.Prepare(args.Command)
+		stmt, err = of.Tx.Prepare(args.Command)
 	} else {
 		stmt, err = DB.Conn().Prepare(args.Command)
 	}
@@ -355,7 +324,7 @@ func (*RpcDB) Prepare(args DBQueryArgs, reply *DBPrepareReply) (err error) {
 		return err
 	}
 
-	id, err := createOpenfile(&openfile{stmt: stmt})
+	id, err := r.s.Create(&util.Handle{Stmt: stmt, SQL: args.Command})
 	if err != nil {
 		if stmt != nil {
 			stmt.Close()
@@ -366,15 +335,44 @@ func (*RpcDB) Prepare(args DBQueryArgs, reply *DBPrepareReply) (err error) {
 	reply.Stmt = id
 	return nil
 }
-func (*RpcDB) CloseStmt(id int64, reply *int) error {
-	of, err := retrieveOpenfile(id)
+func (r *RpcDB) CloseStmt(id int64, reply *int) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.CloseStmt", id, stime, err, 0) }()
+	of, err := r.s.Retrieve(id)
 	if err != nil {
 		return err
 	}
-	if of.stmt == nil {
+	if of.Stmt == nil {
 		return errors.New("resource is not statement")
 	}
 	*reply = 1
-	closeOpenfile(id)
-	return of.stmt.Close()
+	r.s.Release(id)
+	return of.Stmt.Close()
+}
+
+// Stage creates the empty shadow of table for a staged full sync, reply
+// is its name. The policy must allow writing table.
+func (r *RpcDB) Stage(table string, reply *string) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.Stage", table, stime, err, 0) }()
+	if err := currentPolicy().CheckWrite(table); err != nil {
+		return err
+	}
+	*reply, err = DB.CreateShadowTable(table)
+	return err
+}
+
+// Swap replaces table by the shadow loaded after Stage.
+func (r *RpcDB) Swap(table string, reply *int) (err error) {
+	stime := time.Now()
+	defer func() { r.audit("db.Swap", table, stime, err, 0) }()
+	if err := currentPolicy().CheckWrite(table); err != nil {
+		return err
+	}
+	if err := DB.SwapShadowTable(table); err != nil {
+		return err
+	}
+	markSynced()
+	*reply = 1
+	return nil
 }
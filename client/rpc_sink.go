@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+	"util"
+)
+
+// RpcSink applies rows synced by the server to the file sink of a client
+// without database, in place of SQL sent to RpcDB.
+type RpcSink struct {
+	caller *AuditCaller
+	sink   *FileSink
+}
+
+type SinkApplyArgs struct {
+	Table   string
+	Columns []string
+	// Keys are the positions of the key columns in Columns, rows are keyed
+	// by all columns if it is empty.
+	Keys []int
+	// Begin starts a full sync, the rows applied until End replace the
+	// snapshot.
+	Begin, End bool
+	Ops        []SinkOp
+}
+type SinkOp struct {
+	Delete bool
+	Row    []util.Cell
+}
+type SinkApplyReply struct {
+	// Rows is the count of rows in the snapshot.
+	Rows int
+}
+
+// sinkAuditArgs is recorded in the audit log instead of the rows.
+type sinkAuditArgs struct {
+	Table      string
+	Begin, End bool
+	Ops        int
+}
+
+func (r *RpcSink) Apply(args *SinkApplyArgs, reply *SinkApplyReply) (err error) {
+	stime := time.Now()
+	defer func() {
+		Audit.Record(r.caller, "sink.Apply", &sinkAuditArgs{args.Table, args.Begin, args.End, len(args.Ops)}, stime, err, int64(len(args.Ops)))
+	}()
+	reply.Rows, err = r.sink.Apply(args)
+	if err == nil {
+		markSynced()
+	}
+	return err
+}
@@ -0,0 +1,18 @@
+package main
+
+import "util"
+
+type UpstreamPushArgs struct {
+	ClientID string
+	Table    string
+	// Seq numbers the batches of a table, it is only advanced by the
+	// client after an ack.
+	Seq     int64
+	Columns []string
+	Cells   [][]util.Cell
+}
+type UpstreamPushReply struct {
+	// Applied is false if Seq is not newer than LastSeq.
+	Applied bool
+	LastSeq int64
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"util"
+)
+
+const DefaultCursorTTL = 5 * time.Minute
+
+var StatusFile = "status.json"
+
+var MaxOpenfileCount = 32
+
+// session owns the handles opened through one notify connection.
+type session struct {
+	*util.Session
+	caller *AuditCaller
+}
+
+func newSession(caller *AuditCaller, cursorTTL time.Duration) *session {
+	if cursorTTL <= 0 {
+		cursorTTL = DefaultCursorTTL
+	}
+	s := &session{
+		Session: util.NewSession("", cursorTTL, MaxOpenfileCount, writeStatus),
+		caller:  caller,
+	}
+	Sessions.add(s)
+	writeStatus()
+	return s
+}
+
+// Close closes cursors and statements and rolls back transactions left
+// open by the server.
+func (s *session) Close() {
+	s.Session.Close()
+	Sessions.del(s)
+	writeStatus()
+}
+
+type SessionStatus struct {
+	Caller  *AuditCaller
+	Started time.Time
+	Handles []util.HandleStatus
+}
+
+func (s *session) status() SessionStatus {
+	return SessionStatus{Caller: s.caller, Started: s.Started, Handles: s.Handles()}
+}
+
+type sessionRegistry struct {
+	mu sync.Mutex
+	m  map[*session]bool
+}
+
+var Sessions = &sessionRegistry{m: make(map[*session]bool)}
+
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	r.m[s] = true
+	r.mu.Unlock()
+}
+func (r *sessionRegistry) del(s *session) {
+	r.mu.Lock()
+	delete(r.m, s)
+	r.mu.Unlock()
+}
+func (r *sessionRegistry) all() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]*session, 0, len(r.m))
+	for s := range r.m {
+		res = append(res, s)
+	}
+	return res
+}
+
+// ClientStatus is written to StatusFile by the running client so the status
+// command can show it.
+type ClientStatus struct {
+	Time time.Time
+	Pid  int
+	// LastSync is when the server last changed rows of the client.
+	LastSync time.Time
+	Sessions []SessionStatus
+}
+
+var statusMu sync.Mutex
+var lastSync time.Time
+
+// markSynced records that the server changed rows of the client.
+func markSynced() {
+	statusMu.Lock()
+	lastSync = time.Now()
+	statusMu.Unlock()
+}
+
+func writeStatus() {
+	statusMu.Lock()
+	st := ClientStatus{Time: time.Now(), Pid: os.Getpid(), LastSync: lastSync}
+	statusMu.Unlock()
+	for _, s := range Sessions.all() {
+		st.Sessions = append(st.Sessions, s.status())
+	}
+
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	b, _ := json.MarshalIndent(&st, "", "\t")
+	if err := ioutil.WriteFile(StatusFile+".tmp", b, 0644); err != nil {
+		log.Printf("ERROR write status: %v", err)
+		return
+	}
+	if err := os.Rename(StatusFile+".tmp", StatusFile); err != nil {
+		log.Printf("ERROR write status: %v", err)
+	}
+}
+
+func readStatus() (*ClientStatus, error) {
+	b, err := ioutil.ReadFile(StatusFile)
+	if err != nil {
+		return nil, err
+	}
+	st := new(ClientStatus)
+	return st, json.Unmarshal(b, st)
+}
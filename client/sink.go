@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"util"
+)
+
+// SinkConfigFile selects a file sink. A client with a file sink has no
+// database, sync_vars is kept in "sync_vars.json" of the sink directory.
+var SinkConfigFile = "sink.json"
+
+const (
+	SinkJSONL = "jsonl"
+	SinkCSV   = "csv"
+)
+
+type SinkConfig struct {
+	// Format of the files, SinkJSONL or SinkCSV.
+	Format string
+	// Dir holds the files, the current directory if empty.
+	Dir string
+}
+
+// LoadSinkConfig reads filename, it returns nil if the file does not
+// exist.
+func LoadSinkConfig(filename string) (*SinkConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc := new(SinkConfig)
+	if err := json.Unmarshal(data, sc); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filename, err)
+	}
+	if sc.Format != SinkJSONL && sc.Format != SinkCSV {
+		return nil, fmt.Errorf("%s: unknown format '%s'", filename, sc.Format)
+	}
+	if sc.Dir == "" {
+		sc.Dir = "."
+	}
+	return sc, nil
+}
+
+// FileSink keeps every synced table as a snapshot file, rewritten after
+// each applied batch, and an append-only change file. Snapshots are
+// "<table>.jsonl" or "<table>.csv", changes "<table>.changes.jsonl" or
+// "<table>.changes.csv". NULL is an empty field in CSV files.
+type FileSink struct {
+	config *SinkConfig
+
+	mu     sync.Mutex
+	tables map[string]*sinkTable
+}
+
+type sinkTable struct {
+	columns []string
+	keys    []int
+	rows    map[string][]util.Cell
+	// staged collects the rows of a full sync until it ends.
+	staged map[string][]util.Cell
+}
+
+func NewFileSink(config *SinkConfig) *FileSink {
+	return &FileSink{config: config, tables: make(map[string]*sinkTable)}
+}
+
+func (fs *FileSink) filename(table string, changes bool) string {
+	if changes {
+		table += ".changes"
+	}
+	return filepath.Join(fs.config.Dir, table+"."+fs.config.Format)
+}
+
+// Apply applies the operations of args and returns the count of rows in
+// the snapshot.
+func (fs *FileSink) Apply(args *SinkApplyArgs) (int, error) {
+	if !isTableName(args.Table) {
+		return 0, fmt.Errorf("bad table name '%s'", args.Table)
+	}
+	if len(args.Columns) == 0 {
+		return 0, errors.New("no columns")
+	}
+	for _, k := range args.Keys {
+		if k < 0 || k >= len(args.Columns) {
+			return 0, fmt.Errorf("key %d out of range", k)
+		}
+	}
+	for _, op := range args.Ops {
+		if len(op.Row) != len(args.Columns) {
+			return 0, errors.New("row length not match columns count")
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	t, err := fs.table(args.Table)
+	if err != nil {
+		return 0, fmt.Errorf("load '%s': %v", args.Table, err)
+	}
+	t.reshape(args.Columns, args.Keys)
+
+	var changes []sinkChange
+	now := time.Now()
+	if args.Begin {
+		t.staged = make(map[string][]util.Cell)
+		changes = append(changes, sinkChange{"reset", now, nil})
+	}
+	rows := t.rows
+	if t.staged != nil {
+		rows = t.staged
+	}
+	for _, op := range args.Ops {
+		if op.Delete {
+			delete(rows, t.key(op.Row))
+			changes = append(changes, sinkChange{"delete", now, op.Row})
+		} else {
+			rows[t.key(op.Row)] = op.Row
+			changes = append(changes, sinkChange{"upsert", now, op.Row})
+		}
+	}
+	if args.End {
+		t.rows, t.staged = rows, nil
+	}
+
+	if err := fs.appendChanges(args.Table, t.columns, changes); err != nil {
+		return 0, fmt.Errorf("write changes of '%s': %v", args.Table, err)
+	}
+	if t.staged == nil {
+		if err := fs.writeSnapshot(args.Table, t); err != nil {
+			return 0, fmt.Errorf("write snapshot of '%s': %v", args.Table, err)
+		}
+	}
+	return len(t.rows), nil
+}
+
+// table returns table name, its snapshot is read on first use.
+func (fs *FileSink) table(name string) (*sinkTable, error) {
+	if t := fs.tables[name]; t != nil {
+		return t, nil
+	}
+	t := &sinkTable{rows: make(map[string][]util.Cell)}
+	f, err := os.Open(fs.filename(name, false))
+	if err == nil {
+		var rows [][]util.Cell
+		if fs.config.Format == SinkCSV {
+			t.columns, rows, err = readCSVSnapshot(f)
+		} else {
+			t.columns, rows, err = readJSONLSnapshot(f)
+		}
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			t.rows[t.key(row)] = row
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	fs.tables[name] = t
+	return t, nil
+}
+
+// reshape maps the rows of t to columns by name and keys them by keys.
+// Columns new to t are NULL.
+func (t *sinkTable) reshape(columns []string, keys []int) {
+	if equalStrings(t.columns, columns) && equalInts(t.keys, keys) {
+		return
+	}
+	index := make([]int, len(columns))
+	for i, c := range columns {
+		index[i] = -1
+		for j, old := range t.columns {
+			if old == c {
+				index[i] = j
+			}
+		}
+	}
+	reshape := func(rows map[string][]util.Cell) map[string][]util.Cell {
+		if rows == nil {
+			return nil
+		}
+		res := make(map[string][]util.Cell, len(rows))
+		for _, old := range rows {
+			row := make([]util.Cell, len(columns))
+			for i, j := range index {
+				if j < 0 {
+					row[i] = util.Cell{Null: true}
+				} else {
+					row[i] = old[j]
+				}
+			}
+			res[keyOf(row, keys)] = row
+		}
+		return res
+	}
+	t.columns, t.keys = columns, keys
+	t.rows, t.staged = reshape(t.rows), reshape(t.staged)
+}
+
+func (t *sinkTable) key(row []util.Cell) string {
+	return keyOf(row, t.keys)
+}
+
+func keyOf(row []util.Cell, keys []int) string {
+	var buf bytes.Buffer
+	add := func(c util.Cell) {
+		if c.Null {
+			buf.WriteString("N;")
+			return
+		}
+		buf.WriteString(strconv.Itoa(len(c.Bytes)))
+		buf.WriteByte(':')
+		buf.Write(c.Bytes)
+	}
+	if len(keys) == 0 {
+		for _, c := range row {
+			add(c)
+		}
+	}
+	for _, k := range keys {
+		add(row[k])
+	}
+	return buf.String()
+}
+
+type sinkChange struct {
+	Op   string
+	Time time.Time
+	Row  []util.Cell
+}
+
+func (fs *FileSink) appendChanges(table string, columns []string, changes []sinkChange) error {
+	filename := fs.filename(table, true)
+	_, err := os.Stat(filename)
+	isNew := os.IsNotExist(err)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if fs.config.Format == SinkCSV {
+		w := csv.NewWriter(&buf)
+		if isNew {
+			w.Write(append([]string{"op", "time"}, columns...))
+		}
+		for _, c := range changes {
+			record := []string{c.Op, c.Time.Format(time.RFC3339)}
+			if c.Row != nil {
+				record = append(record, csvRecord(c.Row)...)
+			}
+			w.Write(record)
+		}
+		w.Flush()
+	} else {
+		for _, c := range changes {
+			buf.WriteString(`{"op":"` + c.Op + `","time":"` + c.Time.Format(time.RFC3339) + `"`)
+			if c.Row != nil {
+				buf.WriteString(`,"row":`)
+				appendJSONRow(&buf, columns, c.Row)
+			}
+			buf.WriteString("}\n")
+		}
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (fs *FileSink) writeSnapshot(table string, t *sinkTable) error {
+	keys := make([]string, 0, len(t.rows))
+	for k := range t.rows {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	if fs.config.Format == SinkCSV {
+		w := csv.NewWriter(&buf)
+		w.Write(t.columns)
+		for _, k := range keys {
+			w.Write(csvRecord(t.rows[k]))
+		}
+		w.Flush()
+	} else {
+		for _, k := range keys {
+			appendJSONRow(&buf, t.columns, t.rows[k])
+			buf.WriteByte('\n')
+		}
+	}
+	return writeFileAtomic(fs.filename(table, false), buf.Bytes())
+}
+
+func csvRecord(row []util.Cell) []string {
+	record := make([]string, len(row))
+	for i, c := range row {
+		if !c.Null {
+			record[i] = string(c.Bytes)
+		}
+	}
+	return record
+}
+
+// appendJSONRow writes row as an object in the order of columns, numbers
+// are written as JSON numbers.
+func appendJSONRow(buf *bytes.Buffer, columns []string, row []util.Cell) {
+	buf.WriteByte('{')
+	for i, c := range row {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(columns[i])
+		buf.Write(name)
+		buf.WriteByte(':')
+		switch {
+		case c.Null:
+			buf.WriteString("null")
+		case c.Kind != util.KindString && c.Kind != util.KindTime && c.Kind != util.KindBytes && json.Valid(c.Bytes):
+			buf.Write(c.Bytes)
+		default:
+			s, _ := json.Marshal(string(c.Bytes))
+			buf.Write(s)
+		}
+	}
+	buf.WriteByte('}')
+}
+
+func readCSVSnapshot(r io.Reader) ([]string, [][]util.Cell, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, nil, err
+	}
+	rows := make([][]util.Cell, len(records)-1)
+	for i, record := range records[1:] {
+		rows[i] = make([]util.Cell, len(record))
+		for j, s := range record {
+			if s == "" {
+				rows[i][j] = util.Cell{Null: true}
+			} else {
+				rows[i][j] = util.Cell{Kind: util.KindString, Bytes: []byte(s)}
+			}
+		}
+	}
+	return records[0], rows, nil
+}
+
+func readJSONLSnapshot(r io.Reader) ([]string, [][]util.Cell, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var columns []string
+	var rows [][]util.Cell
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			return columns, rows, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		var names []string
+		var row []util.Cell
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, nil, err
+			}
+			name, _ := tok.(string)
+			var v interface{}
+			if err := dec.Decode(&v); err != nil {
+				return nil, nil, err
+			}
+			names = append(names, name)
+			switch v := v.(type) {
+			case nil:
+				row = append(row, util.Cell{Null: true})
+			case json.Number:
+				row = append(row, util.Cell{Kind: util.KindDecimal, Bytes: []byte(v)})
+			default:
+				row = append(row, util.Cell{Kind: util.KindString, Bytes: []byte(fmt.Sprint(v))})
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, nil, err
+		}
+		if columns == nil {
+			columns = names
+		} else if !equalStrings(columns, names) {
+			return nil, nil, errors.New("rows have different columns")
+		}
+		rows = append(rows, row)
+	}
+}
+
+func isTableName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
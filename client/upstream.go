@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"util"
+)
+
+const DefaultUpstreamInterval = 10 * time.Second
+const DefaultUpstreamBatchRows = 500
+
+// UpstreamStateTable keeps the sequence number and watermark of every
+// pushed table. It is not part of sync_vars, so restoring a generation of
+// HistoryTable does not move the watermark back.
+const UpstreamStateTable = "sync_upstream"
+
+// UpstreamTable is a local table pushed to the server, configured in the
+// sync_vars value ValueUpstream as a JSON list. Rows are captured by
+// Watermark, a column which grows on every change such as an auto
+// increment id or a timestamp kept by ON UPDATE or a trigger. Key is a
+// unique column which orders rows with the same watermark. Rows with a
+// NULL watermark are not pushed.
+type UpstreamTable struct {
+	Table     string
+	Key       string
+	Watermark string
+	// Columns lists the pushed columns, all columns if empty.
+	Columns   []string
+	BatchRows int
+}
+
+type upstreamState struct {
+	Seq       int64
+	Watermark sql.NullString
+	Key       sql.NullString
+}
+
+// LoadUpstream reads the pushed tables and creates UpstreamStateTable if
+// there are any.
+func LoadUpstream() ([]*UpstreamTable, error) {
+	v, err := DB.GetValue(ValueUpstream)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	if DB.conn == nil {
+		return nil, fmt.Errorf("sync_vars.%s: upstream needs a database", ValueUpstream)
+	}
+	var tables []*UpstreamTable
+	if err := json.Unmarshal([]byte(v), &tables); err != nil {
+		return nil, fmt.Errorf("parse sync_vars.%s: %v", ValueUpstream, err)
+	}
+	for _, t := range tables {
+		names := append([]string{t.Table, t.Key, t.Watermark}, t.Columns...)
+		for _, name := range names {
+			if name == "" || strings.IndexByte(name, '`') >= 0 {
+				return nil, fmt.Errorf("sync_vars.%s: bad name '%s' in table '%s'", ValueUpstream, name, t.Table)
+			}
+		}
+		if t.BatchRows <= 0 {
+			t.BatchRows = DefaultUpstreamBatchRows
+		}
+	}
+
+	qs := DB.BeforeQuery("CREATE TABLE IF NOT EXISTS `" + UpstreamStateTable + "` (" +
+		"src_table VARCHAR(64) NOT NULL PRIMARY KEY, " +
+		"seq BIGINT NOT NULL, " +
+		"watermark VARCHAR(255) NULL, " +
+		"wm_key VARCHAR(255) NULL)")
+	_, err = DB.conn.Exec(qs.SQL)
+	qs.EndQuery(err)
+	if err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+func loadUpstreamState(table string) (*upstreamState, error) {
+	st := new(upstreamState)
+	qs := DB.BeforeQuery("SELECT seq, watermark, wm_key FROM `"+UpstreamStateTable+"` WHERE src_table=?", table)
+	err := DB.conn.QueryRow(qs.SQL, qs.Params...).Scan(&st.Seq, &st.Watermark, &st.Key)
+	qs.EndQuery(err)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return st, err
+}
+func saveUpstreamState(table string, st *upstreamState) error {
+	qs := DB.BeforeQuery("INSERT INTO `"+UpstreamStateTable+"` (src_table, seq, watermark, wm_key) VALUES (?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE seq=VALUES(seq), watermark=VALUES(watermark), wm_key=VALUES(wm_key)",
+		table, st.Seq, st.Watermark, st.Key)
+	_, err := DB.conn.Exec(qs.SQL, qs.Params...)
+	qs.EndQuery(err)
+	return err
+}
+
+// captureUpstream reads the next batch of rows after the watermark of st,
+// wi and ki are the positions of the watermark and key columns.
+func captureUpstream(t *UpstreamTable, st *upstreamState) (columns []string, cells [][]util.Cell, wi, ki int, err error) {
+	sel := "*"
+	if len(t.Columns) > 0 {
+		sel = "`" + strings.Join(t.Columns, "`,`") + "`"
+	}
+	wm, key := "`"+t.Watermark+"`", "`"+t.Key+"`"
+	query := "SELECT " + sel + " FROM `" + t.Table + "`"
+	var params []interface{}
+	if st.Watermark.Valid {
+		query += " WHERE (" + wm + "," + key + ") > (?,?)"
+		params = []interface{}{st.Watermark.String, st.Key.String}
+	} else {
+		query += " WHERE " + wm + " IS NOT NULL"
+	}
+	query += fmt.Sprintf(" ORDER BY %s,%s LIMIT %d", wm, key, t.BatchRows)
+
+	qs := DB.BeforeQuery(query, params...)
+	rows, err := DB.conn.Query(qs.SQL, qs.Params...)
+	qs.EndQuery(err)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	types, err := util.ScanColumns(rows)
+	if err != nil {
+		return
+	}
+	wi, ki = -1, -1
+	columns = make([]string, len(types))
+	for i, c := range types {
+		columns[i] = c.Name
+		if strings.EqualFold(c.Name, t.Watermark) {
+			wi = i
+		}
+		if strings.EqualFold(c.Name, t.Key) {
+			ki = i
+		}
+	}
+	if wi < 0 || ki < 0 {
+		err = errors.New("watermark and key must be in the pushed columns")
+		return
+	}
+	cells, _, err = util.ScanCells(rows, types, -1)
+	return
+}
+
+// pushUpstream sends the rows of t changed since the last ack, one batch
+// per call of upstream.Push.
+func (c *Client) pushUpstream(clientUUID string, t *UpstreamTable) error {
+	st, err := loadUpstreamState(t.Table)
+	if err != nil {
+		return fmt.Errorf("load state of '%s': %v", t.Table, err)
+	}
+	for {
+		columns, cells, wi, ki, err := captureUpstream(t, st)
+		if err != nil {
+			return fmt.Errorf("capture '%s': %v", t.Table, err)
+		}
+		if len(cells) == 0 {
+			return nil
+		}
+
+		args := &UpstreamPushArgs{
+			ClientID: clientUUID,
+			Table:    t.Table,
+			Seq:      st.Seq + 1,
+			Columns:  columns,
+			Cells:    cells,
+		}
+		var reply UpstreamPushReply
+		if err := c.Call("upstream.Push", args, &reply); err != nil {
+			return fmt.Errorf("push '%s': %v", t.Table, err)
+		}
+		if !reply.Applied && reply.LastSeq > args.Seq {
+			// the state is older than the server, e.g. the database was
+			// restored from a backup, send the batch again after the last
+			// sequence number of the server
+			log.Printf("info: upstream %s seq %d behind server seq %d", t.Table, args.Seq, reply.LastSeq)
+			st.Seq = reply.LastSeq
+			continue
+		}
+
+		last := cells[len(cells)-1]
+		st.Seq = args.Seq
+		st.Watermark = sql.NullString{String: string(last[wi].Bytes), Valid: true}
+		st.Key = sql.NullString{String: string(last[ki].Bytes), Valid: true}
+		if err := saveUpstreamState(t.Table, st); err != nil {
+			return fmt.Errorf("save state of '%s': %v", t.Table, err)
+		}
+		if reply.Applied {
+			log.Printf("info: upstream %s seq %d, %d rows pushed", t.Table, st.Seq, len(cells))
+		} else {
+			log.Printf("info: upstream %s seq %d acked before", t.Table, st.Seq)
+		}
+		if len(cells) < t.BatchRows {
+			return nil
+		}
+	}
+}
+
+// RunUpstream pushes the configured tables every "upstream" interval of
+// the timeout config. It returns on the first error.
+func (c *Client) RunUpstream() error {
+	interval, _ := c.timeout.Get("upstream", DefaultUpstreamInterval)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		tables, err := LoadUpstream()
+		if err != nil {
+			return fmt.Errorf("load upstream tables: %v", err)
+		}
+		if len(tables) == 0 {
+			continue
+		}
+		// the UUID is stored by the first notify connection or imported
+		// with a bundle, the server accepts pushes of that UUID only
+		clientUUID, err := DB.GetValue(ValueClientID)
+		if err != nil {
+			return err
+		}
+		if clientUUID == "" {
+			continue
+		}
+		for _, t := range tables {
+			if err := c.pushUpstream(clientUUID, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fileVars keeps sync_vars in JSON files of dir for clients without a
+// database, the table "sync_vars" is the file "sync_vars.json".
+type fileVars struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (fv *fileVars) filename(table string) string {
+	return filepath.Join(fv.dir, table+".json")
+}
+
+func (fv *fileVars) load(table string) (map[string]string, error) {
+	values := make(map[string]string)
+	data, err := ioutil.ReadFile(fv.filename(table))
+	if os.IsNotExist(err) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return values, nil
+	}
+	return values, json.Unmarshal(data, &values)
+}
+
+func (fv *fileVars) save(table string, values map[string]string) error {
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fv.filename(table), data)
+}
+
+func (fv *fileVars) GetValue(name string) (string, error) {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	values, err := fv.load("sync_vars")
+	return values[name], err
+}
+
+// GetValues returns the values with names matching the LIKE pattern name.
+func (fv *fileVars) GetValues(name string) ([]KeyValuePair, error) {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	values, err := fv.load("sync_vars")
+	if err != nil {
+		return nil, err
+	}
+	re := likePattern(name)
+	var res []KeyValuePair
+	for k, v := range values {
+		if re.MatchString(k) {
+			res = append(res, KeyValuePair{k, v})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+func (fv *fileVars) SetValue(name string, value string) error {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	values, err := fv.load("sync_vars")
+	if err != nil {
+		return err
+	}
+	values[name] = value
+	return fv.save("sync_vars", values)
+}
+
+func (fv *fileVars) DeleteValue(name string) error {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	values, err := fv.load("sync_vars")
+	if err != nil {
+		return err
+	}
+	if _, ok := values[name]; !ok {
+		return nil
+	}
+	delete(values, name)
+	return fv.save("sync_vars", values)
+}
+
+// CopyTable replaces the file of table dst by a copy of src.
+func (fv *fileVars) CopyTable(dst, src string) error {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	data, err := ioutil.ReadFile(fv.filename(src))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fv.filename(dst), data)
+}
+
+func likePattern(s string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?i)^")
+	for _, r := range s {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// writeFileAtomic replaces filename by data through a temporary file, so
+// readers never see a partial file.
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
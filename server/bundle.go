@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// BundleMagic starts an offline bundle file, it is followed by a gob
+// encoded bundleFile. The Payload of it is the flate compressed gob of a
+// Bundle, signed with the key of the server certificate.
+const BundleMagic = "GDBBNDL1"
+const BundleVersion = 1
+
+type BundleHeader struct {
+	Version  int
+	ClientID string
+	Table    string
+	Created  time.Time
+	// Full bundles replace the rows of the client, others apply the
+	// changes after checkpoint From and must be imported in sequence.
+	Full bool
+	From string
+	// To is the checkpoint of the client after the import.
+	To string
+}
+
+// Bundle is the statements which sync a client without network.
+type Bundle struct {
+	Header     BundleHeader
+	Statements []string
+}
+
+type bundleFile struct {
+	// Certs is the certificate chain of the signing key, DER encoded.
+	Certs     [][]byte
+	Signature []byte
+	Payload   []byte
+}
+
+// queryCheckpoint returns the checkpoint of SyncTableName by
+// BundleCheckpoint of st, which must be set.
+func queryCheckpoint(st *SQLTemplet) (string, error) {
+	var to sql.NullString
+	qs := DB.BeforeQuery(st.BundleCheckpoint)
+	err := DB.Conn().QueryRow(qs.SQL).Scan(&to)
+	qs.EndQuery(err)
+	if err != nil {
+		return "", fmt.Errorf("query checkpoint: %v", err)
+	}
+	return to.String, nil
+}
+
+// ExportBundle renders the rows of a client as SQL for its templet, all
+// rows of its filter if full or the rows changed after checkpoint since.
+// Rows deleted on the server only reach the client with a full bundle.
+func ExportBundle(clientUUID, cn string, full bool, since string, maxPacketSize int) (*Bundle, error) {
+	c, st := currentConfig(), currentSQL()
+	if !full && (st.BundleChanges == "" || st.BundleCheckpoint == "") {
+		return nil, errors.New("BundleCheckpoint and BundleChanges not configured, only full bundles")
+	}
+	filter := clientFilter(clientUUID, cn)
+	tpl := st.Client(clientUUID, cn)
+	b := &Bundle{Header: BundleHeader{
+		Version:  BundleVersion,
+		ClientID: clientUUID,
+		Table:    tpl.clientTableName,
+		Created:  time.Now(),
+		Full:     full,
+	}}
+	if !full {
+		b.Header.From = since
+	}
+
+	// read the checkpoint first, rows changed meanwhile are sent again by
+	// the next bundle
+	if st.BundleCheckpoint != "" {
+		to, err := queryCheckpoint(st)
+		if err != nil {
+			return nil, err
+		}
+		b.Header.To = to
+	}
+
+	if full {
+		qs := DB.BeforeQuery(st.FullUpdate(filter))
+		rows, err := DB.Conn().Query(qs.SQL)
+		qs.EndQuery(err)
+		if err != nil {
+			return nil, fmt.Errorf("query, %v", err)
+		}
+		defer rows.Close()
+		d, err := NewDbDump(rows, st.ServerColumns, DumpHeader{Table: c.SyncTableName, Position: b.Header.To})
+		if err != nil {
+			return nil, fmt.Errorf("dump, %v", err)
+		}
+		defer d.Close()
+
+		if st.SyncClientBeforeFullUpdate != "" {
+			b.Statements = append(b.Statements, st.SyncClientBeforeFullUpdate)
+		}
+		for {
+			res, err := d.ReadRows(fullSyncBatchRows)
+			if err != nil {
+				return nil, fmt.Errorf("read dump, %v", err)
+			}
+			if len(res) == 0 {
+				break
+			}
+			items := make([]QueueItem, len(res))
+			for i := range res {
+				items[i].Row = res[i]
+			}
+			b.appendItems(tpl, items, maxPacketSize)
+		}
+		return b, nil
+	}
+
+	qs := DB.BeforeQuery(st.BundleChanges, since)
+	rows, err := DB.Conn().Query(qs.SQL, qs.Params...)
+	qs.EndQuery(err)
+	if err != nil {
+		return nil, fmt.Errorf("query changes, %v", err)
+	}
+	defer rows.Close()
+	var changed [][]string
+	for rows.Next() {
+		res := make([]string, len(st.ServerColumns))
+		if err := st.ServerColumns.Scan(res, rows, nil); err != nil {
+			return nil, err
+		}
+		changed = append(changed, res)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var match []bool
+	if filter != "" {
+		if match, err = st.MatchFilter(filter, changed); err != nil {
+			return nil, fmt.Errorf("match filter %q: %v", filter, err)
+		}
+	}
+	items := make([]QueueItem, len(changed))
+	for i, res := range changed {
+		items[i] = QueueItem{Delete: match != nil && !match[i], Row: res}
+	}
+	b.appendItems(tpl, items, maxPacketSize)
+	return b, nil
+}
+
+// appendItems renders items like clientApply, conflicts are recorded
+// before each upsert.
+func (b *Bundle) appendItems(tpl *SQLTemplet, items []QueueItem, maxPacketSize int) {
+	for len(items) > 0 {
+		n := 1
+		for n < len(items) && items[n].Delete == items[0].Delete {
+			n++
+		}
+		res := make([][]string, n)
+		for i := range res {
+			res[i] = items[i].Row
+		}
+		for len(res) > 0 {
+			var stmt string
+			var rest [][]string
+			if items[0].Delete {
+				stmt, rest = tpl.ClientDeleteSlice(res, maxPacketSize)
+			} else {
+				stmt, rest = tpl.ClientInsertSlice(res, maxPacketSize)
+				b.Statements = append(b.Statements, tpl.ClientConflicts(res[:len(res)-len(rest)], maxPacketSize)...)
+			}
+			if stmt != "" {
+				b.Statements = append(b.Statements, stmt)
+			}
+			res = rest
+		}
+		items = items[n:]
+	}
+}
+
+// WriteBundle compresses b and signs it with the key of cert.
+func WriteBundle(w io.Writer, b *Bundle, cert tls.Certificate) error {
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("certificate key can not sign")
+	}
+	var payload bytes.Buffer
+	zw, err := flate.NewWriter(&payload, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(zw).Encode(b); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	digest := sha256.Sum256(payload.Bytes())
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("sign: %v", err)
+	}
+	if _, err := io.WriteString(w, BundleMagic); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(&bundleFile{cert.Certificate, sig, payload.Bytes()})
+}
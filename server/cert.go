@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"sync"
 )
 
 func NewTLSConfig(config *config) (*tls.Config, error) {
@@ -32,3 +33,37 @@ func NewTLSConfig(config *config) (*tls.Config, error) {
 		MinVersion: tls.VersionTLS12,
 	}, nil
 }
+
+// tlsStore holds the current TLS material. Listeners created from
+// ListenerConfig pick up a reloaded certificate or ClientCA on the next
+// handshake, connections already established are not affected.
+type tlsStore struct {
+	mu   sync.RWMutex
+	conf *tls.Config
+}
+
+var TLS = new(tlsStore)
+
+func (s *tlsStore) Load(config *config) error {
+	conf, err := NewTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.conf = conf
+	s.mu.Unlock()
+	return nil
+}
+func (s *tlsStore) Get() *tls.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conf
+}
+func (s *tlsStore) ListenerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.Get(), nil
+		},
+		MinVersion: tls.VersionTLS12,
+	}
+}
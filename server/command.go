@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"util"
+)
+
+var commands = map[string]func(args []string) error{
+	"check-config": cmdCheckConfig,
+	"console":      cmdConsole,
+	"dump":         cmdDump,
+	"export":       cmdExport,
+	"print-sql":    cmdPrintSQL,
+	"run":          cmdRun,
+	"version":      cmdVersion,
+}
+
+// newFlagSet returns the flags of command name, every command takes the
+// config file.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&ConfigFile, "config", ConfigFile, "config file")
+	return fs
+}
+
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", name)
+		return 2
+	}
+	if err := cmd(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// cmdRun runs the server, like the server without command.
+func cmdRun(args []string) error {
+	fs := newFlagSet("run")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: run [-config file]")
+	}
+	run()
+	return nil
+}
+
+func cmdVersion(args []string) error {
+	fmt.Printf("godbsync server %d, %s %s/%s\n", ServerVersion, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
+
+// loadConfig loads ConfigFile and compiles its templets, a missing file
+// is an error.
+func loadConfig() error {
+	c := newConfig()
+	if !c.IsFileExist(ConfigFile) {
+		return fmt.Errorf("config file '%s' not found", ConfigFile)
+	}
+	if err := c.Load(ConfigFile); err != nil {
+		return fmt.Errorf("load config file '%s': %v", ConfigFile, err)
+	}
+	st := new(SQLTemplet)
+	if err := st.Init(c); err != nil {
+		return fmt.Errorf("init SQL: %v", err)
+	}
+	setConfig(c, st)
+	return nil
+}
+
+// cmdCheckConfig validates the config file without serving: templets,
+// timeouts, certificates and the queries of SyncFullUpdate on the database.
+func cmdCheckConfig(args []string) error {
+	fs := newFlagSet("check-config")
+	fs.Parse(args)
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	c, st := currentConfig(), currentSQL()
+	if err := c.Check(); err != nil {
+		return fmt.Errorf("check config: %v", err)
+	}
+	for _, v := range []struct{ name, value string }{{"Timeout", c.Timeout}, {"PushTimeout", c.PushTimeout}} {
+		if _, err := util.ParseTimeoutConfig(v.value); err != nil {
+			return fmt.Errorf("parse config %s: %v", v.name, err)
+		}
+	}
+	fmt.Printf("config: OK, %d columns, %d column profiles, %d client filters\n",
+		len(st.Columns), len(c.ColumnProfiles), len(c.ClientFilters))
+
+	if err := TLS.Load(c); err != nil {
+		return fmt.Errorf("config TLS: %v", err)
+	}
+	cert := TLS.Get().Certificates[0]
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parse Cert: %v", err)
+	}
+	expired := printCertExpiry("Cert", leaf)
+	data, err := ioutil.ReadFile(c.ClientCA)
+	if err != nil {
+		return fmt.Errorf("load ClientCA: %v", err)
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("parse ClientCA: %v", err)
+		}
+		expired = printCertExpiry("ClientCA", ca) || expired
+	}
+	if expired {
+		return errors.New("certificate expired")
+	}
+
+	dsn, err := util.ReadDSN(c.DSNFile)
+	if err != nil {
+		return fmt.Errorf("load DSN: %v", err)
+	}
+	if err := DB.Open(dsn); err != nil {
+		return err
+	}
+	if err := DB.Conn().Ping(); err != nil {
+		return fmt.Errorf("database: %v", err)
+	}
+	fmt.Println("database: OK")
+	queries := map[string]string{"SyncFullUpdate": st.FullUpdate("")}
+	for client, filter := range c.ClientFilters {
+		queries[fmt.Sprintf("SyncFullUpdate of client '%s'", client)] = st.FullUpdate(filter)
+	}
+	for name, query := range queries {
+		rows, err := DB.Conn().Query("SELECT * FROM (" + query + ") AS t LIMIT 0")
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		columns, err := rows.Columns()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if len(columns) != len(st.ServerColumns) {
+			return fmt.Errorf("%s returns %d columns, SyncColumns has %d", name, len(columns), len(st.ServerColumns))
+		}
+		fmt.Printf("%s: OK\n", name)
+	}
+	return nil
+}
+
+// printCertExpiry prints the subject and expiry of cert and reports if it
+// expired.
+func printCertExpiry(name string, cert *x509.Certificate) bool {
+	left := time.Until(cert.NotAfter)
+	fmt.Printf("%s: %s, expires %s (%d days)\n", name, cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339), int(left.Hours()/24))
+	return left <= 0
+}
+
+// cmdPrintSQL prints the statements of the templets of a client, with a
+// sample row rendered for the client.
+func cmdPrintSQL(args []string) error {
+	fs := newFlagSet("print-sql")
+	clientUUID := fs.String("client", "", "client UUID, for filters and column profiles")
+	cn := fs.String("cn", "", "certificate common name of the client, for filters and column profiles")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("usage: print-sql [-config file] [-client uuid] [-cn name]")
+	}
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	st := currentSQL()
+	filter := clientFilter(*clientUUID, *cn)
+	tpl := st.Client(*clientUUID, *cn)
+
+	show := func(name, stmt string) {
+		if stmt != "" {
+			fmt.Printf("-- %s\n%s;\n\n", name, stmt)
+		}
+	}
+	show("SyncFullUpdate", st.FullUpdate(filter))
+	show("SyncSingleUpdate", st.SyncSingleUpdate)
+	show("BundleCheckpoint", st.BundleCheckpoint)
+	show("BundleChanges", st.BundleChanges)
+	show("QueueCheckpoint", st.QueueCheckpoint)
+	show("SyncClientBeforeFullUpdate", st.SyncClientBeforeFullUpdate)
+
+	row := make([]string, len(st.ServerColumns))
+	for i, sc := range st.ServerColumns {
+		if sc.IsString {
+			row[i] = sc.Name
+		} else {
+			row[i] = strconv.Itoa(i + 1)
+		}
+	}
+	res := [][]string{row}
+	for _, stmt := range tpl.ClientConflicts(res, 1024*1024) {
+		show("sample conflicts of "+tpl.clientTableName, stmt)
+	}
+	insert, _ := tpl.ClientInsertSlice(res, 1024*1024)
+	show("sample insert into "+tpl.clientTableName, insert)
+	if len(tpl.keys) > 0 {
+		del, _ := tpl.ClientDeleteSlice(res, 1024*1024)
+		show("sample delete from "+tpl.clientTableName, del)
+	}
+	return nil
+}
+
+// cmdConsole opens a SQL console on a connected client through the
+// /console endpoint of a running server.
+func cmdConsole(args []string) error {
+	fs := newFlagSet("console")
+	addr := fs.String("addr", "", "http address of the server, default HttpListen of "+ConfigFile)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: console [-addr host:port] <client-uuid>")
+	}
+	if *addr == "" {
+		c := newConfig()
+		if err := c.Load(ConfigFile); err != nil {
+			return fmt.Errorf("load config file '%s': %v", ConfigFile, err)
+		}
+		*addr = c.HttpListen
+	}
+
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	q := url.Values{"client": {fs.Arg(0)}}
+	req, _ := http.NewRequest("GET", "http://"+*addr+"/console?"+q.Encode(), nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", ConsoleUpgrade)
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return fmt.Errorf("%s: %s", resp.Status, b)
+	}
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	_, err = io.Copy(os.Stdout, br)
+	return err
+}
+
+// openDatabase loads the config file and opens the database like main,
+// queries are logged to QueryLog.
+func openDatabase() error {
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	c := currentConfig()
+	qlog, err := os.OpenFile(c.QueryLog, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	if err != nil {
+		return err
+	}
+	DB.SetLogger(log.New(qlog, "", log.LstdFlags))
+	dsn, err := util.ReadDSN(c.DSNFile)
+	if err != nil {
+		return fmt.Errorf("load DSN: %v", err)
+	}
+	return DB.Open(dsn)
+}
+
+// cmdExport writes an offline bundle for a client without network, it is
+// imported by the "import" command of the client.
+func cmdExport(args []string) error {
+	fs := newFlagSet("export")
+	out := fs.String("o", "", "bundle file to write")
+	since := fs.String("since", "", "export the changes after this checkpoint of the client instead of all rows")
+	cn := fs.String("cn", "", "certificate common name of the client, for filters and column profiles")
+	packet := fs.Int("packet", 1024*1024, "max statement size, the max_allowed_packet of the client")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *out == "" {
+		return errors.New("usage: export -o file [-since checkpoint] [-cn name] [-packet bytes] <client-uuid>")
+	}
+	if err := openDatabase(); err != nil {
+		return err
+	}
+	c := currentConfig()
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.CertKey)
+	if err != nil {
+		return fmt.Errorf("load Cert: %v", err)
+	}
+
+	b, err := ExportBundle(fs.Arg(0), *cn, *since == "", *since, *packet)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := WriteBundle(f, b, cert); err != nil {
+		f.Close()
+		os.Remove(*out)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	kind := "full"
+	if !b.Header.Full {
+		kind = "changes after " + b.Header.From
+	}
+	fmt.Printf("%s: client %s, %s, %d statements, checkpoint %q\n", *out, b.Header.ClientID, kind, len(b.Statements), b.Header.To)
+	return nil
+}
+
+const dumpUsage = `usage: dump info <file>
+       dump cat [-format jsonl|csv] [-where column=value]... <file>
+       dump convert [-table name] [-strings columns] <in> <out>`
+
+// cmdDump inspects dump files, convert turns a dump into CSV and CSV
+// with a header line into a dump.
+func cmdDump(args []string) error {
+	if len(args) == 0 {
+		return errors.New(dumpUsage)
+	}
+	switch args[0] {
+	case "info":
+		return cmdDumpInfo(args[1:])
+	case "cat":
+		return cmdDumpCat(args[1:])
+	case "convert":
+		return cmdDumpConvert(args[1:])
+	}
+	return errors.New(dumpUsage)
+}
+
+func cmdDumpInfo(args []string) error {
+	if len(args) != 1 {
+		return errors.New(dumpUsage)
+	}
+	d, err := OpenDbDump(args[0])
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	h := d.Header
+	fmt.Printf("version:    %d\n", h.Version)
+	fmt.Printf("table:      %s\n", h.Table)
+	fmt.Printf("created:    %s\n", h.Created.Format(time.RFC3339))
+	fmt.Printf("position:   %s\n", h.Position)
+	fmt.Printf("compressed: %v\n", h.Compressed)
+	for _, c := range h.Columns {
+		kind := "number"
+		if c.IsString {
+			kind = "string"
+		}
+		fmt.Printf("column:     %s %s\n", c.Name, kind)
+	}
+	n := 0
+	for d.Next() {
+		n++
+	}
+	fmt.Printf("rows:       %d\n", n)
+	return d.Err()
+}
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string     { return strings.Join(*l, ",") }
+func (l *listFlag) Set(s string) error { *l = append(*l, s); return nil }
+
+func cmdDumpCat(args []string) error {
+	fs := flag.NewFlagSet("dump cat", flag.ExitOnError)
+	format := fs.String("format", "jsonl", "output format, jsonl or csv")
+	var where listFlag
+	fs.Var(&where, "where", "print rows where column equals value, repeated conditions must all hold")
+	fs.Parse(args)
+	if fs.NArg() != 1 || (*format != "jsonl" && *format != "csv") {
+		return errors.New(dumpUsage)
+	}
+	d, err := OpenDbDump(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	type cond struct {
+		i     int
+		value string
+	}
+	var conds []cond
+	for _, w := range where {
+		pos := strings.IndexByte(w, '=')
+		if pos < 0 {
+			return fmt.Errorf("bad condition '%s', want column=value", w)
+		}
+		i := dumpColumnIndex(d.Header.Columns, w[:pos])
+		if i < 0 {
+			return fmt.Errorf("column '%s' not in dump", w[:pos])
+		}
+		conds = append(conds, cond{i, w[pos+1:]})
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	var cw *csv.Writer
+	if *format == "csv" {
+		cw = csv.NewWriter(out)
+		cw.Write(dumpColumnNames(d.Header.Columns))
+	}
+rows:
+	for d.Next() {
+		row := d.Value()
+		for _, c := range conds {
+			if row[c.i] != c.value {
+				continue rows
+			}
+		}
+		if cw != nil {
+			cw.Write(row)
+			continue
+		}
+		writeJSONRow(out, d.Header.Columns, row)
+	}
+	if cw != nil {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	}
+	return d.Err()
+}
+
+func dumpColumnIndex(columns []DumpColumn, name string) int {
+	for i, c := range columns {
+		if strings.EqualFold(c.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func dumpColumnNames(columns []DumpColumn) []string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// writeJSONRow writes row as a JSON object in the order of columns, values
+// of number columns are JSON numbers if they are valid.
+func writeJSONRow(w *bufio.Writer, columns []DumpColumn, row []string) {
+	w.WriteByte('{')
+	for i, c := range columns {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		name, _ := json.Marshal(c.Name)
+		w.Write(name)
+		w.WriteByte(':')
+		if !c.IsString && json.Valid([]byte(row[i])) {
+			w.WriteString(row[i])
+			continue
+		}
+		v, _ := json.Marshal(row[i])
+		w.Write(v)
+	}
+	w.WriteString("}\n")
+}
+
+func cmdDumpConvert(args []string) error {
+	fs := newFlagSet("dump convert")
+	table := fs.String("table", "", "table of the dump made from CSV, SyncTableName of "+ConfigFile+" if empty")
+	stringColumns := fs.String("strings", "", "comma separated string columns of the dump made from CSV, others are numbers")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New(dumpUsage)
+	}
+	in, out := fs.Arg(0), fs.Arg(1)
+
+	if d, err := OpenDbDump(in); err == nil {
+		defer d.Close()
+		return convertDumpToCSV(d, out)
+	}
+	if c := newConfig(); *table == "" && c.IsFileExist(ConfigFile) {
+		if err := c.Load(ConfigFile); err != nil {
+			return fmt.Errorf("load config file '%s': %v", ConfigFile, err)
+		}
+		*table = c.SyncTableName
+	}
+	var strs []string
+	if *stringColumns != "" {
+		strs = strings.Split(*stringColumns, ",")
+	}
+	return convertCSVToDump(in, out, *table, strs)
+}
+
+func convertDumpToCSV(d *DbDump, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write(dumpColumnNames(d.Header.Columns))
+	n := 0
+	for d.Next() {
+		w.Write(d.Value())
+		n++
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := d.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	fmt.Printf("%s: %d rows\n", filename, n)
+	return f.Close()
+}
+
+func convertCSVToDump(in, out, table string, strs []string) error {
+	fin, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	r := csv.NewReader(fin)
+	names, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("read header of '%s': %v", in, err)
+	}
+	h := &DumpHeader{
+		Version:    DumpVersion,
+		Table:      table,
+		Created:    time.Now(),
+		Compressed: true,
+		Columns:    make([]DumpColumn, len(names)),
+	}
+	for i, name := range names {
+		h.Columns[i] = DumpColumn{name, util.ContainsFold(strs, name)}
+	}
+	for _, name := range strs {
+		if dumpColumnIndex(h.Columns, name) < 0 {
+			return fmt.Errorf("string column '%s' not in '%s'", name, in)
+		}
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(out)
+		return err
+	}
+	w, err := newDumpWriter(f, h)
+	if err != nil {
+		return fail(err)
+	}
+	n := 0
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if err := w.WriteRow(row); err != nil {
+			return fail(err)
+		}
+		n++
+	}
+	if err := w.Close(); err != nil {
+		return fail(err)
+	}
+	fmt.Printf("%s: %d rows\n", out, n)
+	return f.Close()
+}
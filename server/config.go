@@ -2,11 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
+	"sync"
+	"util"
 )
 
 type config struct {
-	Log string
+	Log string `secret:"expand"`
 
 	Listen           string
 	NotifyListen     string
@@ -16,42 +19,161 @@ type config struct {
 	Timeout          string
 	PushTimeout      string
 
-	ClientCA      string
-	Cert, CertKey string
+	ClientCA string `secret:"expand"`
+	Cert     string `secret:"expand"`
+	CertKey  string `secret:"expand"`
 
-	DSNFile  string
-	QueryLog string
+	DSNFile  string `secret:"expand"`
+	QueryLog string `secret:"expand"`
 
-	SyncTableName              string
+	SyncTableName string
+	// SyncClientTableName is the table written on clients, SyncTableName
+	// if empty. SyncColumns maps column names with "server:client".
+	SyncClientTableName string
+	// SyncClientDialect is the SQL dialect of client databases, "mysql"
+	// or "postgres".
+	SyncClientDialect          string
 	SyncColumns                string
 	SyncClientBeforeFullUpdate string
 	SyncClientInsert           string
 	SyncFullUpdate             string
 	SyncSingleUpdate           string
 	UseLockTable               bool
+	// StagedFullSync loads full syncs into a shadow of the client table
+	// which replaces it when complete, SyncClientBeforeFullUpdate is not
+	// run. Every column must be server owned.
+	StagedFullSync bool
+
+	// BundleCheckpoint queries the checkpoint of SyncTableName stored in
+	// offline bundles, like "SELECT MAX(last_modify) FROM $_TABLE".
+	// BundleChanges selects the rows changed after the checkpoint "?".
+	// Without them only full bundles are exported.
+	BundleCheckpoint string
+	BundleChanges    string
+
+	ShutdownTimeout string
+	// QueueDir keeps the queues of clients over a restart. They are
+	// restored if QueueCheckpoint, a query of the state of SyncTableName,
+	// returns the same row as at shutdown, queues are not kept if it is
+	// empty.
+	QueueDir        string `secret:"expand"`
+	QueueCheckpoint string
+	// DumpDir spools the rows of full syncs, dumps left by a crash are
+	// removed at startup. DumpCompress compresses them with flate.
+	DumpDir      string `secret:"expand"`
+	DumpCompress bool
+
+	// DBRules authorizes the "db" RPC service by client certificate common
+	// name, "*" applies to clients without their own rule.
+	DBRules map[string]*DBRule
+
+	// Upstream accepts tables pushed by clients, keyed by the client table
+	// name. The last applied batch of each client is kept in
+	// UpstreamSeqTable.
+	Upstream         map[string]*UpstreamTable
+	UpstreamSeqTable string
+
+	// ClientFilters limits the rows synced to a client, keyed by client
+	// UUID or certificate common name, "*" applies to other clients. A
+	// filter is a condition on the columns of SyncTableName, it replaces
+	// $_CLIENT_FILTER in SyncFullUpdate.
+	ClientFilters map[string]string
+
+	// ColumnProfiles drop, null or hash columns for some clients, keyed by
+	// profile name. ClientProfiles maps a client UUID, certificate common
+	// name or "*" to a profile name.
+	ColumnProfiles map[string]*ColumnProfile
+	ClientProfiles map[string]string
+
+	// DryRun records the statements of clients instead of executing them,
+	// keyed by client UUID, certificate common name or "*". They are
+	// appended to DryRunFile if set and served by "/dryrun" to loopback.
+	DryRun     map[string]bool
+	DryRunFile string `secret:"expand"`
+
+	// ConsoleReadWrite allows statements other than SELECT, SHOW, DESCRIBE
+	// and EXPLAIN in the "/console" of clients, keyed by client UUID or "*".
+	ConsoleReadWrite map[string]bool
 }
 
-var Config = &config{
-	Log: "server.log",
+var configMu sync.RWMutex
+var runningConfig = newConfig()
+var runningSQL = new(SQLTemplet)
+
+// currentConfig returns the running config. ReloadConfig replaces it as a
+// whole, callers keep the value for a consistent view and never modify it.
+func currentConfig() *config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return runningConfig
+}
+
+// currentSQL returns the templets of currentConfig.
+func currentSQL() *SQLTemplet {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return runningSQL
+}
+
+// setConfig makes c and st, its initialized templets, the running config.
+func setConfig(c *config, st *SQLTemplet) {
+	configMu.Lock()
+	runningConfig, runningSQL = c, st
+	configMu.Unlock()
+}
+
+func newConfig() *config {
+	return &config{
+		Log: "server.log",
+
+		Listen:           ":9443",
+		NotifyListen:     ":9444",
+		HttpListen:       ":9445",
+		NotifyServerName: "server",
+		Timeout:          "read=60s&write=5s&heartbeat=25s",
+		PushTimeout:      "read=60s&write=5s&heartbeat=25s",
+
+		ClientCA: "cert/clientca.pem",
+		Cert:     "cert/server.pem",
+		CertKey:  "cert/server.key",
 
-	Listen:           ":9443",
-	NotifyListen:     ":9444",
-	HttpListen:       ":9445",
-	NotifyServerName: "server",
-	Timeout:          "read=60s&write=5s&heartbeat=25s",
-	PushTimeout:      "read=60s&write=5s&heartbeat=25s",
+		DSNFile:  "db.dsn",
+		QueryLog: "query.log",
 
-	ClientCA: "cert/clientca.pem",
-	Cert:     "cert/server.pem",
-	CertKey:  "cert/server.key",
+		SyncClientDialect:          "mysql",
+		SyncClientBeforeFullUpdate: "",
+		SyncClientInsert:           "INSERT INTO $_TABLE ($_COLUMNS) VALUES $_VALUES ON DUPLICATE KEY UPDATE $_ALL_VALUES",
+		SyncFullUpdate:             "SELECT $_COLUMNS FROM $_TABLE",
+		SyncSingleUpdate:           "SELECT $_COLUMNS FROM $_TABLE WHERE id=? LIMIT 1",
 
-	DSNFile:  "db.dsn",
-	QueryLog: "query.log",
+		ShutdownTimeout: "30s",
+		QueueDir:        "queue",
+		QueueCheckpoint: "CHECKSUM TABLE $_TABLE",
+		DumpDir:         "dump",
+		DumpCompress:    true,
 
-	SyncClientBeforeFullUpdate: "",
-	SyncClientInsert:           "INSERT INTO $_TABLE ($_COLUMNS) VALUES $_VALUES ON DUPLICATE KEY UPDATE $_ALL_VALUES",
-	SyncFullUpdate:             "SELECT $_COLUMNS FROM $_TABLE",
-	SyncSingleUpdate:           "SELECT $_COLUMNS FROM $_TABLE WHERE id=? LIMIT 1",
+		DBRules: map[string]*DBRule{},
+
+		Upstream:         map[string]*UpstreamTable{},
+		UpstreamSeqTable: "sync_upstream_seq",
+
+		ClientFilters: map[string]string{},
+
+		ColumnProfiles: map[string]*ColumnProfile{},
+		ClientProfiles: map[string]string{},
+
+		DryRun:     map[string]bool{},
+		DryRunFile: "dryrun.sql",
+
+		ConsoleReadWrite: map[string]bool{},
+	}
+}
+
+func (c *config) clientTableName() string {
+	if c.SyncClientTableName != "" {
+		return c.SyncClientTableName
+	}
+	return c.SyncTableName
 }
 
 func (c *config) IsFileExist(filename string) bool {
@@ -66,7 +188,12 @@ func (c *config) Load(filename string) error {
 	defer f.Close()
 
 	dec := json.NewDecoder(f)
-	return dec.Decode(c)
+	if err := dec.Decode(c); err != nil {
+		return err
+	}
+	// ${ENV} and ${file:path} references in paths keep secrets out of the
+	// file, SQL is not expanded
+	return util.ExpandSecretsIn(c)
 }
 func (c *config) Save(filename string) error {
 	f, err := os.Create(filename)
@@ -79,3 +206,16 @@ func (c *config) Save(filename string) error {
 	enc.SetIndent("", "\t")
 	return enc.Encode(c)
 }
+
+func (c *config) Check() error {
+	if c.NotifyServerAddr == "" {
+		return errors.New("NotifyServerAddr not set")
+	}
+	if c.NotifyServerName == "" {
+		return errors.New("NotifyServerName not set")
+	}
+	if c.PushTimeout == "" {
+		return errors.New("PushTimeout not set")
+	}
+	return nil
+}
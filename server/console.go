@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"util"
+)
+
+const ConsoleUpgrade = "godbsync-console"
+
+const DefaultConsolePageSize = 20
+const DefaultConsoleIdleTimeout = 10 * time.Minute
+
+var consoleReadOnlyStatements = map[string]bool{
+	"SELECT":   true,
+	"SHOW":     true,
+	"DESC":     true,
+	"DESCRIBE": true,
+	"EXPLAIN":  true,
+}
+
+// HandleConsole upgrades the connection to a line based SQL console on the
+// database of the client given by the "client" parameter. The console is
+// read-only unless ConsoleReadWrite of the config allows the client. It is
+// served to loopback addresses only.
+type HandleConsole int
+
+func (*HandleConsole) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	clientUUID := r.FormValue("client")
+	c := NotifyClients.Get(clientUUID)
+	if c == nil {
+		http.Error(w, "Client Not Connected", http.StatusNotFound)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), ConsoleUpgrade) {
+		http.Error(w, "Upgrade Required", http.StatusUpgradeRequired)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("ERROR console hijack: %v", err)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n", ConsoleUpgrade)
+
+	cs := &consoleSession{
+		clientUUID: clientUUID,
+		c:          c,
+		conn:       conn,
+		rw:         rw,
+		readWrite:  isConsoleReadWrite(clientUUID),
+		pageSize:   DefaultConsolePageSize,
+	}
+	cs.run(r.RemoteAddr)
+}
+
+// isConsoleReadWrite reports if the console of a client by UUID may run
+// statements which change data.
+func isConsoleReadWrite(clientUUID string) bool {
+	allow := currentConfig().ConsoleReadWrite
+	if v, ok := allow[clientUUID]; ok {
+		return v
+	}
+	return allow["*"]
+}
+
+type consoleSession struct {
+	clientUUID string
+	c          *rpc.Client
+	conn       net.Conn
+	rw         *bufio.ReadWriter
+	readWrite  bool
+	pageSize   int
+
+	cursor  int64
+	columns []string
+}
+
+func (cs *consoleSession) printf(format string, a ...interface{}) {
+	fmt.Fprintf(cs.rw, format, a...)
+}
+
+// notify logs msg on the server and sends it to the client log.
+func (cs *consoleSession) notify(msg string) {
+	log.Printf("info: console[%s] %s", cs.clientUUID, msg)
+	var reply int32
+	cs.c.Call("client.Message", &ClientMessageArgs{Message: "console " + msg}, &reply)
+}
+
+func (cs *consoleSession) run(remoteAddr string) {
+	mode := "read-only"
+	if cs.readWrite {
+		mode = "read-write"
+	}
+	cs.notify(fmt.Sprintf("session opened by %s, %s", remoteAddr, mode))
+	defer cs.notify(fmt.Sprintf("session of %s closed", remoteAddr))
+	defer cs.closeCursor()
+
+	cs.printf("connected to client %s, %s\n", cs.clientUUID, mode)
+	cs.printf("end statements with ';', \\n next page, \\p <rows> page size, \\q quit\n")
+
+	var stmt strings.Builder
+	for {
+		if stmt.Len() == 0 {
+			cs.printf("sql> ")
+		} else {
+			cs.printf("  -> ")
+		}
+		cs.rw.Flush()
+
+		cs.conn.SetReadDeadline(time.Now().Add(DefaultConsoleIdleTimeout))
+		line, err := cs.rw.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("info: console[%s] read: %v", cs.clientUUID, err)
+			}
+			return
+		}
+		line = strings.TrimSpace(line)
+
+		if stmt.Len() == 0 && strings.HasPrefix(line, "\\") {
+			if !cs.command(line) {
+				return
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if stmt.Len() > 0 {
+			stmt.WriteByte('\n')
+		}
+		stmt.WriteString(line)
+		if strings.HasSuffix(line, ";") {
+			cs.statement(stmt.String())
+			stmt.Reset()
+		}
+	}
+}
+
+func (cs *consoleSession) command(line string) bool {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "\\q":
+		return false
+	case "\\n":
+		cs.fetch()
+	case "\\p":
+		if len(fields) < 2 {
+			cs.printf("page size %d\n", cs.pageSize)
+			break
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n <= 0 {
+			cs.printf("bad page size '%s'\n", fields[1])
+			break
+		}
+		cs.pageSize = n
+	default:
+		cs.printf("unknown command '%s'\n", fields[0])
+	}
+	return true
+}
+
+func (cs *consoleSession) statement(query string) {
+	cs.closeCursor()
+	st, err := util.ScanSQL(query)
+	if err != nil {
+		cs.printf("ERROR %v\n", err)
+		return
+	}
+	if st.Multi {
+		cs.printf("ERROR one statement at a time\n")
+		return
+	}
+	isQuery := consoleReadOnlyStatements[st.Type]
+	if !isQuery && !cs.readWrite {
+		cs.printf("ERROR %s not allowed in read-only console\n", st.Type)
+		return
+	}
+	log.Printf("info: console[%s] %q", cs.clientUUID, query)
+
+	if !isQuery {
+		var reply DBExecReply
+		if err := cs.c.Call("db.Exec", &DBQueryArgs{Command: query}, &reply); err != nil {
+			cs.printf("ERROR %v\n", err)
+			return
+		}
+		cs.printf("OK, %d rows affected\n", reply.RowsAffected)
+		return
+	}
+
+	var reply DBQueryReply
+	err = cs.c.Call("db.Query", &DBQueryArgs{Command: query, Columns: true, Typed: true}, &reply)
+	if err != nil {
+		cs.printf("ERROR %v\n", err)
+		return
+	}
+	cs.cursor, cs.columns = reply.Cursor, reply.Columns
+	cs.fetch()
+}
+
+func (cs *consoleSession) fetch() {
+	if cs.cursor == 0 {
+		cs.printf("no more rows\n")
+		return
+	}
+	var reply DBFetchReply
+	err := cs.c.Call("db.Fetch", &DBFetchArgs{Cursor: cs.cursor, Rows: cs.pageSize}, &reply)
+	if err != nil || reply.End {
+		// the client closes the cursor
+		cs.cursor = 0
+	}
+	if err != nil {
+		cs.printf("ERROR %v\n", err)
+		return
+	}
+	renderTable(cs.rw, cs.columns, reply.Cells)
+	if reply.End {
+		cs.printf("%d rows, end\n", len(reply.Cells))
+	} else {
+		cs.printf("%d rows, \\n for more\n", len(reply.Cells))
+	}
+}
+
+func (cs *consoleSession) closeCursor() {
+	if cs.cursor == 0 {
+		return
+	}
+	var reply int
+	cs.c.Call("db.CloseCursor", cs.cursor, &reply)
+	cs.cursor = 0
+}
+
+func renderTable(w io.Writer, columns []string, rows [][]util.Cell) {
+	widths := make([]int, len(columns))
+	for i, c := range columns {
+		widths[i] = utf8.RuneCountInString(c)
+	}
+	for _, row := range rows {
+		for i, c := range row {
+			if n := utf8.RuneCountInString(c.String()); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	var sb strings.Builder
+	sep := func() {
+		for _, w := range widths {
+			sb.WriteString("+-")
+			sb.WriteString(strings.Repeat("-", w))
+			sb.WriteByte('-')
+		}
+		sb.WriteString("+\n")
+	}
+	line := func(values []string) {
+		for i, v := range values {
+			sb.WriteString("| ")
+			sb.WriteString(v)
+			sb.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(v)+1))
+		}
+		sb.WriteString("|\n")
+	}
+
+	sep()
+	line(columns)
+	sep()
+	values := make([]string, len(columns))
+	for _, row := range rows {
+		for i := range row {
+			values[i] = row[i].String()
+		}
+		line(values)
+	}
+	sep()
+	io.WriteString(w, sb.String())
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"log"
+	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -11,6 +12,9 @@ import (
 type db struct {
 	logger *log.Logger
 	conn   *sql.DB
+
+	mu       sync.Mutex
+	database string
 }
 
 var DB = new(db)
@@ -26,6 +30,19 @@ func (db *db) Open(dsn string) error {
 func (db *db) Conn() *sql.DB {
 	return db.conn
 }
+
+// Database returns the default database of the DSN, it is queried once.
+func (db *db) Database() (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.database != "" {
+		return db.database, nil
+	}
+	qs := db.BeforeQuery("SELECT IFNULL(DATABASE(), '')")
+	err := db.conn.QueryRow(qs.SQL).Scan(&db.database)
+	qs.EndQuery(err)
+	return db.database, err
+}
 func (db *db) CheckConn() error {
 	_sql := "SELECT 'ping'"
 	var out string
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/url"
+	"time"
+	"util"
+)
+
+// DriverName is the database/sql driver which runs statements on the
+// database of a connected client, the DSN is "godbsync://<client-uuid>".
+// It maps database/sql onto the RpcDB methods of the client through its
+// live notify connection.
+const DriverName = "godbsync"
+
+const driverFetchRows = 256
+
+var ErrClientNotConnected = errors.New("client not connected")
+
+func init() {
+	sql.Register(DriverName, rpcDriver{})
+	gob.Register(time.Time{})
+}
+
+type rpcDriver struct{}
+
+func (rpcDriver) Open(dsn string) (driver.Conn, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != DriverName || u.Host == "" {
+		return nil, fmt.Errorf("bad dsn '%s', should be '%s://<client-uuid>'", dsn, DriverName)
+	}
+	c := NotifyClients.Get(u.Host)
+	if c == nil {
+		return nil, ErrClientNotConnected
+	}
+	return &rpcConn{clientUUID: u.Host, c: c}, nil
+}
+
+type rpcConn struct {
+	clientUUID string
+	c          *rpc.Client
+	tx         int64
+}
+
+func (c *rpcConn) call(serviceMethod string, args interface{}, reply interface{}) error {
+	err := c.c.Call(serviceMethod, args, reply)
+	if err == rpc.ErrShutdown {
+		return driver.ErrBadConn
+	}
+	return err
+}
+
+func (c *rpcConn) Prepare(query string) (driver.Stmt, error) {
+	var reply DBPrepareReply
+	err := c.call("db.Prepare", &DBQueryArgs{Command: query, Tx: c.tx}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcStmt{conn: c, id: reply.Stmt}, nil
+}
+func (c *rpcConn) Close() error {
+	// the rpc client belongs to the notify connection
+	if c.tx != 0 {
+		var reply int
+		c.call("db.Rollback", c.tx, &reply)
+		c.tx = 0
+	}
+	return nil
+}
+func (c *rpcConn) Begin() (driver.Tx, error) {
+	if c.tx != 0 {
+		return nil, errors.New("transaction already started")
+	}
+	var reply DBBeginReply
+	if err := c.call("db.Begin", 0, &reply); err != nil {
+		return nil, err
+	}
+	c.tx = reply.Tx
+	return rpcTx{c}, nil
+}
+func (c *rpcConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return c.exec(&DBQueryArgs{Command: query, Params: driverParams(args), Tx: c.tx})
+}
+func (c *rpcConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return c.query(&DBQueryArgs{Command: query, Params: driverParams(args), Tx: c.tx})
+}
+
+func (c *rpcConn) exec(args *DBQueryArgs) (driver.Result, error) {
+	var reply DBExecReply
+	if err := c.call("db.Exec", args, &reply); err != nil {
+		return nil, err
+	}
+	return rpcResult{reply}, nil
+}
+func (c *rpcConn) query(args *DBQueryArgs) (driver.Rows, error) {
+	args.Columns = true
+	args.Typed = true
+	var reply DBQueryReply
+	if err := c.call("db.Query", args, &reply); err != nil {
+		return nil, err
+	}
+	return &rpcRows{conn: c, cursor: reply.Cursor, columns: reply.Columns, types: reply.ColumnTypes}, nil
+}
+
+func driverParams(args []driver.Value) []interface{} {
+	params := make([]interface{}, len(args))
+	for i := range args {
+		params[i] = args[i]
+	}
+	return params
+}
+
+type rpcTx struct {
+	conn *rpcConn
+}
+
+func (tx rpcTx) Commit() error {
+	var reply int
+	id := tx.conn.tx
+	tx.conn.tx = 0
+	return tx.conn.call("db.Commit", id, &reply)
+}
+func (tx rpcTx) Rollback() error {
+	var reply int
+	id := tx.conn.tx
+	tx.conn.tx = 0
+	return tx.conn.call("db.Rollback", id, &reply)
+}
+
+type rpcStmt struct {
+	conn *rpcConn
+	id   int64
+}
+
+func (s *rpcStmt) Close() error {
+	var reply int
+	return s.conn.call("db.CloseStmt", s.id, &reply)
+}
+func (s *rpcStmt) NumInput() int {
+	return -1
+}
+func (s *rpcStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.exec(&DBQueryArgs{Stmt: s.id, Params: driverParams(args)})
+}
+func (s *rpcStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.query(&DBQueryArgs{Stmt: s.id, Params: driverParams(args)})
+}
+
+type rpcResult struct {
+	reply DBExecReply
+}
+
+func (r rpcResult) LastInsertId() (int64, error) {
+	return r.reply.LastInsertID, nil
+}
+func (r rpcResult) RowsAffected() (int64, error) {
+	return r.reply.RowsAffected, nil
+}
+
+type rpcRows struct {
+	conn    *rpcConn
+	cursor  int64
+	columns []string
+	types   []util.Column
+	buf     [][]util.Cell
+	end     bool
+}
+
+func (r *rpcRows) Columns() []string {
+	return r.columns
+}
+func (r *rpcRows) Close() error {
+	if r.end {
+		return nil
+	}
+	r.end = true
+	var reply int
+	return r.conn.call("db.CloseCursor", r.cursor, &reply)
+}
+func (r *rpcRows) Next(dest []driver.Value) error {
+	if len(r.buf) == 0 {
+		if r.end {
+			return io.EOF
+		}
+		var reply DBFetchReply
+		err := r.conn.call("db.Fetch", &DBFetchArgs{Cursor: r.cursor, Rows: driverFetchRows}, &reply)
+		if err != nil {
+			// the client closes the cursor on error
+			r.end = true
+			return err
+		}
+		r.buf, r.end = reply.Cells, reply.End
+		if len(r.buf) == 0 {
+			return io.EOF
+		}
+	}
+	row := r.buf[0]
+	r.buf = r.buf[1:]
+	for i := range dest {
+		v, err := row[i].Value()
+		if err != nil {
+			return err
+		}
+		dest[i] = v
+	}
+	return nil
+}
+func (r *rpcRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.types[index].Type
+}
+func (r *rpcRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	return r.types[index].Nullable, true
+}
+func (r *rpcRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	c := r.types[index]
+	return c.Precision, c.Scale, c.Kind == util.KindDecimal
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+)
+
+// dryRunKeepStatements is how many statements of each client are kept for
+// the "/dryrun" admin API.
+const dryRunKeepStatements = 200
+
+// dryRunProfile marks the queue of a dry-run client, rows sent in dry-run
+// never reach the client, so a full sync is done when dry-run ends.
+const dryRunProfile = "dry-run;"
+
+// isDryRun reports if the statements of a client by UUID or certificate
+// common name cn are recorded instead of executed.
+func isDryRun(clientUUID, cn string) bool {
+	dr := currentConfig().DryRun
+	if v, ok := dr[clientUUID]; ok {
+		return v
+	}
+	if v, ok := dr[cn]; ok {
+		return v
+	}
+	return dr["*"]
+}
+
+// DryRunStatement is a statement not executed on a dry-run client.
+type DryRunStatement struct {
+	Time   time.Time
+	Client string
+	// Rows is the count of rows rendered into SQL, Size its length in
+	// bytes and MaxPacket the packet size of the client.
+	Rows      int
+	Size      int
+	MaxPacket int
+	SQL       string
+}
+
+// dryRunRegistry tracks the notify connections of dry-run clients and the
+// last statements recorded for each client.
+type dryRunRegistry struct {
+	mu      sync.Mutex
+	clients map[*rpc.Client]string
+	stmts   map[string][]*DryRunStatement
+}
+
+var DryRuns = &dryRunRegistry{
+	clients: make(map[*rpc.Client]string),
+	stmts:   make(map[string][]*DryRunStatement),
+}
+
+func (r *dryRunRegistry) Add(clientUUID string, c *rpc.Client) {
+	r.mu.Lock()
+	r.clients[c] = clientUUID
+	r.mu.Unlock()
+}
+func (r *dryRunRegistry) Del(c *rpc.Client) {
+	r.mu.Lock()
+	delete(r.clients, c)
+	r.mu.Unlock()
+}
+func (r *dryRunRegistry) Enabled(c *rpc.Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.clients[c]
+	return ok
+}
+
+// Record keeps s and appends it to DryRunFile of the config if set.
+func (r *dryRunRegistry) Record(s *DryRunStatement) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stmts := append(r.stmts[s.Client], s)
+	if len(stmts) > dryRunKeepStatements {
+		stmts = stmts[len(stmts)-dryRunKeepStatements:]
+	}
+	r.stmts[s.Client] = stmts
+
+	file := currentConfig().DryRunFile
+	if file == "" {
+		return
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("ERROR open dry-run file: %v", err)
+		return
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "-- %s client=%s rows=%d size=%d max_packet=%d\n%s;\n",
+		s.Time.Format(time.RFC3339), s.Client, s.Rows, s.Size, s.MaxPacket, s.SQL)
+	if err != nil {
+		log.Printf("ERROR write dry-run file: %v", err)
+	}
+}
+
+// Statements returns the statements kept for a client, of all clients if
+// clientUUID is empty.
+func (r *dryRunRegistry) Statements(clientUUID string) []*DryRunStatement {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if clientUUID != "" {
+		return append([]*DryRunStatement(nil), r.stmts[clientUUID]...)
+	}
+	var res []*DryRunStatement
+	for _, stmts := range r.stmts {
+		res = append(res, stmts...)
+	}
+	return res
+}
+
+// clientExec executes stmt, which renders rows rows, on the client or
+// records it if the client is in dry-run. Dry-run statements affect no
+// rows.
+func clientExec(rpcClient *rpc.Client, clientUUID string, stmt string, rows int, maxPacketSize int) (int64, error) {
+	if DryRuns.Enabled(rpcClient) {
+		DryRuns.Record(&DryRunStatement{
+			Time:      time.Now(),
+			Client:    clientUUID,
+			Rows:      rows,
+			Size:      len(stmt),
+			MaxPacket: maxPacketSize,
+			SQL:       stmt,
+		})
+		return 0, nil
+	}
+	execReply := DBExecReply{}
+	if err := rpcClient.Call("db.Exec", &DBQueryArgs{Command: stmt}, &execReply); err != nil {
+		return 0, err
+	}
+	return execReply.RowsAffected, nil
+}
+
+// HandleDryRun returns the statements recorded for the client given by the
+// "client" parameter, of all clients without it.
+type HandleDryRun int
+
+func (*HandleDryRun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.Encode(DryRuns.Statements(r.FormValue("client")))
+}
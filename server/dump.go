@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"database/sql"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// A dump file starts with DumpMagic and the length, JSON and CRC of its
+// DumpHeader. Blocks of rows follow, each is the length and row count of
+// its data, the CRC of the data and the data, a gob encoded [][]string
+// which is flate compressed if the header says so. A block without rows
+// ends the file, its row count field holds the total row count, so a
+// truncated dump is detected. Integers are big endian uint32.
+const DumpMagic = "GDBDUMP1"
+const DumpVersion = 1
+
+const dumpBlockRows = 1000
+
+// DumpColumn describes a column of the rows in a dump.
+type DumpColumn struct {
+	Name     string
+	IsString bool
+}
+
+type DumpHeader struct {
+	Version int
+	Table   string
+	Columns []DumpColumn
+	// Position is where the rows were read, like a BundleCheckpoint,
+	// empty if unknown.
+	Position   string
+	Created    time.Time
+	Compressed bool
+}
+
+// DbDump is a dump file read row by row. Dumps made by MakeDbDump are
+// temporary files of DumpDir, removed by Close.
+type DbDump struct {
+	Header DumpHeader
+
+	f    *os.File
+	temp bool
+	r    *dumpReader
+	rows [][]string
+	val  []string
+	err  error
+}
+
+// MakeDbDump writes rows to a temporary dump, the header has the columns
+// and SyncTableName.
+func MakeDbDump(rows *sql.Rows, columns SyncColumns) (*DbDump, error) {
+	return NewDbDump(rows, columns, DumpHeader{Table: currentConfig().SyncTableName})
+}
+
+// NewDbDump is MakeDbDump with header h, its columns, version, created
+// time and compression are set.
+func NewDbDump(rows *sql.Rows, columns SyncColumns, h DumpHeader) (*DbDump, error) {
+	c := currentConfig()
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	dir := c.DumpDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, id.String()+".dump"))
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*DbDump, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	h.Version = DumpVersion
+	h.Created = time.Now()
+	h.Compressed = c.DumpCompress
+	h.Columns = make([]DumpColumn, len(columns))
+	for i, sc := range columns {
+		h.Columns[i] = DumpColumn{sc.Name, sc.IsString}
+	}
+	w, err := newDumpWriter(f, &h)
+	if err != nil {
+		return fail(err)
+	}
+	dest := make([]interface{}, len(columns))
+	for rows.Next() {
+		res := make([]string, len(columns))
+		if err := columns.Scan(res, rows, dest); err != nil {
+			return fail(err)
+		}
+		if err := w.WriteRow(res); err != nil {
+			return fail(err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fail(err)
+	}
+	if err := w.Close(); err != nil {
+		return fail(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	d := &DbDump{Header: h, f: f, temp: true}
+	openDumps.Store(d, struct{}{})
+	return d, nil
+}
+
+// OpenDbDump opens a dump file, Close does not remove it.
+func OpenDbDump(filename string) (*DbDump, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newDumpReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d := &DbDump{Header: r.header, f: f, r: r}
+	openDumps.Store(d, struct{}{})
+	return d, nil
+}
+
+var openDumps sync.Map
+
+// CloseDbDumps closes and removes every dump file still open.
+func CloseDbDumps() {
+	openDumps.Range(func(k, v interface{}) bool {
+		k.(*DbDump).Close()
+		return true
+	})
+}
+
+// CleanDumpDir removes the dumps left in dir by a server which did not
+// shut down, no dump is in use when the server starts.
+func CleanDumpDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.dump"))
+	if err != nil {
+		return err
+	}
+	for _, fname := range files {
+		if err := os.Remove(fname); err != nil {
+			return err
+		}
+		log.Printf("info: orphan dump '%s' removed", fname)
+	}
+	return nil
+}
+
+func (d *DbDump) Next() bool {
+	if d.r == nil && d.err == nil {
+		if _, err := d.f.Seek(0, io.SeekStart); err != nil {
+			d.err = err
+			return false
+		}
+		d.r, d.err = newDumpReader(d.f)
+	}
+	for d.err == nil && len(d.rows) == 0 {
+		d.rows, d.err = d.r.ReadBlock()
+	}
+	if d.err != nil {
+		return false
+	}
+	d.val, d.rows = d.rows[0], d.rows[1:]
+	return true
+}
+func (d *DbDump) Value() []string {
+	return d.val
+}
+
+// ReadRows reads up to n rows, it returns no rows at the end of the dump.
+func (d *DbDump) ReadRows(n int) ([][]string, error) {
+	var rows [][]string
+	for len(rows) < n && d.Next() {
+		rows = append(rows, d.val)
+	}
+	return rows, d.Err()
+}
+func (d *DbDump) Err() error {
+	if d.err == io.EOF {
+		return nil
+	}
+	return d.err
+}
+func (d *DbDump) Close() error {
+	if _, ok := openDumps.LoadAndDelete(d); !ok {
+		return nil
+	}
+	fname := d.f.Name()
+	d.f.Close()
+	if !d.temp {
+		return nil
+	}
+	return os.Remove(fname)
+}
+
+type dumpWriter struct {
+	w          *bufio.Writer
+	compressed bool
+	block      [][]string
+	total      int
+}
+
+func newDumpWriter(w io.Writer, h *DumpHeader) (*dumpWriter, error) {
+	dw := &dumpWriter{w: bufio.NewWriter(w), compressed: h.Compressed}
+	header, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	dw.w.WriteString(DumpMagic)
+	dw.writeUint32(uint32(len(header)))
+	dw.w.Write(header)
+	dw.writeUint32(crc32.ChecksumIEEE(header))
+	return dw, nil
+}
+
+func (dw *dumpWriter) writeUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	dw.w.Write(b[:])
+}
+
+func (dw *dumpWriter) WriteRow(row []string) error {
+	dw.block = append(dw.block, row)
+	if len(dw.block) < dumpBlockRows {
+		return nil
+	}
+	return dw.flush()
+}
+
+func (dw *dumpWriter) flush() error {
+	if len(dw.block) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *flate.Writer
+	if dw.compressed {
+		zw, _ = flate.NewWriter(&buf, flate.BestSpeed)
+		w = zw
+	}
+	if err := gob.NewEncoder(w).Encode(dw.block); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	dw.writeUint32(uint32(buf.Len()))
+	dw.writeUint32(uint32(len(dw.block)))
+	dw.writeUint32(crc32.ChecksumIEEE(buf.Bytes()))
+	_, err := dw.w.Write(buf.Bytes())
+	dw.total += len(dw.block)
+	dw.block = dw.block[:0]
+	return err
+}
+
+// Close writes the last block and the end of the dump.
+func (dw *dumpWriter) Close() error {
+	if err := dw.flush(); err != nil {
+		return err
+	}
+	dw.writeUint32(0)
+	dw.writeUint32(uint32(dw.total))
+	dw.writeUint32(0)
+	return dw.w.Flush()
+}
+
+type dumpReader struct {
+	r      *bufio.Reader
+	header DumpHeader
+	total  int
+}
+
+func newDumpReader(r io.Reader) (*dumpReader, error) {
+	dr := &dumpReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(DumpMagic))
+	if _, err := io.ReadFull(dr.r, magic); err != nil || string(magic) != DumpMagic {
+		return nil, errors.New("not a dump file")
+	}
+	n, err := dr.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, n)
+	if _, err := io.ReadFull(dr.r, header); err != nil {
+		return nil, dumpTruncated(err)
+	}
+	sum, err := dr.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if sum != crc32.ChecksumIEEE(header) {
+		return nil, errors.New("dump header checksum mismatch")
+	}
+	if err := json.Unmarshal(header, &dr.header); err != nil {
+		return nil, fmt.Errorf("dump header: %v", err)
+	}
+	if dr.header.Version != DumpVersion {
+		return nil, fmt.Errorf("unsupported dump version %d", dr.header.Version)
+	}
+	return dr, nil
+}
+
+func dumpTruncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("dump truncated")
+	}
+	return err
+}
+
+func (dr *dumpReader) readUint32() (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(dr.r, b[:]); err != nil {
+		return 0, dumpTruncated(err)
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// ReadBlock returns the rows of the next block, io.EOF after the end of
+// the dump.
+func (dr *dumpReader) ReadBlock() ([][]string, error) {
+	var v [3]uint32
+	for i := range v {
+		var err error
+		if v[i], err = dr.readUint32(); err != nil {
+			return nil, err
+		}
+	}
+	size, count, sum := v[0], int(v[1]), v[2]
+	if size == 0 {
+		if count != dr.total {
+			return nil, fmt.Errorf("dump has %d rows, %d expected", dr.total, count)
+		}
+		return nil, io.EOF
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(dr.r, data); err != nil {
+		return nil, dumpTruncated(err)
+	}
+	if sum != crc32.ChecksumIEEE(data) {
+		return nil, fmt.Errorf("dump block after row %d: checksum mismatch", dr.total)
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if dr.header.Compressed {
+		zr := flate.NewReader(r)
+		defer zr.Close()
+		r = zr
+	}
+	var rows [][]string
+	if err := gob.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, fmt.Errorf("dump block after row %d: %v", dr.total, err)
+	}
+	if len(rows) != count {
+		return nil, fmt.Errorf("dump block after row %d: %d rows, %d expected", dr.total, len(rows), count)
+	}
+	dr.total += count
+	return rows, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestDump(t *testing.T, filename string, rows int, compressed bool) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	h := &DumpHeader{Version: DumpVersion, Table: "bus_authorized", Compressed: compressed}
+	w, err := newDumpWriter(f, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < rows; i++ {
+		w.WriteRow([]string{fmt.Sprint(i), "plate"})
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDumpFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, compressed := range []bool{false, true} {
+		filename := filepath.Join(dir, "test.dump")
+		writeTestDump(t, filename, 2500, compressed)
+		d, err := OpenDbDump(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for d.Next() {
+			if d.Value()[0] != fmt.Sprint(n) {
+				t.Fatalf("row %d: got %v", n, d.Value())
+			}
+			n++
+		}
+		if err := d.Err(); err != nil || n != 2500 || d.Header.Table != "bus_authorized" {
+			t.Errorf("compressed=%v: %d rows, err %v", compressed, n, err)
+		}
+		d.Close()
+
+		// a truncated dump is an error, not a short dump
+		data, _ := ioutil.ReadFile(filename)
+		ioutil.WriteFile(filename, data[:len(data)-20], 0644)
+		d, err = OpenDbDump(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for d.Next() {
+		}
+		if d.Err() == nil {
+			t.Errorf("compressed=%v: truncated dump read without error", compressed)
+		}
+		d.Close()
+	}
+}
+
+func TestDumpConvertCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in.csv")
+	data := "id,plate\n1,\"A,1\"\n2,B2\n"
+	if err := ioutil.WriteFile(in, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dump := filepath.Join(dir, "out.dump")
+	if err := convertCSVToDump(in, dump, "bus_authorized", []string{"plate"}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := OpenDbDump(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.Header.Table != "bus_authorized" || len(d.Header.Columns) != 2 ||
+		d.Header.Columns[0].IsString || !d.Header.Columns[1].IsString {
+		t.Fatalf("bad header %+v", d.Header)
+	}
+	out := filepath.Join(dir, "out.csv")
+	if err := convertDumpToCSV(d, out); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != data {
+		t.Fatalf("round trip gives %q", res)
+	}
+	if err := convertCSVToDump(in, dump, "", []string{"name"}); err == nil {
+		t.Fatal("unknown string column accepted")
+	}
+}
@@ -3,12 +3,28 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 )
 
+// localOnly serves h to loopback addresses only, the HTTP listener has no
+// authentication.
+func localOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 type HandleNotify int
 
 func (*HandleNotify) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := currentSQL()
 	if r.Method != "POST" {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
@@ -26,15 +42,17 @@ func (*HandleNotify) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rows := make([][]string, 0, len(ids))
 	for _, id := range ids {
-		row := DB.Conn().QueryRow(SQL.SyncSingleUpdate, id)
-		res, err := SQL.Columns.ScanRow(row)
+		row := DB.Conn().QueryRow(st.SyncSingleUpdate, id)
+		res, err := st.ServerColumns.ScanRow(row)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error Query Database: %v", err), http.StatusInternalServerError)
 			return
 		}
-		DefaultQM.Append(res)
+		rows = append(rows, res)
 	}
+	DefaultQM.Append(rows)
 	http.Error(w, fmt.Sprintf("OK, %d item processed", len(ids)), http.StatusOK)
 	return
 }
@@ -47,7 +65,30 @@ func (*HandleStat) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	enc.Encode(Stat)
 }
 
+type HandleReload int
+
+func (*HandleReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := ReloadConfig(ConfigFile)
+	if err != nil {
+		log.Printf("ERROR reload config: %v", err)
+		http.Error(w, fmt.Sprintf("Error Reload Config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("info: config reloaded, applied: %v, need restart: %v", res.Applied, res.NeedRestart)
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.Encode(res)
+}
+
 func init() {
 	http.DefaultServeMux.Handle("/notify", new(HandleNotify))
 	http.DefaultServeMux.Handle("/stat", new(HandleStat))
+	http.DefaultServeMux.Handle("/reload", localOnly(new(HandleReload)))
+	http.DefaultServeMux.Handle("/console", localOnly(new(HandleConsole)))
+	http.DefaultServeMux.Handle("/dryrun", localOnly(new(HandleDryRun)))
 }
@@ -2,18 +2,25 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
+	"os/signal"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"util"
 )
 
-const ConfigFile = "config.json"
+// ConfigFile is the config of the server, commands override it by the
+// -config flag.
+var ConfigFile = "config.json"
+
 const ServerVersion = 10000
 
 const DefaultReadTimeout = 60 * time.Second
@@ -21,42 +28,45 @@ const DefaultWriteTimeout = 5 * time.Second
 const DefaultHeartbeatTimeout = 25 * time.Second
 
 func main() {
-	if !Config.IsFileExist(ConfigFile) {
-		err := Config.Save(ConfigFile)
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		os.Exit(runCommand(args[0], args[1:]))
+	}
+	os.Exit(runCommand("run", args))
+}
+
+// run serves clients until SIGINT or SIGTERM.
+func run() {
+	c := newConfig()
+	if !c.IsFileExist(ConfigFile) {
+		err := c.Save(ConfigFile)
 		if err != nil {
 			log.Fatalf("FAILED create config file '%s': %v", ConfigFile, err)
 			return
 		}
-		log.Printf("info: config file created, please check config and restart server")
+		log.Fatalf("FAILED config file '%s' not found, a default one is created, check it with check-config and restart server", ConfigFile)
 		return
 	}
 
-	err := Config.Load(ConfigFile)
+	err := c.Load(ConfigFile)
 	if err != nil {
 		log.Fatalf("FAILED load config file '%s': %v", ConfigFile, err)
 		return
 	}
 
-	if Config.NotifyServerAddr == "" {
-		log.Fatalf("FAILED config NotifyServerAddr not set")
-		return
-	}
-	if Config.NotifyServerName == "" {
-		log.Fatalf("FAILED config NotifyServerName not set")
-		return
-	}
-	if Config.PushTimeout == "" {
-		log.Fatalf("FAILED config PushTimeout not set")
+	if err := c.Check(); err != nil {
+		log.Fatalf("FAILED config: %v", err)
 		return
 	}
 
-	timeoutConfig, err := util.ParseTimeoutConfig(Config.Timeout)
+	tc, err := util.ParseTimeoutConfig(c.Timeout)
 	if err != nil {
 		log.Fatalf("FAILED parse config Timeout: %v", err)
 		return
 	}
+	setTimeout(tc)
 
-	flog, err := os.OpenFile(Config.Log, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0755)
+	flog, err := os.OpenFile(c.Log, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0755)
 	if err != nil {
 		log.Fatalf("FAILED write log: %v", err)
 		return
@@ -65,8 +75,21 @@ func main() {
 	log.SetOutput(io.MultiWriter(os.Stderr, flog))
 	log.Println("info: app started")
 
-	SQL.Init(Config)
-	dsn, err := readDSN(Config.DSNFile)
+	qlog, err := os.OpenFile(c.QueryLog, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0755)
+	if err != nil {
+		log.Fatalf("FAILED write query log: %v", err)
+		return
+	}
+	defer qlog.Close()
+	DB.SetLogger(log.New(qlog, "", log.LstdFlags))
+
+	st := new(SQLTemplet)
+	if err := st.Init(c); err != nil {
+		log.Fatalf("FAILED init SQL: %v", err)
+		return
+	}
+	setConfig(c, st)
+	dsn, err := util.ReadDSN(c.DSNFile)
 	if err != nil {
 		log.Fatalf("FAILED load DSN: %v", err)
 		return
@@ -77,42 +100,57 @@ func main() {
 		return
 	}
 
-	tlsConfig, err := NewTLSConfig(Config)
+	err = TLS.Load(c)
 	if err != nil {
 		log.Fatalf("FAILED config TLS: %v", err)
 		return
 	}
 
-	l, err := tls.Listen("tcp", Config.Listen, tlsConfig.Clone())
+	l, err := tls.Listen("tcp", c.Listen, TLS.ListenerConfig())
 	if err != nil {
-		log.Fatalf("FAILED Create Server '%s': %v", Config.Listen, err)
+		log.Fatalf("FAILED Create Server '%s': %v", c.Listen, err)
 		return
 	}
-	lHttp, err := net.Listen("tcp", Config.HttpListen)
+	lHttp, err := net.Listen("tcp", c.HttpListen)
 	if err != nil {
-		log.Fatalf("FAILED Create Server '%s': %v", Config.HttpListen, err)
+		log.Fatalf("FAILED Create Server '%s': %v", c.HttpListen, err)
 		return
 	}
-	lNotify, err := tls.Listen("tcp", Config.NotifyListen, tlsConfig.Clone())
+	lNotify, err := tls.Listen("tcp", c.NotifyListen, TLS.ListenerConfig())
 	if err != nil {
-		log.Fatalf("FAILED Create Server '%s': %v", Config.NotifyListen, err)
+		log.Fatalf("FAILED Create Server '%s': %v", c.NotifyListen, err)
 		return
 	}
 
-	go startRPCServ(l, timeoutConfig)
-	go startNotifyServ(lNotify, timeoutConfig)
-	err = http.Serve(lHttp, http.DefaultServeMux)
-	if err != nil {
-		log.Fatalf("FAILED serve http '%s': %v", Config.HttpListen, err)
-		return
+	if err := restoreQueues(c.QueueDir); err != nil {
+		log.Printf("ERROR restore queues: %v", err)
+	}
+	if err := CleanDumpDir(c.DumpDir); err != nil {
+		log.Printf("ERROR clean dump dir: %v", err)
 	}
-}
 
-func startRPCServ(l net.Listener, timeout *util.TimeoutConfig) {
-	rpcServ := rpc.NewServer()
-	rpcServ.RegisterName("client", new(RpcClient))
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
-	var servConn = func(conn io.ReadWriteCloser) {
+	srv := &http.Server{Handler: http.DefaultServeMux}
+	go handleReloadSignal(ConfigFile)
+	go startRPCServ(l)
+	go startNotifyServ(lNotify)
+	go func() {
+		err := srv.Serve(lHttp)
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("FAILED serve http '%s': %v", c.HttpListen, err)
+		}
+	}()
+
+	s := <-sig
+	log.Printf("info: %v received, shutting down", s)
+	shutdownServer(srv, l, lHttp, lNotify)
+	log.Println("info: app stopped")
+}
+
+func startRPCServ(l net.Listener) {
+	var servConn = func(conn net.Conn) {
 		defer func() {
 			atomic.AddInt64(&Stat.ConnectionRPC, -1)
 			p := recover()
@@ -121,7 +159,27 @@ func startRPCServ(l net.Listener, timeout *util.TimeoutConfig) {
 			}
 		}()
 		atomic.AddInt64(&Stat.ConnectionRPC, 1)
-		rpcServ.ServeConn(conn)
+
+		timeout := currentTimeout()
+		readTimeout, _ := timeout.Get("read", DefaultReadTimeout)
+		cn, err := peerCommonName(conn, readTimeout)
+		if err != nil {
+			log.Printf("ERROR rpc handshake %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		tc := util.NewTimeoutConn(conn)
+		tc.ReadTimeout = readTimeout
+		tc.WriteTimeout, _ = timeout.Get("write", DefaultWriteTimeout)
+		cursorTTL, _ := timeout.Get("cursor", DefaultCursorTTL)
+
+		s := newSession(cn, cursorTTL)
+		defer s.Close()
+		rpcServ := rpc.NewServer()
+		rpcServ.RegisterName("client", new(RpcClient))
+		rpcServ.RegisterName("db", &RpcDB{cn: cn, s: s})
+		rpcServ.RegisterName("upstream", &RpcUpstream{cn: cn})
+		rpcServ.ServeConn(tc)
 	}
 
 	for {
@@ -130,15 +188,36 @@ func startRPCServ(l net.Listener, timeout *util.TimeoutConfig) {
 			log.Print("rpc.Serve: accept:", err.Error())
 			return
 		}
-		tc := util.NewTimeoutConn(conn)
-		tc.ReadTimeout, _ = timeout.Get("read", DefaultReadTimeout)
-		tc.WriteTimeout, _ = timeout.Get("write", DefaultWriteTimeout)
-		go servConn(tc)
+		go servConn(conn)
 	}
 }
 
-func startNotifyServ(l net.Listener, timeout *util.TimeoutConfig) {
-	var handleConn = func(conn io.ReadWriteCloser) {
+// peerCommonName completes the TLS handshake of conn and returns the common
+// name of the client certificate.
+func peerCommonName(conn net.Conn, timeout time.Duration) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", errors.New("not a TLS connection")
+	}
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("no client certificate")
+	}
+	return certs[0].Subject.CommonName, nil
+}
+
+func startNotifyServ(l net.Listener) {
+	var handleConn = func(conn net.Conn) {
+		if !Shutdown.Enter() {
+			conn.Close()
+			return
+		}
+		defer Shutdown.Leave()
 		defer func() {
 			atomic.AddInt64(&Stat.ConnectionRPC, -1)
 			p := recover()
@@ -147,7 +226,19 @@ func startNotifyServ(l net.Listener, timeout *util.TimeoutConfig) {
 			}
 		}()
 		atomic.AddInt64(&Stat.ConnectionRPC, 1)
-		handleNotifyConn(conn)
+
+		timeout := currentTimeout()
+		readTimeout, _ := timeout.Get("read", DefaultReadTimeout)
+		cn, err := peerCommonName(conn, readTimeout)
+		if err != nil {
+			log.Printf("ERROR notify handshake %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		tc := util.NewTimeoutConn(conn)
+		tc.ReadTimeout = readTimeout
+		tc.WriteTimeout, _ = timeout.Get("write", DefaultWriteTimeout)
+		handleNotifyConn(tc, cn)
 	}
 
 	for {
@@ -156,9 +247,6 @@ func startNotifyServ(l net.Listener, timeout *util.TimeoutConfig) {
 			log.Print("rpc.Serve: accept:", err.Error())
 			return
 		}
-		tc := util.NewTimeoutConn(conn)
-		tc.ReadTimeout, _ = timeout.Get("read", DefaultReadTimeout)
-		tc.WriteTimeout, _ = timeout.Get("write", DefaultWriteTimeout)
-		go handleConn(tc)
+		go handleConn(conn)
 	}
 }
@@ -2,17 +2,32 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/rpc"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
 
-func handleNotifyConn(conn io.ReadWriteCloser) {
+// clientFilter returns the filter of a client by UUID or certificate
+// common name cn.
+func clientFilter(clientUUID, cn string) string {
+	filters := currentConfig().ClientFilters
+	if f, ok := filters[clientUUID]; ok {
+		return f
+	}
+	if f, ok := filters[cn]; ok {
+		return f
+	}
+	return filters["*"]
+}
+
+func handleNotifyConn(conn io.ReadWriteCloser, cn string) {
 	rpcClient := rpc.NewClient(conn)
 	defer rpcClient.Close()
 
@@ -41,7 +56,13 @@ func handleNotifyConn(conn io.ReadWriteCloser) {
 		}
 		clientUUID = u2.String()
 		log.Printf("info: new client UUID generated '%s'", clientUUID)
-		// sql := "REPLACE INTO `sync_vars` () VALUES ()"
+		var reply int32
+		if err := rpcClient.Call("client.SetClientID", clientUUID, &reply); err != nil {
+			log.Printf("ERROR rpc set client uuid: %v", err)
+			clientSendMessagef("error set client uuid: %v", err)
+			clientSendMessagef("server will close connection")
+			return
+		}
 		clientSendMessagef("set client UUID '%s'", clientUUID)
 	}
 
@@ -61,6 +82,24 @@ func handleNotifyConn(conn io.ReadWriteCloser) {
 		}
 	}
 	_ = maxPacketSize
+	sink := clientSink(rpcClient)
+	if sink != "" {
+		log.Printf("info: client[%s] applies rows to a %s sink", clientUUID, sink)
+	}
+	dryRun := isDryRun(clientUUID, cn)
+	if dryRun && sink != "" {
+		log.Printf("info: client[%s] has a sink, dry-run ignored", clientUUID)
+		dryRun = false
+	}
+	if dryRun {
+		log.Printf("info: client[%s] in dry-run, statements are recorded instead of executed", clientUUID)
+		clientSendMessagef("dry-run, statements are recorded on the server")
+		DryRuns.Add(clientUUID, rpcClient)
+		defer DryRuns.Del(rpcClient)
+	}
+
+	NotifyClients.Add(clientUUID, cn, rpcClient)
+	defer NotifyClients.Del(rpcClient)
 
 	err := preSync(rpcClient, clientUUID)
 	if err != nil {
@@ -70,6 +109,12 @@ func handleNotifyConn(conn io.ReadWriteCloser) {
 		return
 	}
 
+	filter := clientFilter(clientUUID, cn)
+	tpl := currentSQL().Client(clientUUID, cn)
+	profile := tpl.Signature
+	if dryRun {
+		profile = dryRunProfile + profile
+	}
 	var q *Queue
 	defer func() {
 		if q != nil {
@@ -78,18 +123,39 @@ func handleNotifyConn(conn io.ReadWriteCloser) {
 	}()
 	log.Printf("info: enter sync loop")
 	for {
+		if Shutdown.Closing() {
+			clientSendMessagef(shutdownMessage)
+			return
+		}
 		q = DefaultQM.Get(clientUUID)
+		if q != nil && q.Filter != filter {
+			log.Printf("info: filter of client[%s] changed to %q", clientUUID, filter)
+			q.Close()
+			q = nil
+		}
+		if q != nil && q.Profile != profile {
+			log.Printf("info: column profile of client[%s] changed to %q", clientUUID, profile)
+			q.Close()
+			q = nil
+		}
 		if q == nil {
 			log.Printf("info: start full sync[%s]", clientUUID)
-			q, err = fullSync(clientUUID, DefaultQM, rpcClient, maxPacketSize)
+			q, err = fullSync(clientUUID, filter, profile, tpl, sink != "", DefaultQM, rpcClient, maxPacketSize)
 			if err != nil {
 				log.Printf("ERROR full sync[%s]: %v", clientUUID, err)
 				clientSendMessagef("error full sync: %v", err)
 				return
 			}
+			q.SetReady()
 		}
 
 		for {
+			if Shutdown.Closing() {
+				// keep the queue, it is flushed for the next start
+				q = nil
+				clientSendMessagef(shutdownMessage)
+				return
+			}
 			res, err := q.RetrieveTimeout(time.Millisecond * 100)
 			if err != nil {
 				log.Printf("ERROR retrieve item[%s]: %v", clientUUID, err)
@@ -98,22 +164,21 @@ func handleNotifyConn(conn io.ReadWriteCloser) {
 			}
 
 			for len(res) > 0 {
-				var sql string
-				sql, res = SQL.ClientInsertSlice(res, maxPacketSize)
-				if sql != "" {
-					execArgs := DBQueryArgs{
-						Command: sql,
-					}
-					execReply := DBExecReply{}
-					err := rpcClient.Call("db.Exec", &execArgs, &execReply)
-					if err != nil {
-						log.Printf("ERROR rpc db.Exec[%s] 'INSERT INTO ...': %v", clientUUID, err)
-						clientSendMessagef("error exec 'INSERT INTO': %v", err)
-						clientSendMessagef("server will close connection")
-						return
-					}
-					log.Printf("client db.Exec[%s] 'INSERT INTO ...', RowsAffected: %d",
-						clientUUID, execReply.RowsAffected)
+				if Shutdown.Aborted() {
+					q.PutBack(res)
+					q = nil
+					return
+				}
+				if sink != "" {
+					res, err = sinkApply(rpcClient, tpl, clientUUID, res)
+				} else {
+					res, err = clientApply(rpcClient, tpl, clientUUID, res, maxPacketSize)
+				}
+				if err != nil {
+					log.Printf("ERROR %v", err)
+					clientSendMessagef("error exec: %v", err)
+					clientSendMessagef("server will close connection")
+					return
 				}
 			}
 		}
@@ -125,83 +190,164 @@ func preSync(rpcClient *rpc.Client, clientUUID string) error {
 	return nil
 }
 
-func fullSync(clientUUID string, qm *QueueMap, rpcClient *rpc.Client, maxPacketSize int) (*Queue, error) {
+// fullSync sends the rows of filter to the client, they are rendered by
+// the templet tpl of the client or sent to its file sink. The queue of the
+// client is created with filter and the column profile signature profile.
+func fullSync(clientUUID string, filter string, profile string, tpl *SQLTemplet, sink bool, qm *QueueMap, rpcClient *rpc.Client, maxPacketSize int) (*Queue, error) {
+	c, st := currentConfig(), currentSQL()
 	var err error
 	var rows *sql.Rows
 	var tx *sql.Tx
 
 	defer func() {
 		if tx != nil {
-			tx.Exec(SQL.UnlockTable)
+			tx.Exec(st.UnlockTable)
 			tx.Commit()
 		}
 	}()
 
-	if Config.UseLockTable {
+	if c.UseLockTable {
 		tx, err = DB.Conn().Begin()
 		if err != nil {
 			return nil, fmt.Errorf("begin transaction, %v", err)
 		}
-		_, err = tx.Exec(SQL.LockTable)
+		_, err = tx.Exec(st.LockTable)
 		if err != nil {
 			return nil, fmt.Errorf("lock table, %v", err)
 		}
-		rows, err = tx.Query(SQL.SyncFullUpdate)
+		rows, err = tx.Query(st.FullUpdate(filter))
 	} else {
-		rows, err = DB.Conn().Query(SQL.SyncFullUpdate)
+		rows, err = DB.Conn().Query(st.FullUpdate(filter))
 	}
 	if err != nil {
 		return nil, fmt.Errorf("query, %v", err)
 	}
 	defer rows.Close()
-	d, err := MakeDbDump(rows, SQL.Columns)
+	d, err := MakeDbDump(rows, st.ServerColumns)
 	if err != nil {
 		return nil, fmt.Errorf("dump, %v", err)
 	}
 	defer d.Close()
 
 	if tx != nil {
-		tx.Exec(SQL.UnlockTable)
+		tx.Exec(st.UnlockTable)
 		tx.Commit()
 		tx = nil
 	}
 
 	q := NewQueue(clientUUID)
+	q.Filter = filter
+	q.Profile = profile
 	qm.Add(q)
 
-	if SQL.SyncClientBeforeFullUpdate != "" {
-		execArgs := DBQueryArgs{
-			Command: SQL.SyncClientBeforeFullUpdate,
-		}
-		execReply := DBExecReply{}
-		err := rpcClient.Call("db.Exec", &execArgs, &execReply)
+	if sink {
+		return q, sinkFullSync(rpcClient, tpl, clientUUID, d)
+	}
+	if c.StagedFullSync {
+		return q, stagedFullSync(rpcClient, tpl, clientUUID, d, maxPacketSize)
+	}
+	if st.SyncClientBeforeFullUpdate != "" {
+		affected, err := clientExec(rpcClient, clientUUID, st.SyncClientBeforeFullUpdate, 0, maxPacketSize)
 		if err != nil {
-			err = fmt.Errorf("rpc db.Exec '%s': %v", execArgs.Command, err)
+			err = fmt.Errorf("rpc db.Exec '%s': %v", st.SyncClientBeforeFullUpdate, err)
 			return nil, err
 		}
 		log.Printf("client db.Exec[%s] '%s', RowsAffected: %d",
-			clientUUID, execArgs.Command, execReply.RowsAffected)
+			clientUUID, st.SyncClientBeforeFullUpdate, affected)
 	}
 
+	return q, clientInsertDump(rpcClient, tpl, clientUUID, d, maxPacketSize)
+}
+
+// clientInsertDump upserts the rows of d on the client.
+func clientInsertDump(rpcClient *rpc.Client, tpl *SQLTemplet, clientUUID string, d *DbDump, maxPacketSize int) error {
 	for {
-		sql, end := SQL.ClientInsertDump(d, maxPacketSize)
-		if sql != "" {
-			execArgs := DBQueryArgs{
-				Command: sql,
-			}
-			execReply := DBExecReply{}
-			err := rpcClient.Call("db.Exec", &execArgs, &execReply)
+		if Shutdown.Aborted() {
+			return errors.New(shutdownMessage)
+		}
+		res, err := d.ReadRows(fullSyncBatchRows)
+		if err != nil {
+			return fmt.Errorf("read dump, %v", err)
+		}
+		if len(res) == 0 {
+			return nil
+		}
+		for len(res) > 0 {
+			res, err = clientInsert(rpcClient, tpl, clientUUID, res, maxPacketSize)
 			if err != nil {
-				err = fmt.Errorf("rpc db.Exec[%s] 'INSERT INTO ...': %v", clientUUID, err)
-				return q, err
+				return err
 			}
-			log.Printf("client db.Exec[%s] 'INSERT INTO ...', RowsAffected: %d",
-				clientUUID, execReply.RowsAffected)
 		}
-		if end {
-			break
+	}
+}
+
+const fullSyncBatchRows = 1000
+
+// clientApply sends the first packet of items, upserts and deletes are
+// sent in the order of the queue. It returns the items not sent.
+func clientApply(rpcClient *rpc.Client, tpl *SQLTemplet, clientUUID string, items []QueueItem, maxPacketSize int) ([]QueueItem, error) {
+	n := 1
+	for n < len(items) && items[n].Delete == items[0].Delete {
+		n++
+	}
+	res := make([][]string, n)
+	for i := range res {
+		res[i] = items[i].Row
+	}
+	var rest [][]string
+	var err error
+	if items[0].Delete {
+		rest, err = clientDelete(rpcClient, tpl, clientUUID, res, maxPacketSize)
+	} else {
+		rest, err = clientInsert(rpcClient, tpl, clientUUID, res, maxPacketSize)
+	}
+	if err != nil {
+		return items, err
+	}
+	return items[n-len(rest):], nil
+}
+
+// clientDelete deletes the rows of res which fit in one packet on the
+// client and returns the rest.
+func clientDelete(rpcClient *rpc.Client, tpl *SQLTemplet, clientUUID string, res [][]string, maxPacketSize int) ([][]string, error) {
+	sql, rest := tpl.ClientDeleteSlice(res, maxPacketSize)
+	if sql == "" {
+		return rest, nil
+	}
+	affected, err := clientExec(rpcClient, clientUUID, sql, len(res)-len(rest), maxPacketSize)
+	if err != nil {
+		return res, fmt.Errorf("rpc db.Exec[%s] 'DELETE FROM ...': %v", clientUUID, err)
+	}
+	log.Printf("client db.Exec[%s] 'DELETE FROM ...', RowsAffected: %d",
+		clientUUID, affected)
+	return rest, nil
+}
+
+// clientInsert upserts the rows of res which fit in one packet on the
+// client and returns the rest. Conflicts with newer client rows are
+// recorded on the client first.
+func clientInsert(rpcClient *rpc.Client, tpl *SQLTemplet, clientUUID string, res [][]string, maxPacketSize int) ([][]string, error) {
+	sql, rest := tpl.ClientInsertSlice(res, maxPacketSize)
+	if sql == "" {
+		return rest, nil
+	}
+	n := len(res) - len(rest)
+	for _, stmt := range tpl.ClientConflicts(res[:n], maxPacketSize) {
+		affected, err := clientExec(rpcClient, clientUUID, stmt, n, maxPacketSize)
+		if err != nil {
+			return res, fmt.Errorf("rpc db.Exec[%s] 'INSERT INTO %s ...': %v", clientUUID, ConflictTable, err)
+		}
+		if affected > 0 {
+			atomic.AddInt64(&Stat.Conflicts, affected)
+			log.Printf("info: conflicts[%s]: %d rows kept newer client version", clientUUID, affected)
 		}
 	}
 
-	return q, nil
+	affected, err := clientExec(rpcClient, clientUUID, sql, n, maxPacketSize)
+	if err != nil {
+		return res, fmt.Errorf("rpc db.Exec[%s] 'INSERT INTO ...': %v", clientUUID, err)
+	}
+	log.Printf("client db.Exec[%s] 'INSERT INTO ...', RowsAffected: %d",
+		clientUUID, affected)
+	return rest, nil
 }
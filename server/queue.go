@@ -1,7 +1,13 @@
 package main
 
 import (
+	"encoding/gob"
 	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,11 +25,31 @@ func NewQueueMap() *QueueMap {
 
 var DefaultQM = NewQueueMap()
 
+// QueueItem is a row for one client. Delete removes the row by its key
+// columns instead of upserting it, rows are deleted once they leave the
+// filter of the client.
+type QueueItem struct {
+	Delete bool
+	Row    []string
+}
+
 type Queue struct {
 	id  string
 	qm  *QueueMap
 	End chan int
-	C   chan []string
+	C   chan QueueItem
+
+	// Filter is the client filter of the full sync, rows appended later
+	// are matched against it.
+	Filter string
+	// Profile is the Signature of the column profile of the full sync.
+	Profile string
+
+	// ready is set once the full sync of the client finished, only ready
+	// queues are flushed on shutdown.
+	ready     bool
+	pending   []QueueItem
+	pendingMu sync.Mutex
 
 	once sync.Once
 }
@@ -51,12 +77,42 @@ func (qm *QueueMap) Get(id string) *Queue {
 	return qm.m[id]
 }
 
-func (qm *QueueMap) Append(val []string) {
+// Append queues rows to every client, rows which do not pass the filter of
+// a client delete it there.
+func (qm *QueueMap) Append(rows [][]string) {
 	qm.mu.RLock()
-	defer qm.mu.RUnlock()
+	queues := make([]*Queue, 0, len(qm.m))
+	for _, q := range qm.m {
+		queues = append(queues, q)
+	}
+	qm.mu.RUnlock()
 
-	for _, v := range qm.m {
-		v.Append(val)
+	// clients often share a filter, match each filter once for all rows,
+	// nil if it failed
+	st := currentSQL()
+	matched := make(map[string][]bool)
+	for _, q := range queues {
+		if q.Filter == "" {
+			for _, row := range rows {
+				q.Append(QueueItem{Row: row})
+			}
+			continue
+		}
+		match, ok := matched[q.Filter]
+		if !ok {
+			var err error
+			match, err = st.MatchFilter(q.Filter, rows)
+			if err != nil {
+				log.Printf("ERROR match filter[%s] %q: %v", q.id, q.Filter, err)
+			}
+			matched[q.Filter] = match
+		}
+		if match == nil {
+			continue
+		}
+		for i, row := range rows {
+			q.Append(QueueItem{Delete: !match[i], Row: row})
+		}
 	}
 }
 
@@ -64,10 +120,10 @@ func NewQueue(id string) *Queue {
 	return &Queue{
 		id:  id,
 		End: make(chan int, 1),
-		C:   make(chan []string, 2*1024),
+		C:   make(chan QueueItem, 2*1024),
 	}
 }
-func (q *Queue) Append(val []string) {
+func (q *Queue) Append(val QueueItem) {
 	select {
 	case q.C <- val:
 
@@ -75,17 +131,20 @@ func (q *Queue) Append(val []string) {
 		q.Close()
 	}
 }
-func (q *Queue) Retrieve(timeout time.Duration) ([]string, error) {
+func (q *Queue) Retrieve(timeout time.Duration) (QueueItem, error) {
 	for {
 		select {
 		case <-q.End:
-			return nil, errors.New("queue closed")
+			return QueueItem{}, errors.New("queue closed")
 		case out := <-q.C:
 			return out, nil
 		}
 	}
 }
-func (q *Queue) RetrieveTimeout(timeout time.Duration) (res [][]string, err error) {
+func (q *Queue) RetrieveTimeout(timeout time.Duration) (res []QueueItem, err error) {
+	q.pendingMu.Lock()
+	res, q.pending = q.pending, nil
+	q.pendingMu.Unlock()
 	for {
 		select {
 		case <-q.End:
@@ -99,6 +158,26 @@ func (q *Queue) RetrieveTimeout(timeout time.Duration) (res [][]string, err erro
 	}
 }
 
+// PutBack returns rows retrieved but not sent, they are retrieved again
+// before any row in C.
+func (q *Queue) PutBack(res []QueueItem) {
+	q.pendingMu.Lock()
+	q.pending = append(res, q.pending...)
+	q.pendingMu.Unlock()
+}
+
+// SetReady marks the full sync of the client finished.
+func (q *Queue) SetReady() {
+	q.pendingMu.Lock()
+	q.ready = true
+	q.pendingMu.Unlock()
+}
+func (q *Queue) Ready() bool {
+	q.pendingMu.Lock()
+	defer q.pendingMu.Unlock()
+	return q.ready
+}
+
 func (q *Queue) Close() {
 	q.once.Do(func() {
 		q.End <- 1
@@ -108,3 +187,119 @@ func (q *Queue) Close() {
 		}
 	})
 }
+
+type queueFile struct {
+	ID      string
+	Columns string
+	Filter  string
+	Profile string
+	// Position is the QueueCheckpoint row of SyncTableName when flushed.
+	Position string
+	Items    []QueueItem
+}
+
+// Flush writes pending rows of every ready queue to dir, one file per
+// client, with the checkpoint position of the table. Restore loads them
+// back so a restarted server can continue without a full sync. Queues must
+// not be in use.
+func (qm *QueueMap) Flush(dir string, position string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	qm.mu.RLock()
+	queues := make([]*Queue, 0, len(qm.m))
+	for _, q := range qm.m {
+		// client UUID is used as file name
+		if q.Ready() && !strings.ContainsAny(q.id, "/\\.") {
+			queues = append(queues, q)
+		}
+	}
+	qm.mu.RUnlock()
+
+	columns := currentSQL().ServerColumns.String()
+	for _, q := range queues {
+		qf := queueFile{
+			ID:       q.id,
+			Columns:  columns,
+			Filter:   q.Filter,
+			Profile:  q.Profile,
+			Position: position,
+		}
+		q.pendingMu.Lock()
+		qf.Items, q.pending = q.pending, nil
+		q.pendingMu.Unlock()
+	drain:
+		for {
+			select {
+			case item := <-q.C:
+				qf.Items = append(qf.Items, item)
+			default:
+				break drain
+			}
+		}
+
+		if err := writeQueueFile(filepath.Join(dir, q.id+".queue"), &qf); err != nil {
+			return fmt.Errorf("flush queue[%s]: %v", q.id, err)
+		}
+		log.Printf("info: queue[%s] flushed, %d rows", q.id, len(qf.Items))
+	}
+	return nil
+}
+
+func writeQueueFile(filename string, qf *queueFile) error {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(qf)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// Restore loads the queues flushed at position. Queues of another or an
+// empty position are dropped, the table changed while the server was
+// down and their clients do a full sync.
+func (qm *QueueMap) Restore(dir string, position string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.queue"))
+	if err != nil {
+		return err
+	}
+	for _, filename := range files {
+		var qf queueFile
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		err = gob.NewDecoder(f).Decode(&qf)
+		f.Close()
+		os.Remove(filename)
+		if err != nil {
+			log.Printf("ERROR restore queue '%s': %v", filename, err)
+			continue
+		}
+		if qf.Columns != currentSQL().ServerColumns.String() {
+			log.Printf("info: queue[%s] dropped, columns changed", qf.ID)
+			continue
+		}
+		if position == "" || qf.Position != position {
+			log.Printf("info: queue[%s] dropped, flushed at %q, table is at %q", qf.ID, qf.Position, position)
+			continue
+		}
+		q := NewQueue(qf.ID)
+		q.ready = true
+		q.Filter = qf.Filter
+		q.Profile = qf.Profile
+		q.pending = qf.Items
+		qm.Add(q)
+		log.Printf("info: queue[%s] restored, %d rows", qf.ID, len(qf.Items))
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueueFlushRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	flush := func(ready bool) []QueueItem {
+		qm := NewQueueMap()
+		q := NewQueue("c1")
+		q.Filter = "id=1"
+		q.Profile = "p1"
+		if ready {
+			q.SetReady()
+		}
+		qm.Add(q)
+		q.Append(QueueItem{Row: []string{"3"}})
+		q.PutBack([]QueueItem{{Row: []string{"1"}}, {Delete: true, Row: []string{"2"}}})
+		if err := qm.Flush(dir, "pos1"); err != nil {
+			t.Fatal(err)
+		}
+		return []QueueItem{{Row: []string{"1"}}, {Delete: true, Row: []string{"2"}}, {Row: []string{"3"}}}
+	}
+
+	items := flush(true)
+	qm := NewQueueMap()
+	if err := qm.Restore(dir, "pos1"); err != nil {
+		t.Fatal(err)
+	}
+	q := qm.Get("c1")
+	if q == nil {
+		t.Fatal("queue not restored")
+	}
+	if !q.Ready() || q.Filter != "id=1" || q.Profile != "p1" {
+		t.Errorf("restored queue ready %v, filter %q, profile %q", q.Ready(), q.Filter, q.Profile)
+	}
+	got, err := q.RetrieveTimeout(100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, items) {
+		t.Errorf("restored items %v, want %v", got, items)
+	}
+
+	for _, position := range []string{"pos2", ""} {
+		flush(true)
+		qm = NewQueueMap()
+		if err := qm.Restore(dir, position); err != nil {
+			t.Fatal(err)
+		}
+		if qm.Get("c1") != nil {
+			t.Errorf("queue flushed at pos1 restored at %q", position)
+		}
+	}
+
+	flush(false)
+	qm = NewQueueMap()
+	if err := qm.Restore(dir, "pos1"); err != nil {
+		t.Fatal(err)
+	}
+	if qm.Get("c1") != nil {
+		t.Error("queue flushed before its full sync finished")
+	}
+}
+
+// filterDriver answers MatchFilter queries, every even row matches. It
+// counts the queries it receives.
+type filterDriver struct{ queries int }
+
+func (d *filterDriver) Open(name string) (driver.Conn, error) { return filterConn{d}, nil }
+
+type filterConn struct{ d *filterDriver }
+
+func (c filterConn) Prepare(query string) (driver.Stmt, error) { return filterStmt{c.d, query}, nil }
+func (c filterConn) Close() error                              { return nil }
+func (c filterConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type filterStmt struct {
+	d     *filterDriver
+	query string
+}
+
+func (s filterStmt) Close() error  { return nil }
+func (s filterStmt) NumInput() int { return 0 }
+func (s filterStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (s filterStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.queries++
+	var ids []int64
+	for _, m := range regexp.MustCompile(`SELECT (\d+) AS _sync_row`).FindAllStringSubmatch(s.query, -1) {
+		if id, _ := strconv.ParseInt(m[1], 10, 64); id%2 == 0 {
+			ids = append(ids, id)
+		}
+	}
+	return &filterRows{ids: ids}, nil
+}
+
+type filterRows struct{ ids []int64 }
+
+func (r *filterRows) Columns() []string { return []string{"_sync_row"} }
+func (r *filterRows) Close() error      { return nil }
+func (r *filterRows) Next(dest []driver.Value) error {
+	if len(r.ids) == 0 {
+		return io.EOF
+	}
+	dest[0], r.ids = r.ids[0], r.ids[1:]
+	return nil
+}
+
+func TestQueueMapAppendFilters(t *testing.T) {
+	fd := new(filterDriver)
+	sql.Register("filter_test", fd)
+	conn, _ := sql.Open("filter_test", "")
+	defer conn.Close()
+	DB.conn, DB.logger = conn, log.New(ioutil.Discard, "", 0)
+	defer func() { DB.conn, DB.logger = nil, nil }()
+
+	c := testConfig("id@key,$plate")
+	st := newTestTemplet(t, c)
+	oldConfig, oldSQL := currentConfig(), currentSQL()
+	setConfig(c, st)
+	defer setConfig(oldConfig, oldSQL)
+
+	qm := NewQueueMap()
+	for i, filter := range []string{"", "id<10", "id<10", "plate='A'", "id<10"} {
+		q := NewQueue(fmt.Sprintf("c%d", i))
+		q.Filter = filter
+		qm.Add(q)
+	}
+	rows := make([][]string, matchFilterRows+3)
+	for i := range rows {
+		rows[i] = []string{strconv.Itoa(i), "A"}
+	}
+	qm.Append(rows)
+
+	// two distinct filters, two queries each for matchFilterRows+3 rows
+	if fd.queries != 4 {
+		t.Errorf("%d queries for %d rows", fd.queries, len(rows))
+	}
+	for id, q := range qm.m {
+		if len(q.C) != len(rows) {
+			t.Errorf("queue[%s] has %d rows, want %d", id, len(q.C), len(rows))
+			continue
+		}
+		for i := range rows {
+			item := <-q.C
+			want := q.Filter != "" && i%2 != 0
+			if item.Row[0] != rows[i][0] || item.Delete != want {
+				t.Errorf("queue[%s] row %d: %+v", id, i, item)
+				break
+			}
+		}
+	}
+}
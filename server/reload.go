@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"util"
+)
+
+// restartConfigFields lists config fields which can not be changed on a
+// running server. Listeners, log files and the database are opened once in
+// main, queued rows are shaped by SyncTableName and SyncColumns, and
+// UpstreamSeqTable is created once.
+var restartConfigFields = map[string]bool{
+	"Log":           true,
+	"Listen":        true,
+	"NotifyListen":  true,
+	"HttpListen":    true,
+	"DSNFile":       true,
+	"QueryLog":      true,
+	"SyncTableName": true,
+	"SyncColumns":   true,
+
+	"UpstreamSeqTable": true,
+}
+
+type ReloadResult struct {
+	Applied     []string
+	NeedRestart []string
+}
+
+var reloadMu sync.Mutex
+
+var timeoutMu sync.RWMutex
+var timeoutConfig = new(util.TimeoutConfig)
+
+func currentTimeout() *util.TimeoutConfig {
+	timeoutMu.RLock()
+	defer timeoutMu.RUnlock()
+	return timeoutConfig
+}
+func setTimeout(tc *util.TimeoutConfig) {
+	timeoutMu.Lock()
+	timeoutConfig = tc
+	timeoutMu.Unlock()
+}
+
+// ReloadConfig reads filename and applies every setting which does not need
+// a restart. Settings which do need a restart keep their running value and
+// are reported in NeedRestart. Nothing is applied if the new config is
+// invalid.
+func ReloadConfig(filename string) (*ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	nc := newConfig()
+	if err := nc.Load(filename); err != nil {
+		return nil, fmt.Errorf("load config file '%s': %v", filename, err)
+	}
+	if err := nc.Check(); err != nil {
+		return nil, fmt.Errorf("check config: %v", err)
+	}
+
+	res := new(ReloadResult)
+	oldv := reflect.ValueOf(currentConfig()).Elem()
+	newv := reflect.ValueOf(nc).Elem()
+	for i := 0; i < newv.NumField(); i++ {
+		name := newv.Type().Field(i).Name
+		if reflect.DeepEqual(oldv.Field(i).Interface(), newv.Field(i).Interface()) {
+			continue
+		}
+		if restartConfigFields[name] {
+			res.NeedRestart = append(res.NeedRestart, name)
+			newv.Field(i).Set(oldv.Field(i))
+			continue
+		}
+		res.Applied = append(res.Applied, name)
+	}
+
+	tc, err := util.ParseTimeoutConfig(nc.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("parse config Timeout: %v", err)
+	}
+	st := new(SQLTemplet)
+	if err := st.Init(nc); err != nil {
+		return nil, fmt.Errorf("init SQL: %v", err)
+	}
+	// certificate files may be replaced in place, so TLS is always reloaded
+	if err := TLS.Load(nc); err != nil {
+		return nil, fmt.Errorf("config TLS: %v", err)
+	}
+	res.Applied = append(res.Applied, "TLS")
+
+	setTimeout(tc)
+	setConfig(nc, st)
+	return res, nil
+}
+
+func handleReloadSignal(filename string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		log.Printf("info: SIGHUP received, reload config '%s'", filename)
+		res, err := ReloadConfig(filename)
+		if err != nil {
+			log.Printf("ERROR reload config: %v", err)
+			continue
+		}
+		log.Printf("info: config reloaded, applied: %v, need restart: %v", res.Applied, res.NeedRestart)
+	}
+}
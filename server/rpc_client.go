@@ -32,15 +32,16 @@ func (*RpcClient) Connect(args *ClientConnectArgs, reply *ClientConnectReply) er
 	return nil
 }
 func (*RpcClient) GetValue(key string, value *string) (err error) {
+	c := currentConfig()
 	switch key {
 	case "notify_server_addr":
-		if Config.NotifyServerName != "" {
-			*value = Config.NotifyServerAddr + "<" + Config.NotifyServerName + ">"
+		if c.NotifyServerName != "" {
+			*value = c.NotifyServerAddr + "<" + c.NotifyServerName + ">"
 		} else {
-			*value = Config.NotifyServerAddr
+			*value = c.NotifyServerAddr
 		}
 	case "timeout_config":
-		*value = Config.PushTimeout
+		*value = c.PushTimeout
 	default:
 		err = errors.New("unknown key")
 	}
@@ -1,6 +1,18 @@
 package main
 
-type RpcDB int
+import (
+	"database/sql"
+	"errors"
+	"util"
+)
+
+// RpcDB serves one client RPC connection on the server database. cn is the
+// common name of the client certificate, every statement is checked
+// against its DBRule.
+type RpcDB struct {
+	cn string
+	s  *util.Session
+}
 
 type DBQueryArgs struct {
 	Command string
@@ -8,6 +20,9 @@ type DBQueryArgs struct {
 	Stmt    int64
 	Tx      int64
 	Columns bool
+	// Typed requests results in Cells and column metadata in ColumnTypes
+	// instead of Results.
+	Typed bool
 }
 
 type DBExecReply struct {
@@ -15,12 +30,15 @@ type DBExecReply struct {
 	RowsAffected int64
 }
 type DBQueryReply struct {
-	Columns []string
-	Cursor  int64
+	Columns     []string
+	ColumnTypes []util.Column
+	Cursor      int64
 }
 type DBQueryAllReply struct {
-	Columns []string
-	Results [][]string
+	Columns     []string
+	ColumnTypes []util.Column
+	Results     [][]string
+	Cells       [][]util.Cell
 }
 type DBFetchArgs struct {
 	Cursor int64
@@ -29,6 +47,7 @@ type DBFetchArgs struct {
 type DBFetchReply struct {
 	End     bool
 	Results [][]string
+	Cells   [][]util.Cell
 }
 type DBBeginReply struct {
 	Tx int64
@@ -37,30 +56,241 @@ type DBPrepareReply struct {
 	Stmt int64
 }
 
-func (*RpcDB) Exec(args *DBQueryArgs, reply *DBExecReply) error {
-	panic("not implements")
+func (r *RpcDB) Exec(args *DBQueryArgs, reply *DBExecReply) error {
+	q, err := r.getQuerier(args)
+	if err != nil {
+		return err
+	}
+
+	qs := DB.BeforeQuery(args.Command, args.Params...)
+	result, err := q.Exec(qs.SQL, qs.Params...)
+	qs.EndQuery(err)
+	if err != nil {
+		return err
+	}
+	reply.LastInsertID, _ = result.LastInsertId()
+	reply.RowsAffected, _ = result.RowsAffected()
+	return nil
+}
+func (r *RpcDB) Query(args *DBQueryArgs, reply *DBQueryReply) error {
+	q, err := r.getQuerier(args)
+	if err != nil {
+		return err
+	}
+	qs := DB.BeforeQuery(args.Command, args.Params...)
+	rows, err := q.Query(qs.SQL, qs.Params...)
+	qs.EndQuery(err)
+	if err != nil {
+		return err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return err
+	}
+	if args.Columns {
+		reply.Columns = columns
+	}
+	of := &util.Handle{Rows: rows, ColumnCount: len(columns)}
+	if args.Typed {
+		of.ColumnTypes, err = util.ScanColumns(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		reply.ColumnTypes = of.ColumnTypes
+	}
+	id, err := r.s.Create(of)
+	if err != nil {
+		rows.Close()
+		return err
+	}
+	reply.Cursor = id
+	return nil
+}
+func (r *RpcDB) QueryAll(args *DBQueryArgs, reply *DBQueryAllReply) error {
+	q, err := r.getQuerier(args)
+	if err != nil {
+		return err
+	}
+	qs := DB.BeforeQuery(args.Command, args.Params...)
+	rows, err := q.Query(qs.SQL, qs.Params...)
+	qs.EndQuery(err)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if args.Columns {
+		reply.Columns = columns
+	}
+
+	if args.Typed {
+		reply.ColumnTypes, err = util.ScanColumns(rows)
+		if err != nil {
+			return err
+		}
+		reply.Cells, _, err = util.ScanCells(rows, reply.ColumnTypes, -1)
+		return err
+	}
+	reply.Results, _, err = util.Fetch(rows, len(columns), -1)
+	return err
 }
-func (*RpcDB) Query(args *DBQueryArgs, reply *DBQueryReply) error {
-	panic("not implements")
+func (r *RpcDB) QueryScalar(args *DBQueryArgs, reply *int64) error {
+	q, err := r.getQuerier(args)
+	if err != nil {
+		return err
+	}
+
+	qs := DB.BeforeQuery(args.Command, args.Params...)
+	err = q.QueryRow(qs.SQL, qs.Params...).Scan(reply)
+	qs.EndQuery(err)
+	return err
 }
-func (*RpcDB) QueryAll(args *DBQueryArgs, reply *DBQueryAllReply) error {
-	panic("not implements")
+
+func (r *RpcDB) getQuerier(args *DBQueryArgs) (util.Querier, error) {
+	if args.Stmt != 0 {
+		// checked by Prepare
+		of, err := r.s.Retrieve(args.Stmt)
+		if err != nil {
+			return nil, err
+		}
+		if of.Stmt == nil {
+			return nil, errors.New("resource is not statement")
+		}
+		return util.StmtQuerier{Stmt: of.Stmt}, nil
+	}
+	if err := checkDBRule(r.cn, args.Command); err != nil {
+		return nil, err
+	}
+	if args.Tx != 0 {
+		of, err := r.s.Retrieve(args.Tx)
+		if err != nil {
+			return nil, err
+		}
+		if of.Tx == nil {
+			return nil, errors.New("resource is not transaction")
+		}
+		return of.Tx, nil
+	}
+	return DB.Conn(), nil
 }
-func (*RpcDB) QueryScalar(args *DBQueryArgs, reply *int64) error {
-	panic("not implements")
+
+func (r *RpcDB) Fetch(args *DBFetchArgs, reply *DBFetchReply) (err error) {
+	of, err := r.s.Retrieve(args.Cursor)
+	if err != nil {
+		return err
+	}
+	if of.Rows == nil {
+		return errors.New("resource is not cursor")
+	}
+
+	if of.ColumnTypes != nil {
+		reply.Cells, reply.End, err = util.ScanCells(of.Rows, of.ColumnTypes, args.Rows)
+	} else {
+		reply.Results, reply.End, err = util.Fetch(of.Rows, of.ColumnCount, args.Rows)
+	}
+	if err != nil || reply.End {
+		reply.End = true
+		of.Rows.Close()
+		r.s.Release(args.Cursor)
+	}
+	return err
 }
-func (*RpcDB) Fetch(args *DBFetchArgs, reply *DBFetchReply) (err error) {
-	panic("not implements")
+func (r *RpcDB) CloseCursor(id int64, reply *int) error {
+	of, err := r.s.Retrieve(id)
+	if err != nil {
+		return err
+	}
+	if of.Rows == nil {
+		return errors.New("resource is not cursor")
+	}
+	*reply = 1
+	r.s.Release(id)
+	return of.Rows.Close()
 }
-func (*RpcDB) Commit(id int64, reply *int) error {
-	panic("not implements")
+func (r *RpcDB) Begin(args int, reply *DBBeginReply) error {
+	if dbRule(r.cn) == nil {
+		return &RuleError{r.cn, "BEGIN", "no rule for client"}
+	}
+	tx, err := DB.Conn().Begin()
+	if err != nil {
+		return err
+	}
+
+	id, err := r.s.Create(&util.Handle{Tx: tx})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	reply.Tx = id
+	return nil
+}
+func (r *RpcDB) Commit(id int64, reply *int) error {
+	of, err := r.s.Retrieve(id)
+	if err != nil {
+		return err
+	}
+	if of.Tx == nil {
+		return errors.New("resource is not transaction")
+	}
+	*reply = 1
+	r.s.Release(id)
+	return of.Tx.Commit()
 }
-func (*RpcDB) Rollback(id int64, reply *int) error {
-	panic("not implements")
+func (r *RpcDB) Rollback(id int64, reply *int) error {
+	of, err := r.s.Retrieve(id)
+	if err != nil {
+		return err
+	}
+	if of.Tx == nil {
+		return errors.New("resource is not transaction")
+	}
+	*reply = 1
+	r.s.Release(id)
+	return of.Tx.Rollback()
 }
-func (*RpcDB) Prepare(args DBQueryArgs, reply *DBPrepareReply) (err error) {
-	panic("not implements")
+func (r *RpcDB) Prepare(args DBQueryArgs, reply *DBPrepareReply) (err error) {
+	if err := checkDBRule(r.cn, args.Command); err != nil {
+		return err
+	}
+	var stmt *sql.Stmt
+	if args.Tx != 0 {
+		of, errof := r.s.Retrieve(args.Tx)
+		if errof != nil {
+			return errof
+		}
+		if of.Tx == nil {
+			return errors.New("resource is not transaction")
+		}
+		stmt, err = of.Tx.Prepare(args.Command)
+	} else {
+		stmt, err = DB.Conn().Prepare(args.Command)
+	}
+	if err != nil {
+		return err
+	}
+
+	id, err := r.s.Create(&util.Handle{Stmt: stmt, SQL: args.Command})
+	if err != nil {
+		stmt.Close()
+		return err
+	}
+	reply.Stmt = id
+	return nil
 }
-func (*RpcDB) CloseStmt(id int64, reply *int) error {
-	panic("not implements")
+func (r *RpcDB) CloseStmt(id int64, reply *int) error {
+	of, err := r.s.Retrieve(id)
+	if err != nil {
+		return err
+	}
+	if of.Stmt == nil {
+		return errors.New("resource is not statement")
+	}
+	*reply = 1
+	r.s.Release(id)
+	return of.Stmt.Close()
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"util"
+)
+
+// UpstreamTable maps a table pushed by clients to a central table.
+type UpstreamTable struct {
+	// Table is the central table, rows are upserted so it needs a unique
+	// key on ClientColumn and the key columns of the client table.
+	Table string
+	// ClientColumn receives the UUID of the client, "client_uuid" if empty.
+	ClientColumn string
+	// Columns lists the columns clients may push, any if empty.
+	Columns []string
+}
+
+const DefaultUpstreamClientColumn = "client_uuid"
+
+// RpcUpstream receives rows captured on a client, cn is the common name of
+// the client certificate.
+type RpcUpstream struct {
+	cn string
+}
+
+type UpstreamPushArgs struct {
+	ClientID string
+	Table    string
+	// Seq numbers the batches of a table, it is only advanced by the
+	// client after an ack.
+	Seq     int64
+	Columns []string
+	Cells   [][]util.Cell
+}
+type UpstreamPushReply struct {
+	// Applied is false if Seq is not newer than LastSeq.
+	Applied bool
+	LastSeq int64
+}
+
+var upstreamSeqOnce sync.Once
+var upstreamSeqErr error
+
+func createUpstreamSeqTable() error {
+	upstreamSeqOnce.Do(func() {
+		_, upstreamSeqErr = DB.Conn().Exec("CREATE TABLE IF NOT EXISTS `" + currentConfig().UpstreamSeqTable + "` (" +
+			"client_uuid VARCHAR(64) NOT NULL, " +
+			"src_table VARCHAR(64) NOT NULL, " +
+			"seq BIGINT NOT NULL, " +
+			"updated_at DATETIME NOT NULL, " +
+			"PRIMARY KEY (client_uuid, src_table))")
+	})
+	return upstreamSeqErr
+}
+
+func (r *RpcUpstream) Push(args *UpstreamPushArgs, reply *UpstreamPushReply) error {
+	cfg := currentConfig()
+	ut := cfg.Upstream[args.Table]
+	if ut == nil {
+		return fmt.Errorf("table '%s' not accepted", args.Table)
+	}
+	if args.ClientID == "" {
+		return fmt.Errorf("client uuid not set")
+	}
+	// rows are stored under the UUID, it must be the one the notify
+	// connection with the same certificate identified
+	if !NotifyClients.Identifies(r.cn, args.ClientID) {
+		log.Printf("ERROR upstream[%s] rejected, no notify connection of cert '%s' with that uuid", args.ClientID, r.cn)
+		return fmt.Errorf("client uuid '%s' not identified for cert '%s'", args.ClientID, r.cn)
+	}
+	for _, c := range args.Columns {
+		if !isIdentifier(c) || (len(ut.Columns) > 0 && !util.ContainsFold(ut.Columns, c)) {
+			return fmt.Errorf("column '%s' not accepted", c)
+		}
+	}
+	if err := createUpstreamSeqTable(); err != nil {
+		return fmt.Errorf("create table '%s': %v", cfg.UpstreamSeqTable, err)
+	}
+
+	tx, err := DB.Conn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	qs := DB.BeforeQuery("SELECT seq FROM `"+cfg.UpstreamSeqTable+"` WHERE client_uuid=? AND src_table=? FOR UPDATE", args.ClientID, args.Table)
+	err = tx.QueryRow(qs.SQL, qs.Params...).Scan(&reply.LastSeq)
+	qs.EndQuery(err)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if args.Seq <= reply.LastSeq {
+		log.Printf("info: upstream[%s] %s seq %d already applied, last %d", args.ClientID, args.Table, args.Seq, reply.LastSeq)
+		return nil
+	}
+
+	if len(args.Cells) > 0 {
+		q, params := upstreamInsert(ut, args)
+		qs = DB.BeforeQuery(q, params...)
+		_, err = tx.Exec(qs.SQL, qs.Params...)
+		qs.EndQuery(err)
+		if err != nil {
+			return err
+		}
+	}
+	qs = DB.BeforeQuery("INSERT INTO `"+cfg.UpstreamSeqTable+"` (client_uuid, src_table, seq, updated_at) VALUES (?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE seq=VALUES(seq), updated_at=VALUES(updated_at)",
+		args.ClientID, args.Table, args.Seq, time.Now().Format("2006-01-02 15:04:05"))
+	_, err = tx.Exec(qs.SQL, qs.Params...)
+	qs.EndQuery(err)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("info: upstream[%s] %s seq %d, %d rows applied (cert '%s')", args.ClientID, args.Table, args.Seq, len(args.Cells), r.cn)
+	reply.Applied = true
+	reply.LastSeq = args.Seq
+	return nil
+}
+
+func upstreamInsert(ut *UpstreamTable, args *UpstreamPushArgs) (string, []interface{}) {
+	clientColumn := ut.ClientColumn
+	if clientColumn == "" {
+		clientColumn = DefaultUpstreamClientColumn
+	}
+
+	var sb strings.Builder
+	sb.WriteString("INSERT INTO `" + ut.Table + "` (`" + clientColumn + "`")
+	for _, c := range args.Columns {
+		sb.WriteString(",`" + c + "`")
+	}
+	sb.WriteString(") VALUES ")
+	row := "(?" + strings.Repeat(",?", len(args.Columns)) + ")"
+	params := make([]interface{}, 0, len(args.Cells)*(len(args.Columns)+1))
+	for i, cells := range args.Cells {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(row)
+		params = append(params, args.ClientID)
+		for _, c := range cells {
+			params = append(params, cellParam(c))
+		}
+	}
+	sb.WriteString(" ON DUPLICATE KEY UPDATE ")
+	for i, c := range args.Columns {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString("`" + c + "`=VALUES(`" + c + "`)")
+	}
+	return sb.String(), params
+}
+
+// cellParam passes a cell in its text form and lets MySQL convert it, so
+// times are not shifted by the location of the driver.
+func cellParam(c util.Cell) interface{} {
+	switch {
+	case c.Null:
+		return nil
+	case c.Kind == util.KindBytes:
+		return c.Bytes
+	}
+	return string(c.Bytes)
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"util"
+)
+
+// DBRule authorizes SQL a client runs on the server database through the
+// "db" RPC service.
+type DBRule struct {
+	// ReadOnly allows only SELECT, SHOW, DESC, DESCRIBE and EXPLAIN.
+	ReadOnly bool
+	// Tables lists allowed tables as "table", "schema.table" or a pattern
+	// like "schema.*". Tables without schema refer to the server database.
+	// Statements on other tables are rejected, an empty list allows only
+	// SELECT without tables.
+	Tables []string
+}
+
+var dbReadOnlyStatements = []string{"SELECT", "SHOW", "DESC", "DESCRIBE", "EXPLAIN"}
+var dbWriteStatements = []string{"INSERT", "REPLACE", "UPDATE", "DELETE"}
+
+type RuleError struct {
+	Client string
+	SQL    string
+	Reason string
+}
+
+func (e *RuleError) Error() string {
+	return "rule: " + e.Reason
+}
+
+// dbRule returns the rule of the client with certificate common name cn,
+// nil if it may not use the "db" service.
+func dbRule(cn string) *DBRule {
+	rules := currentConfig().DBRules
+	if r, ok := rules[cn]; ok {
+		return r
+	}
+	return rules["*"]
+}
+
+// checkDBRule returns a *RuleError if the client with certificate common
+// name cn may not run query.
+func checkDBRule(cn string, query string) error {
+	err := checkRule(cn, dbRule(cn), query)
+	if err != nil {
+		log.Printf("ERROR rule rejected [%s] %q: %v", cn, query, err)
+	}
+	return err
+}
+
+func checkRule(cn string, r *DBRule, query string) error {
+	if r == nil {
+		return &RuleError{cn, query, "no rule for client"}
+	}
+	st, err := util.ScanSQL(query)
+	if err != nil {
+		return &RuleError{cn, query, err.Error()}
+	}
+	if st.Multi {
+		return &RuleError{cn, query, "multiple statements not allowed"}
+	}
+	if st.File {
+		return &RuleError{cn, query, "file access not allowed"}
+	}
+	if !util.ContainsFold(dbReadOnlyStatements, st.Type) && (r.ReadOnly || !util.ContainsFold(dbWriteStatements, st.Type)) {
+		return &RuleError{cn, query, fmt.Sprintf("statement %s not allowed", st.Type)}
+	}
+	if st.Incomplete {
+		return &RuleError{cn, query, "table references not understood"}
+	}
+	if len(st.Tables) == 0 {
+		// e.g. SELECT NOW(), other statements without tables are refused
+		if st.Type == "SELECT" {
+			return nil
+		}
+		return &RuleError{cn, query, fmt.Sprintf("statement %s without tables not allowed", st.Type)}
+	}
+
+	database, err := DB.Database()
+	if err != nil {
+		return err
+	}
+	for _, table := range st.Tables {
+		table = util.QualifyTable(database, table)
+		if !util.MatchTable(database, r.Tables, table) {
+			return &RuleError{cn, query, fmt.Sprintf("table %s not allowed", table)}
+		}
+	}
+	return nil
+}
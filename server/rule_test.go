@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestCheckRule(t *testing.T) {
+	DB.database = "central"
+	defer func() { DB.database = "" }()
+
+	read := &DBRule{ReadOnly: true, Tables: []string{"bus_*", "other.t"}}
+	none := &DBRule{}
+	tests := []struct {
+		rule  *DBRule
+		query string
+		ok    bool
+	}{
+		{read, "SELECT * FROM bus_authorized WHERE id=1", true},
+		{read, "SELECT * FROM other.t JOIN central.bus_plate USING (id)", true},
+		{read, "SELECT * FROM sync_vars", false},
+		{read, "SELECT * FROM (sync_vars)", false},
+		{read, "SELECT * FROM bus_a STRAIGHT_JOIN sync_vars", false},
+		{read, "SELECT * FROM bus_a, (SELECT * FROM sync_vars) x", false},
+		{read, "SELECT * FROM @x", false},
+		{read, "DELETE FROM bus_authorized", false},
+		{read, "SHOW VARIABLES", false},
+		{read, "SELECT NOW()", true},
+		{none, "SELECT 1", true},
+		{none, "SELECT * FROM (bus_authorized)", false},
+		{none, "DESC bus_authorized", false},
+		{&DBRule{Tables: []string{"bus_*"}}, "DELETE FROM bus_a USING bus_a, sync_vars", false},
+		{&DBRule{Tables: []string{"bus_*"}}, "UPDATE bus_a SET x=1", true},
+		{&DBRule{Tables: []string{"bus_*"}}, "DROP TABLE bus_a", false},
+		{nil, "SELECT 1", false},
+	}
+	for _, test := range tests {
+		err := checkRule("c1", test.rule, test.query)
+		if (err == nil) != test.ok {
+			t.Errorf("checkRule(%q) = %v", test.query, err)
+		}
+	}
+}
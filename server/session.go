@@ -0,0 +1,19 @@
+package main
+
+import (
+	"time"
+	"util"
+)
+
+const DefaultCursorTTL = 5 * time.Minute
+
+var MaxOpenfileCount = 32
+
+// newSession returns the session of a client RPC connection, its log lines
+// are prefixed with the client.
+func newSession(client string, cursorTTL time.Duration) *util.Session {
+	if cursorTTL <= 0 {
+		cursorTTL = DefaultCursorTTL
+	}
+	return util.NewSession(client, cursorTTL, MaxOpenfileCount, nil)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultShutdownTimeout = 30 * time.Second
+
+// shutdownAbortWait is how long notify connections get to return once a
+// shutdown is aborted, and again once their connections are closed.
+const shutdownAbortWait = 5 * time.Second
+
+const shutdownMessage = "server is shutting down"
+
+// shutdown coordinates a graceful stop. Once closing is closed notify
+// connections finish the batch in progress and return, once abort is
+// closed a running full sync stops between two chunks.
+type shutdown struct {
+	closing chan struct{}
+	abort   chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+}
+
+var Shutdown = &shutdown{
+	closing: make(chan struct{}),
+	abort:   make(chan struct{}),
+}
+
+func (s *shutdown) Closing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+func (s *shutdown) Aborted() bool {
+	select {
+	case <-s.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// Enter registers a notify connection, it returns false if the server is
+// shutting down and the connection should be dropped.
+func (s *shutdown) Enter() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Closing() {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+func (s *shutdown) Leave() {
+	s.wg.Done()
+}
+
+func (s *shutdown) wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *shutdown) waitFor(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.wait(ctx)
+}
+
+// queuePosition returns the row of QueueCheckpoint, columns separated by
+// ",". It is empty if QueueCheckpoint is not configured.
+func queuePosition(st *SQLTemplet) (string, error) {
+	if st.QueueCheckpoint == "" {
+		return "", nil
+	}
+	qs := DB.BeforeQuery(st.QueueCheckpoint)
+	rows, err := DB.Conn().Query(qs.SQL)
+	qs.EndQuery(err)
+	if err != nil {
+		return "", fmt.Errorf("query queue checkpoint: %v", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	if !rows.Next() {
+		if err = rows.Err(); err == nil {
+			err = errors.New("no rows")
+		}
+		return "", fmt.Errorf("query queue checkpoint: %v", err)
+	}
+	res := make([]sql.NullString, len(columns))
+	scan := make([]interface{}, len(columns))
+	for i := range res {
+		scan[i] = &res[i]
+	}
+	if err := rows.Scan(scan...); err != nil {
+		return "", fmt.Errorf("query queue checkpoint: %v", err)
+	}
+	position := make([]string, len(res))
+	for i, v := range res {
+		// CHECKSUM TABLE is NULL if the table does not exist
+		if !v.Valid {
+			return "", fmt.Errorf("queue checkpoint column %s is NULL", columns[i])
+		}
+		position[i] = v.String
+	}
+	return strings.Join(position, ","), nil
+}
+
+// flushQueues writes DefaultQM to dir at the position of the table.
+// Without QueueCheckpoint changes made while the server is down can not
+// be detected, nothing is flushed and clients do a full sync.
+func flushQueues(dir string) error {
+	position, err := queuePosition(currentSQL())
+	if err != nil {
+		return err
+	}
+	if position == "" {
+		log.Printf("info: queues not flushed, QueueCheckpoint not configured")
+		return nil
+	}
+	return DefaultQM.Flush(dir, position)
+}
+
+// restoreQueues loads the queues flushed to dir if the table did not
+// change since, otherwise their clients do a full sync.
+func restoreQueues(dir string) error {
+	position, err := queuePosition(currentSQL())
+	if err != nil {
+		return err
+	}
+	return DefaultQM.Restore(dir, position)
+}
+
+func shutdownServer(srv *http.Server, listeners ...net.Listener) {
+	cfg := currentConfig()
+	timeout := DefaultShutdownTimeout
+	if cfg.ShutdownTimeout != "" {
+		d, err := time.ParseDuration(cfg.ShutdownTimeout)
+		if err != nil {
+			log.Printf("ERROR parse config ShutdownTimeout: %v", err)
+		} else {
+			timeout = d
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Step 1. Stop accepting connections
+	Shutdown.mu.Lock()
+	close(Shutdown.closing)
+	Shutdown.mu.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("ERROR shutdown http server: %v", err)
+	}
+
+	// Step 2. Wait for batches in progress, notify connections tell their
+	// client about the shutdown when they return
+	flush := true
+	if !Shutdown.wait(ctx) {
+		close(Shutdown.abort)
+		clients := NotifyClients.All()
+		log.Printf("info: shutdown timeout, %d notify connections left", len(clients))
+
+		// Step 3. Tell clients still busy, their connections put back the
+		// rows not sent and return before the next chunk. Calls still in
+		// progress fail once the connection is closed.
+		for _, c := range clients {
+			var reply int32
+			c.Go("client.Message", &ClientMessageArgs{Message: shutdownMessage}, &reply, nil)
+		}
+		if !Shutdown.waitFor(shutdownAbortWait) {
+			for _, c := range clients {
+				c.Close()
+			}
+			if !Shutdown.waitFor(shutdownAbortWait) {
+				log.Printf("ERROR notify connections did not return, queues not flushed")
+				flush = false
+			}
+		}
+	}
+
+	// Step 4. Keep queued rows for the next start, no connection uses them
+	// any more
+	if flush {
+		if err := flushQueues(cfg.QueueDir); err != nil {
+			log.Printf("ERROR flush queues: %v", err)
+		}
+	}
+
+	// Step 5. Remove dump files of unfinished full syncs
+	CloseDbDumps()
+}
+
+// notifyRegistry tracks live notify connections by client UUID and the
+// common name of their certificate.
+type notifyRegistry struct {
+	mu sync.RWMutex
+	m  map[*rpc.Client]notifyPeer
+}
+
+type notifyPeer struct {
+	clientUUID string
+	cn         string
+}
+
+var NotifyClients = &notifyRegistry{
+	m: make(map[*rpc.Client]notifyPeer),
+}
+
+func (r *notifyRegistry) Add(clientUUID, cn string, c *rpc.Client) {
+	r.mu.Lock()
+	r.m[c] = notifyPeer{clientUUID, cn}
+	r.mu.Unlock()
+}
+func (r *notifyRegistry) Del(c *rpc.Client) {
+	r.mu.Lock()
+	delete(r.m, c)
+	r.mu.Unlock()
+}
+func (r *notifyRegistry) Get(clientUUID string) *rpc.Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for c, p := range r.m {
+		if p.clientUUID == clientUUID {
+			return c
+		}
+	}
+	return nil
+}
+
+// Identifies reports whether a notify connection with a certificate of
+// common name cn identified itself as clientUUID.
+func (r *notifyRegistry) Identifies(cn, clientUUID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, p := range r.m {
+		if p.cn == cn && p.clientUUID == clientUUID {
+			return true
+		}
+	}
+	return false
+}
+func (r *notifyRegistry) All() []*rpc.Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]*rpc.Client, 0, len(r.m))
+	for c := range r.m {
+		res = append(res, c)
+	}
+	return res
+}
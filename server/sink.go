@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/rpc"
+	"util"
+)
+
+type SinkApplyArgs struct {
+	Table   string
+	Columns []string
+	// Keys are the positions of the key columns in Columns, rows are keyed
+	// by all columns if it is empty.
+	Keys []int
+	// Begin starts a full sync, the rows applied until End replace the
+	// snapshot.
+	Begin, End bool
+	Ops        []SinkOp
+}
+type SinkOp struct {
+	Delete bool
+	Row    []util.Cell
+}
+type SinkApplyReply struct {
+	// Rows is the count of rows in the snapshot.
+	Rows int
+}
+
+// clientSink reports if the client applies rows to a file sink through
+// the "sink" service instead of SQL, older clients do not know the key.
+func clientSink(rpcClient *rpc.Client) string {
+	var sink string
+	if err := rpcClient.Call("client.GetValue", "sink", &sink); err != nil {
+		return ""
+	}
+	return sink
+}
+
+func (st *SQLTemplet) sinkArgs() *SinkApplyArgs {
+	args := &SinkApplyArgs{Table: st.clientTableName}
+	args.Columns, args.Keys = st.SinkColumns()
+	return args
+}
+
+// sinkFullSync sends the rows of d to the file sink of a client, they
+// replace its snapshot once all are sent.
+func sinkFullSync(rpcClient *rpc.Client, tpl *SQLTemplet, clientUUID string, d *DbDump) error {
+	begin := true
+	for {
+		if Shutdown.Aborted() {
+			return errors.New(shutdownMessage)
+		}
+		res, err := d.ReadRows(fullSyncBatchRows)
+		if err != nil {
+			return fmt.Errorf("read dump, %v", err)
+		}
+		args := tpl.sinkArgs()
+		args.Begin, args.End = begin, len(res) < fullSyncBatchRows
+		for _, row := range res {
+			args.Ops = append(args.Ops, SinkOp{Row: tpl.SinkRow(row)})
+		}
+		if err := callSink(rpcClient, clientUUID, args); err != nil {
+			return err
+		}
+		if args.End {
+			return nil
+		}
+		begin = false
+	}
+}
+
+// sinkApply sends the first fullSyncBatchRows items to the file sink of a
+// client and returns the items not sent.
+func sinkApply(rpcClient *rpc.Client, tpl *SQLTemplet, clientUUID string, items []QueueItem) ([]QueueItem, error) {
+	n := len(items)
+	if n > fullSyncBatchRows {
+		n = fullSyncBatchRows
+	}
+	args := tpl.sinkArgs()
+	for _, item := range items[:n] {
+		args.Ops = append(args.Ops, SinkOp{Delete: item.Delete, Row: tpl.SinkRow(item.Row)})
+	}
+	if err := callSink(rpcClient, clientUUID, args); err != nil {
+		return items, err
+	}
+	return items[n:], nil
+}
+
+func callSink(rpcClient *rpc.Client, clientUUID string, args *SinkApplyArgs) error {
+	var reply SinkApplyReply
+	if err := rpcClient.Call("sink.Apply", args, &reply); err != nil {
+		return fmt.Errorf("rpc sink.Apply[%s] '%s': %v", clientUUID, args.Table, err)
+	}
+	log.Printf("client sink.Apply[%s] '%s', %d ops, %d rows", clientUUID, args.Table, len(args.Ops), reply.Rows)
+	return nil
+}
@@ -1,21 +1,80 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
-	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
-	"os"
+	"strconv"
 	"strings"
+	"util"
+)
+
+// Owners of a synced column, they decide how an existing client row is
+// updated.
+const (
+	// OwnerServer columns always take the server value.
+	OwnerServer = "server"
+	// OwnerClient columns are only set when the row is inserted.
+	OwnerClient = "client"
+	// OwnerLWW columns take the server value unless the client row has a
+	// newer version in the Version column.
+	OwnerLWW = "lww"
+)
 
-	uuid "github.com/satori/go.uuid"
+// Masks of a column in a ColumnProfile.
+const (
+	MaskDrop = "drop"
+	MaskNull = "null"
+	// MaskHash sends the hex SHA-256 of the value as a string.
+	MaskHash = "hash"
 )
 
+// SyncColumn is one column of SyncColumns, written as
+// "[$]name[:client_name][@key|@server|@client|@lww(version)]" or, for a
+// column derived on the client, "client_name[@owner]=expr". "$" marks a
+// string column, "@key" a server owned column of the unique key. Columns
+// are referred to by name, the server name of synced columns.
 type SyncColumn struct {
 	Name     string
 	SQLName  string
 	IsString bool
+	Key      bool
+	Owner    string
+	Version  string
+
+	ClientName    string
+	ClientSQLName string
+	// Expr is the SQL expression of a derived column, it has no server
+	// value.
+	Expr string
+
+	// Index is the position of the value in a row of the server, -1 for
+	// derived columns.
+	Index int
+	Mask  string
+}
+
+// ColumnProfile lists columns which are dropped, set to NULL or hashed for
+// some clients. Key, lww and version columns can not be masked, lww
+// columns can be dropped.
+type ColumnProfile struct {
+	Drop []string
+	Null []string
+	Hash []string
+}
+
+func (p *ColumnProfile) mask(name string) string {
+	switch {
+	case util.ContainsFold(p.Drop, name):
+		return MaskDrop
+	case util.ContainsFold(p.Null, name):
+		return MaskNull
+	case util.ContainsFold(p.Hash, name):
+		return MaskHash
+	}
+	return ""
 }
 
 type SyncColumns []*SyncColumn
@@ -25,27 +84,170 @@ func ParseSyncColumn(s string) (*SyncColumn, error) {
 		return nil, errors.New("empty column name")
 	}
 	sc := new(SyncColumn)
+	sc.Owner = OwnerServer
+	if pos := strings.IndexByte(s, '='); pos != -1 {
+		sc.Expr = strings.TrimSpace(s[pos+1:])
+		s = strings.TrimSpace(s[:pos])
+		if sc.Expr == "" {
+			return nil, errors.New("empty expression")
+		}
+	}
 	sc.Name = s
-	if strings.HasPrefix(s, "$") {
-		sc.Name = strings.TrimPrefix(s, "$")
+	if pos := strings.IndexByte(s, '@'); pos != -1 {
+		sc.Name = s[:pos]
+		owner := s[pos+1:]
+		switch {
+		case owner == "key":
+			sc.Key = true
+		case owner == OwnerServer, owner == OwnerClient:
+			sc.Owner = owner
+		case strings.HasPrefix(owner, OwnerLWW+"(") && strings.HasSuffix(owner, ")"):
+			sc.Owner = OwnerLWW
+			sc.Version = strings.TrimSpace(owner[len(OwnerLWW)+1 : len(owner)-1])
+			if sc.Version == "" {
+				return nil, errors.New("empty version column")
+			}
+		default:
+			return nil, fmt.Errorf("unknown owner '%s'", owner)
+		}
+	}
+	if strings.HasPrefix(sc.Name, "$") {
+		sc.Name = strings.TrimPrefix(sc.Name, "$")
 		sc.IsString = true
 	}
-	sc.SQLName = "`" + sc.Name + "`"
+	sc.ClientName = sc.Name
+	if pos := strings.IndexByte(sc.Name, ':'); pos != -1 {
+		sc.Name, sc.ClientName = sc.Name[:pos], sc.Name[pos+1:]
+		if sc.Expr != "" {
+			return nil, errors.New("derived column can not be mapped")
+		}
+	}
+	if sc.Name == "" || sc.ClientName == "" {
+		return nil, errors.New("empty column name")
+	}
+	if sc.Expr != "" && (sc.Key || sc.Owner == OwnerLWW) {
+		return nil, errors.New("derived column can not be a key or lww column")
+	}
+	sc.SQLName = util.MySQL.QuoteIdent(sc.Name)
+	sc.ClientSQLName = util.MySQL.QuoteIdent(sc.ClientName)
 	return sc, nil
 }
 
 func ParseSyncColumns(s string) (SyncColumns, error) {
-	p := strings.Split(s, ",")
-	scs := make([]*SyncColumn, len(p))
+	p := splitColumns(s)
+	scs := make(SyncColumns, len(p))
 	var err error
+	index := 0
 	for i, v := range p {
 		v = strings.TrimSpace(v)
 		scs[i], err = ParseSyncColumn(v)
 		if err != nil {
 			return scs, fmt.Errorf("parse '%s': %v", v, err)
 		}
+		scs[i].Index = -1
+		if scs[i].Expr == "" {
+			scs[i].Index = index
+			index++
+		}
+	}
+	return scs, scs.check()
+}
+
+// splitColumns splits s by commas outside of parentheses and quotes, so
+// expressions of derived columns can hold function calls.
+func splitColumns(s string) []string {
+	var p []string
+	depth := 0
+	var quote byte
+	last := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			p = append(p, s[last:i])
+			last = i + 1
+		}
+	}
+	return append(p, s[last:])
+}
+
+func (scs SyncColumns) check() error {
+	hasKey := false
+	for _, sc := range scs {
+		hasKey = hasKey || sc.Key
+	}
+	for _, sc := range scs {
+		if sc.Owner != OwnerLWW {
+			continue
+		}
+		if !hasKey {
+			return errors.New("lww columns need a @key column")
+		}
+		ver := scs.Get(sc.Version)
+		if ver == nil {
+			return fmt.Errorf("version column '%s' of '%s' not synced", sc.Version, sc.Name)
+		}
+		if ver.Owner != OwnerServer || ver.Key || ver.Expr != "" {
+			return fmt.Errorf("version column '%s' of '%s' must be server owned", sc.Version, sc.Name)
+		}
+	}
+	return nil
+}
+
+func (scs SyncColumns) Get(name string) *SyncColumn {
+	for _, sc := range scs {
+		if sc.Name == name {
+			return sc
+		}
+	}
+	return nil
+}
+
+// versions returns the version columns of lww columns in order of first
+// use.
+func (scs SyncColumns) versions() []*SyncColumn {
+	var vers []*SyncColumn
+	for _, sc := range scs {
+		if sc.Owner != OwnerLWW {
+			continue
+		}
+		ver := scs.Get(sc.Version)
+		if !ver.in(vers) {
+			vers = append(vers, ver)
+		}
+	}
+	return vers
+}
+
+func (sc *SyncColumn) in(scs []*SyncColumn) bool {
+	for _, v := range scs {
+		if v == sc {
+			return true
+		}
+	}
+	return false
+}
+
+// Server returns the columns read from the server, without derived
+// columns.
+func (scs SyncColumns) Server() SyncColumns {
+	var server SyncColumns
+	for _, sc := range scs {
+		if sc.Expr == "" {
+			server = append(server, sc)
+		}
 	}
-	return scs, nil
+	return server
 }
 
 func (scs SyncColumns) String() string {
@@ -56,6 +258,15 @@ func (scs SyncColumns) String() string {
 	return strings.Join(s, ",")
 }
 
+// ClientString is String with the client names.
+func (scs SyncColumns) ClientString() string {
+	s := make([]string, len(scs))
+	for i := range scs {
+		s[i] = scs[i].ClientSQLName
+	}
+	return strings.Join(s, ",")
+}
+
 func (scs SyncColumns) ScanRow(row *sql.Row) ([]string, error) {
 	res := make([]string, len(scs))
 	dest := make([]interface{}, len(scs))
@@ -81,130 +292,491 @@ func (scs SyncColumns) Scan(res []string, rows *sql.Rows, dest []interface{}) er
 	return rows.Scan(dest...)
 }
 
-func (scs SyncColumns) AppendValues(sb *strings.Builder, v []string) error {
-	if len(scs) != len(v) {
-		return errors.New("SyncColumns.AppendValues: len(values) not match columns")
+func (scs SyncColumns) AppendValues(sb *strings.Builder, d util.Dialect, v []string) error {
+	for _, sc := range scs {
+		if sc.Index >= len(v) {
+			return errors.New("SyncColumns.AppendValues: len(values) not match columns")
+		}
 	}
 	sb.WriteByte('(')
-	for i, s := range v {
+	for i, sc := range scs {
 		if i > 0 {
 			sb.WriteByte(',')
 		}
-		if scs[i].IsString {
-			sb.Grow(len(s) * 2)
-			sb.WriteByte('\'')
-			last := 0
-			for j, r := range s {
-				if r == '\'' {
-					sb.WriteString(s[last:j])
-					sb.WriteByte('\'')
-					sb.WriteByte('\'')
-					last = j + 1
-				}
-			}
-			sb.WriteString(s[last:])
-			sb.WriteByte('\'')
-		} else {
-			sb.WriteString(s)
-		}
+		sc.appendRowValue(sb, d, v)
 	}
 	sb.WriteByte(')')
 	return nil
 }
 
-func (scs SyncColumns) AppendSetAllValues(sb *strings.Builder) {
-	for i, sc := range scs {
-		if i > 0 {
-			sb.WriteByte(',')
+// appendRowValue writes the value of sc in a server row with its mask.
+func (sc *SyncColumn) appendRowValue(sb *strings.Builder, d util.Dialect, row []string) {
+	switch {
+	case sc.Expr != "":
+		sb.WriteString(sc.Expr)
+	case sc.Mask == MaskNull:
+		sb.WriteString("NULL")
+	case sc.Mask == MaskHash:
+		h := sha256.Sum256([]byte(row[sc.Index]))
+		d.AppendString(sb, hex.EncodeToString(h[:]))
+	default:
+		sc.appendValue(sb, d, row[sc.Index])
+	}
+}
+
+func (sc *SyncColumn) appendValue(sb *strings.Builder, d util.Dialect, s string) {
+	if !sc.IsString {
+		sb.WriteString(s)
+		return
+	}
+	d.AppendString(sb, s)
+}
+
+// AppendSetAllValues writes the assignments of an upsert into table. MySQL
+// assigns from left to right, so lww columns come before their version
+// column while it still holds the client version.
+func (scs SyncColumns) AppendSetAllValues(sb *strings.Builder, d util.Dialect, table string) {
+	sb.WriteString(strings.Join(scs.setAllValues(d, table), ","))
+}
+
+func (scs SyncColumns) setAllValues(d util.Dialect, table string) []string {
+	lww := func(name, ver string) string {
+		old := d.Existing(table, ver)
+		return name + "=" + d.If(old+" IS NULL OR "+d.Inserted(ver)+">="+old, d.Inserted(name), d.Existing(table, name))
+	}
+	versions := scs.versions()
+	var set []string
+	for _, sc := range scs {
+		name := sc.ClientSQLName
+		switch {
+		case sc.Owner == OwnerClient:
+		case sc.Owner == OwnerLWW:
+			set = append(set, lww(name, scs.Get(sc.Version).ClientSQLName))
+		case sc.in(versions):
+		case sc.Expr != "":
+			set = append(set, name+"="+sc.Expr)
+		default:
+			set = append(set, name+"="+d.Inserted(name))
 		}
-		sb.WriteString(sc.SQLName)
-		sb.WriteString("=VALUES(")
-		sb.WriteString(sc.Name)
-		sb.WriteByte(')')
 	}
+	for _, v := range versions {
+		set = append(set, lww(v.ClientSQLName, v.ClientSQLName))
+	}
+	if len(set) == 0 {
+		// every column is client owned
+		set = append(set, scs[0].ClientSQLName+"="+d.Existing(table, scs[0].ClientSQLName))
+	}
+	return set
 }
 
 type SQLTemplet struct {
-	table     string
+	table           string
+	clientTable     string
+	clientTableName string
+	// dialect generates the statements run on clients, statements run on
+	// the server database are MySQL.
+	dialect   util.Dialect
 	Columns   SyncColumns
 	columnStr string
+	// ServerColumns are Columns without derived columns, in the order of
+	// the rows read from the server.
+	ServerColumns SyncColumns
 
 	SyncClientBeforeFullUpdate string
 	syncClientInsert           string
 	SyncFullUpdate             string
 	SyncSingleUpdate           string
+	BundleCheckpoint           string
+	BundleChanges              string
+	QueueCheckpoint            string
 
 	LockTable   string
 	UnlockTable string
 
 	insertHead string
 	insertFoot string
+	deleteHead string
+	keys       []int
+
+	conflicts []conflictTemplet
+
+	// Signature identifies the columns and masks of a column profile, it
+	// is empty for the columns of SyncColumns.
+	Signature      string
+	profiles       map[string]*SQLTemplet
+	clientProfiles map[string]string
 }
 
-var SQL = new(SQLTemplet)
+// ConflictTable is created by the client, it records rows where a newer
+// client version kept lww columns from being updated.
+const ConflictTable = "sync_conflicts"
+
+type conflictTemplet struct {
+	columns []int
+	head    string
+	foot    string
+}
 
 func (st *SQLTemplet) Init(config *config) error {
-	var err error
-	st.Columns, err = ParseSyncColumns(config.SyncColumns)
+	columns, err := ParseSyncColumns(config.SyncColumns)
 	if err != nil {
 		return err
 	}
 
+	st.dialect, err = util.GetDialect(config.SyncClientDialect)
+	if err != nil {
+		return err
+	}
+	for _, sc := range columns {
+		sc.ClientSQLName = st.dialect.QuoteIdent(sc.ClientName)
+	}
+
 	st.table = "`" + config.SyncTableName + "`"
-	st.columnStr = st.Columns.String()
+	st.clientTableName = config.clientTableName()
+	st.clientTable = st.dialect.QuoteIdent(st.clientTableName)
+	st.ServerColumns = columns.Server()
+	st.columnStr = st.ServerColumns.String()
 
-	st.SyncClientBeforeFullUpdate = st.templet(config.SyncClientBeforeFullUpdate)
+	st.SyncClientBeforeFullUpdate = strings.Replace(config.SyncClientBeforeFullUpdate, "$_TABLE", st.clientTable, -1)
+	st.SyncClientBeforeFullUpdate = strings.Replace(st.SyncClientBeforeFullUpdate, "$_COLUMNS", columns.ClientString(), -1)
 	st.syncClientInsert = st.templet(config.SyncClientInsert)
 	st.SyncFullUpdate = st.templet(config.SyncFullUpdate)
 	st.SyncSingleUpdate = st.templet(config.SyncSingleUpdate)
+	st.BundleCheckpoint = st.templet(config.BundleCheckpoint)
+	st.BundleChanges = st.templet(config.BundleChanges)
+	st.QueueCheckpoint = st.templet(config.QueueCheckpoint)
 
 	st.LockTable = st.templet("LOCK TABLES $_TABLE READ")
 	st.UnlockTable = st.templet("UNLOCK TABLES")
 
-	st.insertHead = st.templet("INSERT INTO $_TABLE($_COLUMNS) VALUES ")
-	var sb strings.Builder
-	st.Columns.AppendSetAllValues(&sb)
-	st.insertFoot = "ON DUPLICATE KEY UPDATE " + sb.String()
+	if err := st.setColumns(columns, config); err != nil {
+		return err
+	}
+	if config.StagedFullSync {
+		for _, sc := range columns {
+			if sc.Owner != OwnerServer {
+				return fmt.Errorf("StagedFullSync needs server owned columns, '%s' is %s owned", sc.Name, sc.Owner)
+			}
+		}
+	}
+
+	st.profiles = make(map[string]*SQLTemplet)
+	for name, p := range config.ColumnProfiles {
+		pt, err := st.profile(p, config)
+		if err != nil {
+			return fmt.Errorf("column profile '%s': %v", name, err)
+		}
+		st.profiles[name] = pt
+	}
+	for client, name := range config.ClientProfiles {
+		if st.profiles[name] == nil {
+			return fmt.Errorf("column profile '%s' of client '%s' not found", name, client)
+		}
+	}
+	st.clientProfiles = config.ClientProfiles
 	return nil
 }
 
-func (st *SQLTemplet) templet(s string) string {
-	s = strings.Replace(s, "$_TABLE", st.table, -1)
-	s = strings.Replace(s, "$_COLUMNS", st.columnStr, -1)
-	return s
+// setColumns renders the statements sent to clients for columns.
+func (st *SQLTemplet) setColumns(columns SyncColumns, config *config) error {
+	st.Columns = columns
+	st.insertHead = "INSERT INTO " + st.clientTable + "(" + columns.ClientString() + ") VALUES "
+	st.keys = nil
+	var keys []string
+	for i, sc := range columns {
+		if sc.Key {
+			st.keys = append(st.keys, i)
+			keys = append(keys, sc.ClientSQLName)
+		}
+	}
+	if len(config.ClientFilters) > 0 && len(st.keys) == 0 {
+		return errors.New("client filters need a @key column")
+	}
+	var err error
+	st.insertFoot, err = st.dialect.Upsert(keys, columns.setAllValues(st.dialect, st.clientTable))
+	if err != nil {
+		return fmt.Errorf("%s: %v", st.dialect.Name(), err)
+	}
+	st.deleteHead = st.dialect.DeleteHead(st.clientTable, keys)
+
+	st.conflicts = nil
+	for _, v := range columns.versions() {
+		st.conflicts = append(st.conflicts, st.conflictTemplet(config.clientTableName(), v))
+	}
+	return nil
+}
+
+// profile derives the templet of clients with column profile p.
+func (st *SQLTemplet) profile(p *ColumnProfile, config *config) (*SQLTemplet, error) {
+	for _, names := range [][]string{p.Drop, p.Null, p.Hash} {
+		for _, name := range names {
+			if st.Columns.Get(name) == nil {
+				return nil, fmt.Errorf("column '%s' not synced", name)
+			}
+		}
+	}
+
+	versions := st.Columns.versions()
+	var columns SyncColumns
+	var sig []string
+	for _, sc := range st.Columns {
+		mask := p.mask(sc.Name)
+		if mask == "" {
+			columns = append(columns, sc)
+			sig = append(sig, sc.ClientSQLName)
+			continue
+		}
+		if sc.Key || sc.in(versions) || ((sc.Owner == OwnerLWW || sc.Expr != "") && mask != MaskDrop) {
+			return nil, fmt.Errorf("column '%s' can not be masked", sc.Name)
+		}
+		if mask == MaskDrop {
+			continue
+		}
+		c := *sc
+		c.Mask = mask
+		columns = append(columns, &c)
+		sig = append(sig, sc.ClientSQLName+":"+mask)
+	}
+	if len(columns) == 0 {
+		return nil, errors.New("every column dropped")
+	}
+	if err := columns.check(); err != nil {
+		return nil, err
+	}
+
+	pt := *st
+	pt.profiles, pt.clientProfiles = nil, nil
+	pt.Signature = strings.Join(sig, ",")
+	return &pt, pt.setColumns(columns, config)
+}
+
+// Shadow returns the templet which loads table, the shadow of the client
+// table in a staged full sync.
+func (st *SQLTemplet) Shadow(table string) *SQLTemplet {
+	t := *st
+	t.clientTableName = table
+	t.clientTable = st.dialect.QuoteIdent(table)
+	t.insertHead = "INSERT INTO " + t.clientTable + "(" + st.Columns.ClientString() + ") VALUES "
+	keys := make([]string, len(st.keys))
+	for i, k := range st.keys {
+		keys[i] = st.Columns[k].ClientSQLName
+	}
+	t.deleteHead = st.dialect.DeleteHead(t.clientTable, keys)
+	// the upsert refers to rows of the shadow, keys were accepted by Init
+	t.insertFoot, _ = st.dialect.Upsert(keys, st.Columns.setAllValues(st.dialect, t.clientTable))
+	// the shadow has no client rows to conflict with
+	t.conflicts = nil
+	return &t
+}
+
+// Client returns the templet of a client by UUID or certificate common
+// name cn, st itself if the client has no column profile.
+func (st *SQLTemplet) Client(clientUUID, cn string) *SQLTemplet {
+	name, ok := st.clientProfiles[clientUUID]
+	if !ok {
+		name, ok = st.clientProfiles[cn]
+	}
+	if !ok {
+		name, ok = st.clientProfiles["*"]
+	}
+	if pt := st.profiles[name]; ok && pt != nil {
+		return pt
+	}
+	return st
+}
+
+// conflictTemplet selects rows with a newer client version ver and lww
+// columns which differ from the server, the server rows are a derived
+// table "s" of constant SELECTs joined on the key columns.
+func (st *SQLTemplet) conflictTemplet(table string, ver *SyncColumn) conflictTemplet {
+	d := st.dialect
+	var ct conflictTemplet
+	var keys, on, diff, same []string
+	for i, sc := range st.Columns {
+		name := sc.ClientSQLName
+		switch {
+		case sc.Key:
+			keys = append(keys, "s."+name)
+			on = append(on, d.NullSafeEqual("c."+name, "s."+name))
+		case sc.Owner == OwnerLWW && sc.Version == ver.Name:
+			diff = append(diff, d.If(d.NullSafeEqual("c."+name, "s."+name), "NULL", sqlString(d, sc.ClientName)))
+			same = append(same, d.NullSafeEqual("c."+name, "s."+name))
+		case sc != ver:
+			continue
+		}
+		ct.columns = append(ct.columns, i)
+	}
+	v := ver.ClientSQLName
+	ct.head = "INSERT INTO " + d.QuoteIdent(ConflictTable) + " " +
+		"(table_name,row_key,column_names,server_version,client_version,resolution,detected_at) " +
+		"SELECT " + sqlString(d, table) + ",CONCAT_WS(','," + strings.Join(keys, ",") + ")," +
+		"CONCAT_WS(','," + strings.Join(diff, ",") + "),s." + v + ",c." + v + ",'client',NOW() FROM ("
+	ct.foot = ") AS s JOIN " + st.clientTable + " AS c ON " + strings.Join(on, " AND ") +
+		" WHERE c." + v + ">s." + v + " AND NOT (" + strings.Join(same, " AND ") + ")"
+	return ct
 }
 
-func (st *SQLTemplet) ClientInsertDump(res *DbDump, maxPacketSize int) (string, bool) {
+func sqlString(d util.Dialect, s string) string {
 	var sb strings.Builder
-	var end bool
+	d.AppendString(&sb, s)
+	return sb.String()
+}
 
-	comma := false
-	for {
-		if !res.Next() {
-			end = true
-			break
+// ClientConflicts returns the statements which record conflicts of res
+// in ConflictTable, they must run before the upsert of res.
+func (st *SQLTemplet) ClientConflicts(res [][]string, maxPacketSize int) []string {
+	var stmts []string
+	for _, ct := range st.conflicts {
+		rest := res
+		for len(rest) > 0 {
+			var sb strings.Builder
+			sb.WriteString(ct.head)
+			n := 0
+			for ; n < len(rest); n++ {
+				size := sb.Len()
+				if n == 0 {
+					sb.WriteString("SELECT ")
+				} else {
+					sb.WriteString(" UNION ALL SELECT ")
+				}
+				for j, i := range ct.columns {
+					if j > 0 {
+						sb.WriteByte(',')
+					}
+					st.Columns[i].appendRowValue(&sb, st.dialect, rest[n])
+					if n == 0 {
+						sb.WriteString(" AS " + st.Columns[i].ClientSQLName)
+					}
+				}
+				if n > 0 && sb.Len()+len(ct.foot) > maxPacketSize {
+					s := sb.String()[:size]
+					sb.Reset()
+					sb.WriteString(s)
+					break
+				}
+			}
+			sb.WriteString(ct.foot)
+			stmts = append(stmts, sb.String())
+			rest = rest[n:]
 		}
-		if sb.Len() == 0 {
-			sb.WriteString(st.insertHead)
+	}
+	return stmts
+}
+
+// SinkColumns returns the client names of the columns sent to file sinks
+// and the positions of the key columns among them. Derived columns are
+// not sent, their expressions need SQL.
+func (st *SQLTemplet) SinkColumns() (columns []string, keys []int) {
+	for _, sc := range st.Columns {
+		if sc.Expr != "" {
+			continue
+		}
+		if sc.Key {
+			keys = append(keys, len(columns))
 		}
+		columns = append(columns, sc.ClientName)
+	}
+	return
+}
 
-		sbb := sb
-		if comma {
-			sb.WriteString(",")
+// SinkRow returns the cells of a server row in the order of SinkColumns,
+// masked like the SQL sent to clients.
+func (st *SQLTemplet) SinkRow(row []string) []util.Cell {
+	cells := make([]util.Cell, 0, len(st.Columns))
+	for _, sc := range st.Columns {
+		if sc.Expr != "" {
+			continue
 		}
-		st.Columns.AppendValues(&sb, res.Value())
-		comma = true
-		if sb.Len()+len(st.insertFoot) > maxPacketSize {
-			sb = sbb
-			break
+		kind := util.KindDecimal
+		if sc.IsString {
+			kind = util.KindString
+		}
+		switch sc.Mask {
+		case MaskNull:
+			cells = append(cells, util.Cell{Null: true})
+		case MaskHash:
+			h := sha256.Sum256([]byte(row[sc.Index]))
+			cells = append(cells, util.Cell{Kind: util.KindString, Bytes: []byte(hex.EncodeToString(h[:]))})
+		default:
+			cells = append(cells, util.Cell{Kind: kind, Bytes: []byte(row[sc.Index])})
 		}
 	}
+	return cells
+}
 
-	if sb.Len() > 0 {
-		sb.WriteString(st.insertFoot)
+// FullUpdate returns SyncFullUpdate for a client with filter. The filter
+// replaces $_CLIENT_FILTER, without it the query is wrapped in a derived
+// table named after the sync table.
+func (st *SQLTemplet) FullUpdate(filter string) string {
+	if strings.Contains(st.SyncFullUpdate, "$_CLIENT_FILTER") {
+		if filter == "" {
+			filter = "1=1"
+		}
+		return strings.Replace(st.SyncFullUpdate, "$_CLIENT_FILTER", "("+filter+")", -1)
+	}
+	if filter == "" {
+		return st.SyncFullUpdate
+	}
+	return "SELECT * FROM (" + st.SyncFullUpdate + ") AS " + st.table + " WHERE (" + filter + ")"
+}
+
+// matchFilterRows is how many rows MatchFilter evaluates in one query.
+const matchFilterRows = 500
+
+// MatchFilter reports for each of rows if it passes filter. They are
+// evaluated by the server database, matchFilterRows rows in one query, on
+// a derived table of the rows named after the sync table.
+func (st *SQLTemplet) MatchFilter(filter string, rows [][]string) ([]bool, error) {
+	match := make([]bool, len(rows))
+	for start := 0; start < len(rows); start += matchFilterRows {
+		end := start + matchFilterRows
+		if end > len(rows) {
+			end = len(rows)
+		}
+		var sb strings.Builder
+		sb.WriteString("SELECT _sync_row FROM (")
+		for i, row := range rows[start:end] {
+			if i > 0 {
+				sb.WriteString(" UNION ALL ")
+			}
+			sb.WriteString("SELECT " + strconv.Itoa(start+i) + " AS _sync_row")
+			for _, sc := range st.ServerColumns {
+				sb.WriteByte(',')
+				sc.appendRowValue(&sb, util.MySQL, row)
+				sb.WriteString(" AS " + sc.SQLName)
+			}
+		}
+		sb.WriteString(") AS " + st.table + " WHERE (" + filter + ")")
+
+		qs := DB.BeforeQuery(sb.String())
+		res, err := DB.Conn().Query(qs.SQL)
+		qs.EndQuery(err)
+		if err != nil {
+			return nil, err
+		}
+		for res.Next() {
+			var i int
+			if err := res.Scan(&i); err != nil {
+				res.Close()
+				return nil, err
+			}
+			if i >= start && i < end {
+				match[i] = true
+			}
+		}
+		err = res.Err()
+		res.Close()
+		if err != nil {
+			return nil, err
+		}
 	}
+	return match, nil
+}
 
-	return sb.String(), end
+func (st *SQLTemplet) templet(s string) string {
+	s = strings.Replace(s, "$_TABLE", st.table, -1)
+	s = strings.Replace(s, "$_COLUMNS", st.columnStr, -1)
+	return s
 }
 
 func (st *SQLTemplet) ClientInsertSlice(res [][]string, maxPacketSize int) (string, [][]string) {
@@ -221,9 +793,10 @@ func (st *SQLTemplet) ClientInsertSlice(res [][]string, maxPacketSize int) (stri
 		if comma {
 			sb.WriteString(",")
 		}
-		st.Columns.AppendValues(&sb, res[i])
+		st.Columns.AppendValues(&sb, st.dialect, res[i])
 		comma = true
-		if sb.Len()+len(st.insertFoot) > maxPacketSize {
+		// a row larger than maxPacketSize is sent alone
+		if i > 0 && sb.Len()+len(st.insertFoot) > maxPacketSize {
 			sb = sbb
 			break
 		}
@@ -238,70 +811,35 @@ func (st *SQLTemplet) ClientInsertSlice(res [][]string, maxPacketSize int) (stri
 	return sb.String(), res[i:]
 }
 
-type DbDump struct {
-	f   *os.File
-	dec *gob.Decoder
-	val []string
-	err error
-}
-
-func MakeDbDump(rows *sql.Rows, columns SyncColumns) (*DbDump, error) {
-	id, err := uuid.NewV4()
-	if err != nil {
-		return nil, err
-	}
-
-	f, err := os.Create(fmt.Sprintf("%s.dump", id.String()))
-	if err != nil {
-		return nil, err
-	}
-	enc := gob.NewEncoder(f)
-
-	res := make([]string, len(columns))
-	dest := make([]interface{}, len(columns))
-	for rows.Next() {
-		err := columns.Scan(res, rows, dest)
-		if err != nil {
-			f.Close()
-			return nil, err
+// ClientDeleteSlice is ClientInsertSlice for rows which are deleted by
+// their key columns.
+func (st *SQLTemplet) ClientDeleteSlice(res [][]string, maxPacketSize int) (string, [][]string) {
+	var sb strings.Builder
+	var i int
+	for ; i < len(res); i++ {
+		size := sb.Len()
+		if i == 0 {
+			sb.WriteString(st.deleteHead)
+		} else {
+			sb.WriteByte(',')
 		}
-		enc.Encode(res)
-	}
-	if err := rows.Err(); err != nil {
-		f.Close()
-		return nil, err
-	}
-	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
-		f.Close()
-		return nil, err
-	}
-	return &DbDump{f: f}, nil
-}
-
-func (d *DbDump) Next() bool {
-	if d.dec == nil {
-		if _, err := d.f.Seek(0, os.SEEK_SET); err != nil {
-			d.err = err
+		sb.WriteByte('(')
+		for j, k := range st.keys {
+			if j > 0 {
+				sb.WriteByte(',')
+			}
+			st.Columns[k].appendRowValue(&sb, st.dialect, res[i])
+		}
+		sb.WriteByte(')')
+		if i > 0 && sb.Len()+1 > maxPacketSize {
+			s := sb.String()[:size]
+			sb.Reset()
+			sb.WriteString(s)
+			break
 		}
-		d.dec = gob.NewDecoder(d.f)
-	}
-	if d.err != nil {
-		return false
 	}
-	d.err = d.dec.Decode(&d.val)
-	return d.err == nil
-}
-func (d *DbDump) Value() []string {
-	return d.val
-}
-func (d *DbDump) Err() error {
-	if d.err == io.EOF {
-		return nil
+	if sb.Len() > 0 {
+		sb.WriteByte(')')
 	}
-	return d.err
-}
-func (d *DbDump) Close() error {
-	fname := d.f.Name()
-	d.f.Close()
-	return os.Remove(fname)
+	return sb.String(), res[i:]
 }
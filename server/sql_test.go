@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"strings"
 	"testing"
+	"util"
 )
 
 func TestDbDump(t *testing.T) {
@@ -36,3 +38,171 @@ func TestDbDump(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// testConfig returns the default config syncing columns of bus_authorized.
+func testConfig(columns string) *config {
+	c := newConfig()
+	c.SyncTableName = "bus_authorized"
+	c.SyncColumns = columns
+	return c
+}
+
+func newTestTemplet(t *testing.T, c *config) *SQLTemplet {
+	st := new(SQLTemplet)
+	if err := st.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestSyncColumnOwners(t *testing.T) {
+	cs, err := ParseSyncColumns("id@key,$title@lww(ver),valid_count@client,ver,$plate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	cs.AppendSetAllValues(&sb, util.MySQL, "`t`")
+	want := "`id`=VALUES(`id`)," +
+		"`title`=IF(`ver` IS NULL OR VALUES(`ver`)>=`ver`,VALUES(`title`),`title`)," +
+		"`plate`=VALUES(`plate`)," +
+		"`ver`=IF(`ver` IS NULL OR VALUES(`ver`)>=`ver`,VALUES(`ver`),`ver`)"
+	if sb.String() != want {
+		t.Errorf("got %s, want %s", sb.String(), want)
+	}
+
+	for _, s := range []string{"a@lww(v),v", "id@key,a@lww(v)", "id@key,a@lww(v),v@client", "id@owner"} {
+		if _, err := ParseSyncColumns(s); err == nil {
+			t.Errorf("ParseSyncColumns(%q) should fail", s)
+		}
+	}
+}
+
+func TestClientDeleteSlice(t *testing.T) {
+	c := testConfig("id@key,$valid_entity@key,valid_count")
+	c.ClientFilters = map[string]string{"*": "valid_entity='E01'"}
+	st := newTestTemplet(t, c)
+
+	sql, rest := st.ClientDeleteSlice([][]string{{"1", "E'02", "3"}, {"2", "E03", "5"}}, 4096)
+	want := "DELETE FROM `bus_authorized` WHERE (`id`,`valid_entity`) IN ((1,'E''02'),(2,'E03'))"
+	if sql != want || len(rest) != 0 {
+		t.Errorf("got %s, %d rows left", sql, len(rest))
+	}
+}
+
+func TestColumnProfile(t *testing.T) {
+	c := testConfig("id@key,$remarks,$business_code,valid_count")
+	c.ColumnProfiles = map[string]*ColumnProfile{
+		"site": {Drop: []string{"remarks"}, Null: []string{"business_code"}},
+	}
+	c.ClientProfiles = map[string]string{"*": "site"}
+	st := newTestTemplet(t, c)
+
+	sql, _ := st.Client("uuid", "cn").ClientInsertSlice([][]string{{"1", "note", "B01", "3"}}, 4096)
+	want := "INSERT INTO `bus_authorized`(`id`,`business_code`,`valid_count`) VALUES (1,NULL,3)" +
+		"ON DUPLICATE KEY UPDATE `id`=VALUES(`id`),`business_code`=VALUES(`business_code`),`valid_count`=VALUES(`valid_count`)"
+	if sql != want {
+		t.Errorf("got %s, want %s", sql, want)
+	}
+}
+
+func TestColumnMapping(t *testing.T) {
+	c := testConfig("id:auth_id@key,$valid_entity:entity,synced_at=NOW(),note@client=CONCAT('a','b')")
+	c.SyncClientTableName = "authorized"
+	st := newTestTemplet(t, c)
+	if st.SyncFullUpdate != "SELECT `id`,`valid_entity` FROM `bus_authorized`" {
+		t.Errorf("got %s", st.SyncFullUpdate)
+	}
+
+	sql, _ := st.ClientInsertSlice([][]string{{"1", "E01"}}, 4096)
+	want := "INSERT INTO `authorized`(`auth_id`,`entity`,`synced_at`,`note`) VALUES (1,'E01',NOW(),CONCAT('a','b'))" +
+		"ON DUPLICATE KEY UPDATE `auth_id`=VALUES(`auth_id`),`entity`=VALUES(`entity`),`synced_at`=NOW()"
+	if sql != want {
+		t.Errorf("got %s, want %s", sql, want)
+	}
+
+	for _, s := range []string{"a:b=1", "id@key=1", "a:", "=NOW()"} {
+		if _, err := ParseSyncColumns(s); err == nil {
+			t.Errorf("ParseSyncColumns(%q) should fail", s)
+		}
+	}
+}
+
+func TestPostgresDialect(t *testing.T) {
+	c := testConfig("id@key,$title@lww(ver),ver,$plate:plate_no")
+	c.SyncClientDialect = "postgres"
+	st := newTestTemplet(t, c)
+
+	sql, _ := st.ClientInsertSlice([][]string{{"1", "it's", "2", "A1"}}, 4096)
+	want := `INSERT INTO "bus_authorized"("id","title","ver","plate_no") VALUES (1,'it''s',2,'A1')` +
+		`ON CONFLICT ("id") DO UPDATE SET "id"=EXCLUDED."id",` +
+		`"title"=CASE WHEN "bus_authorized"."ver" IS NULL OR EXCLUDED."ver">="bus_authorized"."ver" THEN EXCLUDED."title" ELSE "bus_authorized"."title" END,` +
+		`"plate_no"=EXCLUDED."plate_no",` +
+		`"ver"=CASE WHEN "bus_authorized"."ver" IS NULL OR EXCLUDED."ver">="bus_authorized"."ver" THEN EXCLUDED."ver" ELSE "bus_authorized"."ver" END`
+	if sql != want {
+		t.Errorf("got %s, want %s", sql, want)
+	}
+
+	sql, _ = st.ClientDeleteSlice([][]string{{"1", "", "", ""}}, 4096)
+	if want := `DELETE FROM "bus_authorized" WHERE ("id") IN ((1))`; sql != want {
+		t.Errorf("got %s, want %s", sql, want)
+	}
+
+	sql, _ = st.Shadow("bus_authorized__shadow").ClientInsertSlice([][]string{{"1", "a", "2", "A1"}}, 4096)
+	if !strings.Contains(sql, `ELSE "bus_authorized__shadow"."title" END`) || strings.Contains(sql, `"bus_authorized".`) {
+		t.Errorf("shadow upsert refers to the live table: %s", sql)
+	}
+
+	c.SyncColumns = "id,$title"
+	if err := st.Init(c); err == nil {
+		t.Error("upsert without @key column should fail")
+	}
+}
+
+func TestSinkRow(t *testing.T) {
+	c := testConfig("id@key,$plate:plate_no,$remarks,synced_at=NOW()")
+	c.ColumnProfiles = map[string]*ColumnProfile{"kiosk": {Null: []string{"remarks"}}}
+	c.ClientProfiles = map[string]string{"*": "kiosk"}
+	st := newTestTemplet(t, c)
+
+	tpl := st.Client("uuid", "cn")
+	columns, keys := tpl.SinkColumns()
+	if strings.Join(columns, ",") != "id,plate_no,remarks" || len(keys) != 1 || keys[0] != 0 {
+		t.Errorf("got columns %v, keys %v", columns, keys)
+	}
+	cells := tpl.SinkRow([]string{"1", "A01", "note"})
+	if len(cells) != 3 || string(cells[1].Bytes) != "A01" || cells[1].Kind != util.KindString || !cells[2].Null {
+		t.Errorf("got %v", cells)
+	}
+}
+
+func TestBundleItems(t *testing.T) {
+	st := newTestTemplet(t, testConfig("id@key,$plate"))
+
+	b := new(Bundle)
+	b.appendItems(st, []QueueItem{{Row: []string{"1", "A"}}, {Row: []string{"2", "B"}}, {Delete: true, Row: []string{"3", "C"}}}, 4096)
+	if len(b.Statements) != 2 ||
+		!strings.HasPrefix(b.Statements[0], "INSERT INTO `bus_authorized`(`id`,`plate`) VALUES (1,'A'),(2,'B')") ||
+		b.Statements[1] != "DELETE FROM `bus_authorized` WHERE (`id`) IN ((3))" {
+		t.Errorf("got %q", b.Statements)
+	}
+}
+
+func TestShadowTemplet(t *testing.T) {
+	c := testConfig("id@key,$bus_plate")
+	c.StagedFullSync = true
+	st := newTestTemplet(t, c)
+	shadow := st.Shadow("bus_authorized__shadow")
+	sql, _ := shadow.ClientInsertSlice([][]string{{"1", "A1"}}, 4096)
+	want := "INSERT INTO `bus_authorized__shadow`(`id`,`bus_plate`) VALUES (1,'A1')ON DUPLICATE KEY UPDATE `id`=VALUES(`id`),`bus_plate`=VALUES(`bus_plate`)"
+	if sql != want {
+		t.Errorf("got %s, want %s", sql, want)
+	}
+	if sql, _ := st.ClientInsertSlice([][]string{{"1", "A1"}}, 4096); !strings.HasPrefix(sql, "INSERT INTO `bus_authorized`(") {
+		t.Errorf("live templet changed: %s", sql)
+	}
+
+	c.SyncColumns = "id@key,$bus_plate@client"
+	if err := new(SQLTemplet).Init(c); err == nil {
+		t.Error("client owned column accepted with StagedFullSync")
+	}
+}
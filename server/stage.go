@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/rpc"
+	"time"
+)
+
+// shadowSuffix is appended to the client table by the client to name its
+// shadow, dry-run clients do not create one.
+const shadowSuffix = "__shadow"
+
+// stagedFullSync loads the rows of d into a shadow of the client table and
+// swaps it with the live table when complete, so the client never sees a
+// partial table. Rows queued meanwhile are applied to the new table after
+// it returns.
+func stagedFullSync(rpcClient *rpc.Client, tpl *SQLTemplet, clientUUID string, d *DbDump, maxPacketSize int) error {
+	table := tpl.clientTableName
+	shadow := table + shadowSuffix
+	if err := callStage(rpcClient, clientUUID, "db.Stage", table, &shadow); err != nil {
+		return err
+	}
+	log.Printf("info: full sync[%s] staged in '%s'", clientUUID, shadow)
+
+	if err := clientInsertDump(rpcClient, tpl.Shadow(shadow), clientUUID, d, maxPacketSize); err != nil {
+		return err
+	}
+
+	var reply int
+	if err := callStage(rpcClient, clientUUID, "db.Swap", table, &reply); err != nil {
+		return err
+	}
+	log.Printf("info: full sync[%s] swapped '%s' into '%s'", clientUUID, shadow, table)
+	return nil
+}
+
+// callStage calls method of the staging RPCs, dry-run clients record the
+// call instead.
+func callStage(rpcClient *rpc.Client, clientUUID, method, table string, reply interface{}) error {
+	if DryRuns.Enabled(rpcClient) {
+		DryRuns.Record(&DryRunStatement{
+			Time:   time.Now(),
+			Client: clientUUID,
+			SQL:    "-- " + method + " " + table,
+		})
+		return nil
+	}
+	if err := rpcClient.Call(method, table, reply); err != nil {
+		return fmt.Errorf("rpc %s[%s] '%s': %v", method, clientUUID, table, err)
+	}
+	return nil
+}
@@ -4,4 +4,6 @@ var Stat stat
 
 type stat struct {
 	ConnectionRPC int64
+	// Conflicts counts rows where a newer client version was kept.
+	Conflicts int64
 }
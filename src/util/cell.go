@@ -0,0 +1,194 @@
+package util
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of a Cell, derived from the database type of its column.
+const (
+	KindString byte = iota
+	KindInt
+	KindUint
+	KindFloat
+	KindDecimal
+	KindTime
+	KindBytes
+)
+
+const CellTimeFormat = "2006-01-02 15:04:05.999999"
+
+// Cell is one NULL-aware value of a typed result set. Bytes holds the text
+// form of the value, except for KindBytes where it is the raw value.
+type Cell struct {
+	Null  bool
+	Kind  byte
+	Bytes []byte
+}
+
+// Column describes one column of a typed result set.
+type Column struct {
+	Name      string
+	Type      string
+	Kind      byte
+	Nullable  bool
+	Precision int64
+	Scale     int64
+	Length    int64
+}
+
+// KindOf returns the kind of the database type name dbType. Integer types
+// are KindInt, the name does not tell whether they are unsigned.
+func KindOf(dbType string) byte {
+	t := strings.TrimPrefix(strings.ToUpper(dbType), "UNSIGNED ")
+	switch t {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "INTEGER", "BIGINT", "YEAR":
+		return KindInt
+	case "FLOAT", "DOUBLE", "REAL":
+		return KindFloat
+	case "DECIMAL", "NUMERIC":
+		return KindDecimal
+	case "DATE", "DATETIME", "TIMESTAMP", "TIME":
+		return KindTime
+	case "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "BIT", "GEOMETRY":
+		return KindBytes
+	}
+	return KindString
+}
+
+// kindOfColumn returns the kind of a column of type dbType scanned as
+// scanType. The driver reports unsigned only by scanning NOT NULL integer
+// columns as unsigned Go types.
+func kindOfColumn(dbType string, scanType reflect.Type) byte {
+	kind := KindOf(dbType)
+	if kind == KindInt && scanType != nil {
+		switch scanType.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return KindUint
+		}
+	}
+	return kind
+}
+
+func ScanColumns(rows *sql.Rows) ([]Column, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]Column, len(types))
+	for i, ct := range types {
+		c := &columns[i]
+		c.Name = ct.Name()
+		c.Type = ct.DatabaseTypeName()
+		c.Kind = kindOfColumn(c.Type, ct.ScanType())
+		c.Nullable, _ = ct.Nullable()
+		c.Precision, c.Scale, _ = ct.DecimalSize()
+		c.Length, _ = ct.Length()
+	}
+	return columns, nil
+}
+
+// ScanCells reads up to count rows, all rows if count <= 0. end is set
+// when rows is exhausted.
+func ScanCells(rows *sql.Rows, columns []Column, count int) (results [][]Cell, end bool, err error) {
+	if count <= 0 {
+		count = 1 << 31
+	}
+	values := make([]interface{}, len(columns))
+	scan := make([]interface{}, len(columns))
+	for i := range scan {
+		scan[i] = &values[i]
+	}
+	for count > 0 {
+		if !rows.Next() {
+			end = true
+			err = rows.Err()
+			return
+		}
+		if err = rows.Scan(scan...); err != nil {
+			return
+		}
+		row := make([]Cell, len(columns))
+		for i, v := range values {
+			row[i] = NewCell(columns[i].Kind, v)
+		}
+		results = append(results, row)
+		count--
+	}
+	return
+}
+
+// NewCell converts a value scanned into *interface{}.
+func NewCell(kind byte, v interface{}) Cell {
+	c := Cell{Kind: kind}
+	switch v := v.(type) {
+	case nil:
+		c.Null = true
+	case []byte:
+		c.Bytes = append([]byte{}, v...)
+	case string:
+		c.Bytes = []byte(v)
+	case int64:
+		c.Bytes = strconv.AppendInt(nil, v, 10)
+	case uint64:
+		c.Bytes = strconv.AppendUint(nil, v, 10)
+	case float64:
+		c.Bytes = strconv.AppendFloat(nil, v, 'g', -1, 64)
+	case float32:
+		c.Bytes = strconv.AppendFloat(nil, float64(v), 'g', -1, 32)
+	case bool:
+		c.Bytes = strconv.AppendBool(nil, v)
+	case time.Time:
+		c.Bytes = []byte(v.Format(CellTimeFormat))
+	default:
+		c.Bytes = []byte(fmt.Sprint(v))
+	}
+	return c
+}
+
+func (c Cell) String() string {
+	if c.Null {
+		return "NULL"
+	}
+	return string(c.Bytes)
+}
+
+// Value converts c to a database/sql/driver value.
+func (c Cell) Value() (driver.Value, error) {
+	if c.Null {
+		return nil, nil
+	}
+	s := string(c.Bytes)
+	switch c.Kind {
+	case KindInt, KindUint:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			// BIGINT UNSIGNED above MaxInt64, nullable columns are not
+			// reported unsigned
+			if _, uerr := strconv.ParseUint(s, 10, 64); uerr == nil {
+				return s, nil
+			}
+		}
+		return i, err
+	case KindFloat:
+		return strconv.ParseFloat(s, 64)
+	case KindTime:
+		layout := CellTimeFormat
+		if len(s) == len("2006-01-02") {
+			layout = "2006-01-02"
+		}
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err != nil {
+			return s, nil
+		}
+		return t, nil
+	case KindBytes:
+		return c.Bytes, nil
+	}
+	return s, nil
+}
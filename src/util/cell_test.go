@@ -0,0 +1,74 @@
+package util
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCellValue(t *testing.T) {
+	ts := time.Date(2019, 3, 1, 8, 30, 0, 0, time.Local)
+	tests := []struct {
+		kind byte
+		in   interface{}
+		out  interface{}
+	}{
+		{KindInt, nil, nil},
+		{KindInt, []byte("-12"), int64(-12)},
+		{KindInt, int64(7), int64(7)},
+		{KindInt, []byte("-9223372036854775808"), int64(-9223372036854775808)},
+		{KindInt, uint64(18446744073709551615), "18446744073709551615"},
+		{KindInt, []byte("18446744073709551615"), "18446744073709551615"},
+		{KindUint, uint64(42), int64(42)},
+		{KindUint, []byte("18446744073709551615"), "18446744073709551615"},
+		{KindFloat, []byte("1.5"), 1.5},
+		{KindDecimal, []byte("0.10"), "0.10"},
+		{KindString, []byte("0"), "0"},
+		{KindTime, ts, ts},
+		{KindTime, []byte("2019-03-01"), time.Date(2019, 3, 1, 0, 0, 0, 0, time.Local)},
+		{KindBytes, []byte{0, 1}, []byte{0, 1}},
+	}
+	for _, test := range tests {
+		c := NewCell(test.kind, test.in)
+		v, err := c.Value()
+		if err != nil {
+			t.Errorf("%v: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, test.out) {
+			t.Errorf("%v: got %#v, want %#v", test.in, v, test.out)
+		}
+	}
+	if c := NewCell(KindString, nil); !c.Null || c.String() != "NULL" {
+		t.Errorf("NULL cell: %+v", c)
+	}
+}
+
+func TestKindOf(t *testing.T) {
+	// type names and scan types as reported by the mysql driver
+	tests := []struct {
+		typ  string
+		scan interface{}
+		kind byte
+	}{
+		{"BIGINT", int64(0), KindInt},
+		{"BIGINT", uint64(0), KindUint},
+		{"BIGINT", sql.NullInt64{}, KindInt},
+		{"INT", uint32(0), KindUint},
+		{"TINYINT", uint8(0), KindUint},
+		{"YEAR", uint16(0), KindUint},
+		{"UNSIGNED BIGINT", uint64(0), KindUint},
+		{"DOUBLE", float64(0), KindFloat},
+		{"DECIMAL", sql.RawBytes{}, KindDecimal},
+		{"DATETIME", sql.NullTime{}, KindTime},
+		{"BLOB", sql.RawBytes{}, KindBytes},
+		{"VARCHAR", sql.RawBytes{}, KindString},
+		{"JSON", sql.RawBytes{}, KindString},
+	}
+	for _, test := range tests {
+		if kind := kindOfColumn(test.typ, reflect.TypeOf(test.scan)); kind != test.kind {
+			t.Errorf("kindOfColumn(%s, %T) = %d, want %d", test.typ, test.scan, kind, test.kind)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Dialect generates the SQL of a database engine rows are synced to.
+// Identifiers passed to it are quoted by QuoteIdent unless noted.
+type Dialect interface {
+	Name() string
+	QuoteIdent(name string) string
+	// AppendString writes s as a string literal.
+	AppendString(sb *strings.Builder, s string)
+	// If returns an expression which is a if cond holds, else b.
+	If(cond, a, b string) string
+	// NullSafeEqual compares a and b, two NULLs are equal.
+	NullSafeEqual(a, b string) string
+	// Inserted refers to column c of the row proposed by an upsert.
+	Inserted(c string) string
+	// Existing refers to column c of the row of table an upsert updates.
+	Existing(table, c string) string
+	// Upsert returns the clause following the rows of an INSERT which
+	// applies set to rows with the same unique key, keys are the key
+	// columns.
+	Upsert(keys []string, set []string) (string, error)
+	// DeleteHead starts a DELETE of table by keys, it is followed by comma
+	// separated row tuples of the keys and ")".
+	DeleteHead(table string, keys []string) string
+	// ShowCreateTable returns the query which scans the name and create
+	// statement of table, empty if CopyTable does not need it.
+	ShowCreateTable(table string) string
+	// CopyTable returns the statements which replace table dst by a copy
+	// of src, create is the statement read by ShowCreateTable of src.
+	// Table names are not quoted.
+	CopyTable(dst, src, create string) ([]string, error)
+	// CreateTableLike is CopyTable without copying the rows.
+	CreateTableLike(dst, src, create string) ([]string, error)
+	// SwapTables returns the statements which replace table by shadow in
+	// one step, table is renamed to old and dropped. Table names are not
+	// quoted.
+	SwapTables(table, shadow, old string) []string
+}
+
+var Dialects = map[string]Dialect{
+	"mysql":    MySQL,
+	"postgres": Postgres,
+}
+
+func GetDialect(name string) (Dialect, error) {
+	if name == "" {
+		return MySQL, nil
+	}
+	d, ok := Dialects[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown SQL dialect '%s'", name)
+	}
+	return d, nil
+}
+
+// appendQuoted writes s in quotes q, doubling q inside s.
+func appendQuoted(sb *strings.Builder, s string, q byte) {
+	sb.Grow(len(s) + 2)
+	sb.WriteByte(q)
+	last := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == q {
+			sb.WriteString(s[last : i+1])
+			sb.WriteByte(q)
+			last = i + 1
+		}
+	}
+	sb.WriteString(s[last:])
+	sb.WriteByte(q)
+}
+
+func quoted(s string, q byte) string {
+	var sb strings.Builder
+	appendQuoted(&sb, s, q)
+	return sb.String()
+}
+
+type mysqlDialect struct{}
+
+// MySQL is the dialect of MySQL and MariaDB.
+var MySQL Dialect = mysqlDialect{}
+
+func (mysqlDialect) Name() string                  { return "mysql" }
+func (mysqlDialect) QuoteIdent(name string) string { return quoted(name, '`') }
+
+// AppendString escapes s like the mysql driver does for the default
+// sql_mode, where a backslash starts an escape sequence.
+func (mysqlDialect) AppendString(sb *strings.Builder, s string) {
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('\'')
+	last := 0
+	for i := 0; i < len(s); i++ {
+		var esc string
+		switch s[i] {
+		case 0:
+			esc = `\0`
+		case '\n':
+			esc = `\n`
+		case '\r':
+			esc = `\r`
+		case '\x1a':
+			esc = `\Z`
+		case '\\':
+			esc = `\\`
+		case '\'':
+			esc = `''`
+		case '"':
+			esc = `\"`
+		default:
+			continue
+		}
+		sb.WriteString(s[last:i])
+		sb.WriteString(esc)
+		last = i + 1
+	}
+	sb.WriteString(s[last:])
+	sb.WriteByte('\'')
+}
+func (mysqlDialect) If(cond, a, b string) string {
+	return "IF(" + cond + "," + a + "," + b + ")"
+}
+func (mysqlDialect) NullSafeEqual(a, b string) string { return a + "<=>" + b }
+func (mysqlDialect) Inserted(c string) string         { return "VALUES(" + c + ")" }
+func (mysqlDialect) Existing(table, c string) string  { return c }
+func (mysqlDialect) Upsert(keys []string, set []string) (string, error) {
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(set, ","), nil
+}
+func (mysqlDialect) DeleteHead(table string, keys []string) string {
+	return "DELETE FROM " + table + " WHERE (" + strings.Join(keys, ",") + ") IN ("
+}
+func (d mysqlDialect) ShowCreateTable(table string) string {
+	return "SHOW CREATE TABLE " + d.QuoteIdent(table)
+}
+func (d mysqlDialect) CopyTable(dst, src, create string) ([]string, error) {
+	stmts, err := d.CreateTableLike(dst, src, create)
+	if err != nil {
+		return nil, err
+	}
+	return append(stmts, "INSERT INTO "+d.QuoteIdent(dst)+" SELECT * FROM "+d.QuoteIdent(src)), nil
+}
+func (d mysqlDialect) CreateTableLike(dst, src, create string) ([]string, error) {
+	// replace table name with dst table
+	pos := strings.IndexByte(create, '(')
+	if pos < 12 { /* length of "CREATE TABLE" */
+		return nil, errors.New("bad create table syntax")
+	}
+	return []string{
+		"DROP TABLE IF EXISTS " + d.QuoteIdent(dst),
+		"CREATE TABLE " + d.QuoteIdent(dst) + " " + create[pos:],
+	}, nil
+}
+func (d mysqlDialect) SwapTables(table, shadow, old string) []string {
+	// RENAME TABLE renames every pair atomically
+	return []string{
+		"DROP TABLE IF EXISTS " + d.QuoteIdent(old),
+		"RENAME TABLE " + d.QuoteIdent(table) + " TO " + d.QuoteIdent(old) + ", " +
+			d.QuoteIdent(shadow) + " TO " + d.QuoteIdent(table),
+		"DROP TABLE " + d.QuoteIdent(old),
+	}
+}
+
+type postgresDialect struct{}
+
+// Postgres is the dialect of PostgreSQL 9.5 and later, which assumes
+// standard_conforming_strings.
+var Postgres Dialect = postgresDialect{}
+
+func (postgresDialect) Name() string                  { return "postgres" }
+func (postgresDialect) QuoteIdent(name string) string { return quoted(name, '"') }
+func (postgresDialect) AppendString(sb *strings.Builder, s string) {
+	appendQuoted(sb, s, '\'')
+}
+func (postgresDialect) If(cond, a, b string) string {
+	return "CASE WHEN " + cond + " THEN " + a + " ELSE " + b + " END"
+}
+func (postgresDialect) NullSafeEqual(a, b string) string {
+	return a + " IS NOT DISTINCT FROM " + b
+}
+func (postgresDialect) Inserted(c string) string { return "EXCLUDED." + c }
+
+// Existing qualifies c, unqualified columns of DO UPDATE SET are ambiguous.
+func (postgresDialect) Existing(table, c string) string { return table + "." + c }
+func (postgresDialect) Upsert(keys []string, set []string) (string, error) {
+	if len(keys) == 0 {
+		return "", errors.New("upsert needs key columns")
+	}
+	return "ON CONFLICT (" + strings.Join(keys, ",") + ") DO UPDATE SET " + strings.Join(set, ","), nil
+}
+func (postgresDialect) DeleteHead(table string, keys []string) string {
+	return "DELETE FROM " + table + " WHERE (" + strings.Join(keys, ",") + ") IN ("
+}
+func (postgresDialect) ShowCreateTable(table string) string { return "" }
+func (d postgresDialect) CopyTable(dst, src, create string) ([]string, error) {
+	stmts, _ := d.CreateTableLike(dst, src, create)
+	return append(stmts, "INSERT INTO "+d.QuoteIdent(dst)+" SELECT * FROM "+d.QuoteIdent(src)), nil
+}
+func (d postgresDialect) CreateTableLike(dst, src, create string) ([]string, error) {
+	return []string{
+		"DROP TABLE IF EXISTS " + d.QuoteIdent(dst),
+		"CREATE TABLE " + d.QuoteIdent(dst) + " (LIKE " + d.QuoteIdent(src) + " INCLUDING ALL)",
+	}, nil
+}
+
+// SwapTables relies on the statements running in one transaction, DDL is
+// transactional in PostgreSQL.
+func (d postgresDialect) SwapTables(table, shadow, old string) []string {
+	return []string{
+		"DROP TABLE IF EXISTS " + d.QuoteIdent(old),
+		"ALTER TABLE " + d.QuoteIdent(table) + " RENAME TO " + d.QuoteIdent(old),
+		"ALTER TABLE " + d.QuoteIdent(shadow) + " RENAME TO " + d.QuoteIdent(table),
+		"DROP TABLE " + d.QuoteIdent(old),
+	}
+}
@@ -0,0 +1,80 @@
+package util
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDialectQuote(t *testing.T) {
+	for _, c := range []struct {
+		d                 Dialect
+		name, ident, text string
+	}{
+		{MySQL, "a`b", "`a``b`", "'it''s'"},
+		{Postgres, `a"b`, `"a""b"`, "'it''s'"},
+	} {
+		if s := c.d.QuoteIdent(c.name); s != c.ident {
+			t.Errorf("%s: QuoteIdent got %s, want %s", c.d.Name(), s, c.ident)
+		}
+		var sb strings.Builder
+		c.d.AppendString(&sb, "it's")
+		if sb.String() != c.text {
+			t.Errorf("%s: AppendString got %s, want %s", c.d.Name(), sb.String(), c.text)
+		}
+	}
+}
+
+func TestMySQLAppendString(t *testing.T) {
+	for in, out := range map[string]string{
+		"":             `''`,
+		"it's":         `'it''s'`,
+		`C:\tmp`:       `'C:\\tmp'`,
+		`\'`:           `'\\'''`,
+		"a\x00b":       `'a\0b'`,
+		"1\n2\r3":      `'1\n2\r3'`,
+		"\x1a":         `'\Z'`,
+		`say "hi"`:     `'say \"hi\"'`,
+		"\u4e2d\u6587": "'\u4e2d\u6587'",
+	} {
+		var sb strings.Builder
+		MySQL.AppendString(&sb, in)
+		if sb.String() != out {
+			t.Errorf("AppendString(%q) = %s, want %s", in, sb.String(), out)
+		}
+	}
+}
+
+func TestDialectCopyTable(t *testing.T) {
+	stmts, err := MySQL.CopyTable("sync_vars__1", "sync_vars", "CREATE TABLE `sync_vars` (\n  `name` varchar(64)\n)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"DROP TABLE IF EXISTS `sync_vars__1`",
+		"CREATE TABLE `sync_vars__1` (\n  `name` varchar(64)\n)",
+		"INSERT INTO `sync_vars__1` SELECT * FROM `sync_vars`",
+	}
+	if !reflect.DeepEqual(stmts, want) {
+		t.Errorf("mysql: got %q", stmts)
+	}
+	if _, err := MySQL.CopyTable("a", "b", "bad"); err == nil {
+		t.Error("mysql: bad create table should fail")
+	}
+
+	stmts, _ = Postgres.CopyTable("sync_vars__1", "sync_vars", "")
+	if stmts[1] != `CREATE TABLE "sync_vars__1" (LIKE "sync_vars" INCLUDING ALL)` {
+		t.Errorf("postgres: got %q", stmts)
+	}
+	stmts = Postgres.SwapTables("t", "t__shadow", "t__old")
+	if len(stmts) != 4 || stmts[2] != `ALTER TABLE "t__shadow" RENAME TO "t"` {
+		t.Errorf("postgres swap: got %q", stmts)
+	}
+	stmts = MySQL.SwapTables("t", "t__shadow", "t__old")
+	if stmts[1] != "RENAME TABLE `t` TO `t__old`, `t__shadow` TO `t`" {
+		t.Errorf("mysql swap: got %q", stmts)
+	}
+	if _, err := GetDialect("oracle"); err == nil {
+		t.Error("unknown dialect should fail")
+	}
+}
@@ -0,0 +1,115 @@
+package util
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// DSNConfig is the structured form of a DSN file, a JSON object instead
+// of DSN lines. PasswordFile is read if Password is empty, Params are the
+// DSN parameters like "timeout".
+type DSNConfig struct {
+	Net          string            `json:"net" secret:"expand"`
+	Host         string            `json:"host" secret:"expand"`
+	User         string            `json:"user" secret:"expand"`
+	Password     string            `json:"password" secret:"expand"`
+	PasswordFile string            `json:"password_file" secret:"expand"`
+	Database     string            `json:"database" secret:"expand"`
+	Params       map[string]string `json:"params" secret:"expand"`
+}
+
+// ReadDSN reads a DSN file. A file starting with "{" is a DSNConfig,
+// otherwise its lines not starting with "#" are joined into the DSN.
+// Secret references of ExpandSecrets are expanded in both.
+func ReadDSN(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		dc := new(DSNConfig)
+		if err := json.Unmarshal(data, dc); err != nil {
+			return "", fmt.Errorf("parse %s: %v", filename, err)
+		}
+		if err := ExpandSecretsIn(dc); err != nil {
+			return "", fmt.Errorf("%s: %v", filename, err)
+		}
+		return dc.DSN()
+	}
+
+	sb := new(strings.Builder)
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		txt := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(txt, "#") {
+			continue
+		}
+		sb.WriteString(txt)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	dsn, err := ExpandSecrets(sb.String())
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", filename, err)
+	}
+	return dsn, nil
+}
+
+// DSN assembles the DSN with the config of the MySQL driver, so values
+// need no escaping.
+func (dc *DSNConfig) DSN() (string, error) {
+	password := dc.Password
+	if password == "" && dc.PasswordFile != "" {
+		data, err := ioutil.ReadFile(dc.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("password_file: %v", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+	cfg := mysql.NewConfig()
+	cfg.Net = dc.Net
+	if cfg.Net == "" {
+		cfg.Net = "tcp"
+	}
+	cfg.Addr = dc.Host
+	cfg.User = dc.User
+	cfg.Passwd = password
+	cfg.DBName = dc.Database
+	dsn := cfg.FormatDSN()
+	if len(dc.Params) > 0 {
+		q := url.Values{}
+		for k, v := range dc.Params {
+			q.Set(k, v)
+		}
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + q.Encode()
+	}
+	// parse the result, so bad values of known params fail here
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// MaskDSN returns dsn with the password masked, for logs.
+func MaskDSN(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "(bad DSN)"
+	}
+	if cfg.Passwd != "" {
+		cfg.Passwd = "***"
+	}
+	return cfg.FormatDSN()
+}
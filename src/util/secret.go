@@ -0,0 +1,150 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// ExpandSecrets replaces references in s: "${NAME}" by the environment
+// variable NAME and "${file:path}" by the content of file path without
+// trailing newlines. "$${" is a literal "${". Unset variables and
+// unreadable files are errors, so a secret is never silently empty.
+func ExpandSecrets(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var sb strings.Builder
+	for {
+		pos := strings.Index(s, "${")
+		if pos < 0 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+		if pos > 0 && s[pos-1] == '$' {
+			sb.WriteString(s[:pos-1] + "${")
+			s = s[pos+2:]
+			continue
+		}
+		end := strings.IndexByte(s[pos:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed reference in %q", s[pos:])
+		}
+		sb.WriteString(s[:pos])
+		ref := s[pos+2 : pos+end]
+		v, err := resolveSecret(ref)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(v)
+		s = s[pos+end+1:]
+	}
+}
+
+func resolveSecret(ref string) (string, error) {
+	if strings.HasPrefix(ref, "file:") {
+		path := ref[len("file:"):]
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("secret file: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if ref == "" {
+		return "", fmt.Errorf("empty reference")
+	}
+	v, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s not set", ref)
+	}
+	return v, nil
+}
+
+// ExpandSecretsIn expands the references in the fields tagged
+// `secret:"expand"` of the struct pointed to by v, in every string
+// reachable from them through pointers, maps and slices. Other fields,
+// like SQL where "${" may be literal, are left alone.
+func ExpandSecretsIn(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("expand secrets: %s is not a struct", rv.Type())
+	}
+	t := rv.Type()
+	for i := 0; i < rv.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("secret") != "expand" {
+			continue
+		}
+		if err := expandValue(rv.Field(i), f.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expandValue(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return expandValue(v.Elem(), path)
+	case reflect.String:
+		s, err := ExpandSecrets(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if v.CanSet() {
+			v.SetString(s)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				continue
+			}
+			if err := expandValue(v.Field(i), joinPath(path, t.Field(i).Name)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			e := v.MapIndex(k)
+			p := fmt.Sprintf("%s[%v]", path, k)
+			if e.Kind() != reflect.String {
+				if err := expandValue(e, p); err != nil {
+					return err
+				}
+				continue
+			}
+			// map elements are not addressable, store the expanded copy
+			s, err := ExpandSecrets(e.String())
+			if err != nil {
+				return fmt.Errorf("%s: %v", p, err)
+			}
+			v.SetMapIndex(k, reflect.ValueOf(s).Convert(e.Type()))
+		}
+	}
+	return nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,75 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pwFile := filepath.Join(dir, "pw")
+	ioutil.WriteFile(pwFile, []byte("p@ss:word\n"), 0600)
+	os.Setenv("GODBSYNC_TEST_USER", "sync")
+	defer os.Unsetenv("GODBSYNC_TEST_USER")
+
+	s, err := ExpandSecrets("${GODBSYNC_TEST_USER}:${file:" + pwFile + "}@tcp(db)/x $${KEEP} $_TABLE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "sync:p@ss:word@tcp(db)/x ${KEEP} $_TABLE"; s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+	if _, err := ExpandSecrets("${GODBSYNC_TEST_UNSET}"); err == nil {
+		t.Error("unset variable should fail")
+	}
+
+	v := struct {
+		DSNFile string                             `secret:"expand"`
+		Names   map[string]string                  `secret:"expand"`
+		Rules   map[string]*struct{ Table string } `secret:"expand"`
+		// SQL is not expanded, "${" may be literal
+		Columns string
+		Filters map[string]string
+	}{
+		DSNFile: "${GODBSYNC_TEST_USER}.dsn",
+		Names:   map[string]string{"*": "${GODBSYNC_TEST_USER}"},
+		Rules:   map[string]*struct{ Table string }{"a": {"${GODBSYNC_TEST_USER}_t"}},
+		Columns: "id,tag=CONCAT('${',id,'}')",
+		Filters: map[string]string{"*": "note LIKE '${GODBSYNC_TEST_UNSET}%'"},
+	}
+	if err := ExpandSecretsIn(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.DSNFile != "sync.dsn" || v.Names["*"] != "sync" || v.Rules["a"].Table != "sync_t" {
+		t.Errorf("got %+v %v %v", v, v.Names, v.Rules["a"])
+	}
+	if v.Columns != "id,tag=CONCAT('${',id,'}')" || v.Filters["*"] != "note LIKE '${GODBSYNC_TEST_UNSET}%'" {
+		t.Errorf("untagged fields expanded: %q %v", v.Columns, v.Filters)
+	}
+
+	structured := filepath.Join(dir, "db.dsn")
+	ioutil.WriteFile(structured, []byte(`{"host": "db:3307", "user": "${GODBSYNC_TEST_USER}",
+		"password_file": "`+pwFile+`", "database": "erp", "params": {"timeout": "10s"}}`), 0600)
+	dsn, err := ReadDSN(structured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "sync:p@ss:word@tcp(db:3307)/erp?timeout=10s"; dsn != want {
+		t.Errorf("got %q, want %q", dsn, want)
+	}
+	if masked := MaskDSN(dsn); masked != "sync:***@tcp(db:3307)/erp?timeout=10s" {
+		t.Errorf("masked %q", masked)
+	}
+
+	lines := filepath.Join(dir, "lines.dsn")
+	ioutil.WriteFile(lines, []byte("# user\n${GODBSYNC_TEST_USER}\n:\n${file:"+pwFile+"}\n@tcp(db)/erp\n"), 0600)
+	if dsn, err := ReadDSN(lines); err != nil || dsn != "sync:p@ss:word@tcp(db)/erp" {
+		t.Errorf("got %q, %v", dsn, err)
+	}
+}
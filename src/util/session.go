@@ -0,0 +1,280 @@
+package util
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Handle is a cursor, transaction or prepared statement opened through an
+// RPC connection.
+type Handle struct {
+	Tx          *sql.Tx
+	Stmt        *sql.Stmt
+	Rows        *sql.Rows
+	ColumnCount int
+	ColumnTypes []Column
+
+	SQL     string
+	Created time.Time
+	LastUse time.Time
+}
+
+func (h *Handle) Kind() string {
+	switch {
+	case h.Tx != nil:
+		return "tx"
+	case h.Stmt != nil:
+		return "stmt"
+	default:
+		return "cursor"
+	}
+}
+func (h *Handle) Close() error {
+	switch {
+	case h.Tx != nil:
+		return h.Tx.Rollback()
+	case h.Stmt != nil:
+		return h.Stmt.Close()
+	default:
+		return h.Rows.Close()
+	}
+}
+
+// HandleStatus describes an open Handle.
+type HandleStatus struct {
+	ID      int64
+	Kind    string
+	SQL     string `json:",omitempty"`
+	Created time.Time
+	LastUse time.Time
+}
+
+// Session owns the handles opened through one RPC connection. Close
+// releases all of them, idle cursors are closed after the cursor TTL.
+type Session struct {
+	Started time.Time
+
+	name      string
+	cursorTTL time.Duration
+	maxOpen   int
+	tick      func()
+
+	mu    sync.Mutex
+	idGen int64
+	files map[int64]*Handle
+	done  chan struct{}
+}
+
+// NewSession returns a session which allows maxOpen handles. name prefixes
+// its log lines if not empty, tick is called periodically if not nil.
+func NewSession(name string, cursorTTL time.Duration, maxOpen int, tick func()) *Session {
+	s := &Session{
+		Started:   time.Now(),
+		name:      name,
+		cursorTTL: cursorTTL,
+		maxOpen:   maxOpen,
+		tick:      tick,
+		files:     make(map[int64]*Handle),
+		done:      make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *Session) logf(format string, v ...interface{}) {
+	if s.name != "" {
+		format = "[" + s.name + "] " + format
+	}
+	log.Printf(format, v...)
+}
+
+// Create adds h and returns its id.
+func (s *Session) Create(h *Handle) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		return 0, errors.New("session closed")
+	}
+	if len(s.files) >= s.maxOpen {
+		return 0, errors.New("too many open files")
+	}
+	s.idGen++
+	h.Created = time.Now()
+	h.LastUse = h.Created
+	s.files[s.idGen] = h
+	return s.idGen, nil
+}
+func (s *Session) Retrieve(id int64) (*Handle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.files[id]
+	if !ok {
+		return nil, errors.New("file not found")
+	}
+	h.LastUse = time.Now()
+	return h, nil
+}
+
+// Release removes the handle id, the caller closes it.
+func (s *Session) Release(id int64) {
+	s.mu.Lock()
+	delete(s.files, id)
+	s.mu.Unlock()
+}
+
+// Close closes cursors and statements and rolls back transactions left
+// open by the peer.
+func (s *Session) Close() {
+	s.mu.Lock()
+	files := s.files
+	s.files = nil
+	s.mu.Unlock()
+	if files == nil {
+		return
+	}
+	close(s.done)
+
+	// cursors and statements may belong to a transaction, close them first
+	ids := make([]int64, 0, len(files))
+	for id := range files {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return files[ids[i]].Tx == nil && files[ids[j]].Tx != nil
+	})
+	for _, id := range ids {
+		h := files[id]
+		if err := h.Close(); err != nil {
+			s.logf("ERROR close %s %d: %v", h.Kind(), id, err)
+		} else {
+			s.logf("info: %s %d closed with connection", h.Kind(), id)
+		}
+	}
+}
+
+// Handles returns the open handles ordered by id.
+func (s *Session) Handles() []HandleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []HandleStatus
+	for id, h := range s.files {
+		res = append(res, HandleStatus{
+			ID:      id,
+			Kind:    h.Kind(),
+			SQL:     h.SQL,
+			Created: h.Created,
+			LastUse: h.LastUse,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+func (s *Session) expire(now time.Time) {
+	var expired []*Handle
+	s.mu.Lock()
+	for id, h := range s.files {
+		if h.Rows != nil && now.Sub(h.LastUse) > s.cursorTTL {
+			delete(s.files, id)
+			expired = append(expired, h)
+			s.logf("info: cursor %d expired, idle since %s", id, h.LastUse.Format(time.RFC3339))
+		}
+	}
+	s.mu.Unlock()
+	for _, h := range expired {
+		h.Rows.Close()
+	}
+}
+
+func (s *Session) run() {
+	interval := s.cursorTTL / 2
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-tick.C:
+			s.expire(now)
+			if s.tick != nil {
+				s.tick()
+			}
+		}
+	}
+}
+
+// Querier runs statements on a connection, a transaction or, through
+// StmtQuerier, a prepared statement.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// StmtQuerier runs Stmt, the query is ignored.
+type StmtQuerier struct {
+	Stmt *sql.Stmt
+}
+
+func (q StmtQuerier) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return q.Stmt.Exec(args...)
+}
+func (q StmtQuerier) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return q.Stmt.Query(args...)
+}
+func (q StmtQuerier) QueryRow(query string, args ...interface{}) *sql.Row {
+	return q.Stmt.QueryRow(args...)
+}
+
+// Fetch reads up to count rows of columns columns as strings, all rows if
+// count <= 0. end is set when rows is exhausted.
+func Fetch(rows *sql.Rows, columns int, count int) (results [][]string, end bool, err error) {
+	if count <= 0 {
+		count = 1 << 31
+	}
+	var sbuf []string
+	makeColumn := func() (s []string) {
+		if len(sbuf) < columns {
+			batch := count
+			if batch > 32 {
+				batch = 32
+			}
+			sbuf = make([]string, batch*columns)
+		}
+		s = sbuf[:columns]
+		sbuf = sbuf[columns:]
+		return
+	}
+	scan := make([]interface{}, columns)
+	for count > 0 {
+		if !rows.Next() {
+			end = true
+			err = rows.Err()
+			return
+		}
+		column := makeColumn()
+		for i := range scan {
+			scan[i] = &column[i]
+		}
+		if err = rows.Scan(scan...); err != nil {
+			return
+		}
+		if results == nil {
+			n := count
+			if n > 32 {
+				n = 32
+			}
+			results = make([][]string, 0, n)
+		}
+		results = append(results, column)
+		count--
+	}
+	return
+}
@@ -0,0 +1,620 @@
+package util
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// SQLStatement is the result of ScanSQL. It is a light weight lexical scan
+// and not a parser, it is meant to classify statements for access checks.
+type SQLStatement struct {
+	// Type is the upper case leading keyword, e.g. SELECT or INSERT. For
+	// statements starting with WITH it is the keyword of the main statement.
+	Type string
+	// Tables lists referenced tables as written, "table" or "schema.table",
+	// without quotes.
+	Tables []string
+	// Multi is set if more than one statement is found.
+	Multi bool
+	// File is set if the statement reads or writes server side files.
+	File bool
+	// Incomplete is set if the table references after FROM, JOIN, UPDATE
+	// or USING were not fully read, Tables may then miss tables.
+	Incomplete bool
+}
+
+type sqlToken struct {
+	kind byte // 'w' word, 'i' quoted identifier, 's' string, 'p' punctuation
+	text string
+}
+
+var ErrExecutableComment = errors.New("executable comment not allowed")
+
+// isExecutableComment reports whether the body s of a comment is run by the
+// server: MySQL "/*!", MariaDB "/*M!" and optimizer hints "/*+".
+func isExecutableComment(s string) bool {
+	if strings.HasPrefix(s, "M!") || strings.HasPrefix(s, "m!") {
+		return true
+	}
+	return strings.HasPrefix(s, "!") || strings.HasPrefix(s, "+")
+}
+
+func tokenizeSQL(s string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#' || (c == '-' && strings.HasPrefix(s[i:], "-- ")):
+			end := strings.IndexByte(s[i:], '\n')
+			if end < 0 {
+				i = len(s)
+			} else {
+				i += end + 1
+			}
+		case c == '/' && strings.HasPrefix(s[i:], "/*"):
+			if isExecutableComment(s[i+2:]) {
+				return nil, ErrExecutableComment
+			}
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			i += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			j := i + 1
+			var sb strings.Builder
+			for {
+				if j >= len(s) {
+					return nil, errors.New("unterminated quote")
+				}
+				if s[j] == '\\' && c != '`' && j+1 < len(s) {
+					sb.WriteByte(s[j+1])
+					j += 2
+					continue
+				}
+				if s[j] == c {
+					if j+1 < len(s) && s[j+1] == c {
+						sb.WriteByte(c)
+						j += 2
+						continue
+					}
+					break
+				}
+				sb.WriteByte(s[j])
+				j++
+			}
+			kind := byte('s')
+			if c == '`' {
+				kind = 'i'
+			}
+			tokens = append(tokens, sqlToken{kind, sb.String()})
+			i = j + 1
+		case isWordByte(c):
+			j := i
+			for j < len(s) && isWordByte(s[j]) {
+				j++
+			}
+			tokens = append(tokens, sqlToken{'w', s[i:j]})
+			i = j
+		default:
+			tokens = append(tokens, sqlToken{'p', s[i : i+1]})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c == '@' ||
+		(c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+// keywords which may be followed by a table reference
+var sqlTableKeywords = map[string]bool{
+	"FROM":          true,
+	"JOIN":          true,
+	"STRAIGHT_JOIN": true,
+	"INTO":          true,
+	"UPDATE":        true,
+	"TABLE":         true,
+	"TABLES":        true,
+	"TO":            true,
+	"LIKE":          true,
+}
+
+// words skipped between a keyword and the table reference
+var sqlTableModifiers = map[string]bool{
+	"LOW_PRIORITY":  true,
+	"HIGH_PRIORITY": true,
+	"DELAYED":       true,
+	"IGNORE":        true,
+	"QUICK":         true,
+	"INTO":          true,
+	"TABLE":         true,
+	"TEMPORARY":     true,
+	"IF":            true,
+	"NOT":           true,
+	"EXISTS":        true,
+}
+
+// words which end a table list, they are never table names
+var sqlReservedWords = map[string]bool{
+	"SELECT": true, "SET": true, "VALUES": true, "VALUE": true, "WHERE": true,
+	"ON": true, "USING": true, "AS": true, "ORDER": true, "GROUP": true,
+	"LIMIT": true, "HAVING": true, "UNION": true, "READ": true, "WRITE": true,
+	"LEFT": true, "RIGHT": true, "INNER": true, "OUTER": true, "CROSS": true,
+	"NATURAL": true, "STRAIGHT_JOIN": true, "JOIN": true, "FOR": true,
+	"PARTITION": true, "DUPLICATE": true, "KEY": true, "WINDOW": true,
+	"OUTFILE": true, "DUMPFILE": true, "DUAL": true, "LOCAL": true,
+	"USE": true, "FORCE": true, "IGNORE": true, "IN": true, "LOCK": true,
+	"EXCEPT": true, "INTERSECT": true, "PROCEDURE": true, "LATERAL": true,
+}
+
+// words which end a join condition or the table references of FROM
+var sqlClauseWords = map[string]bool{
+	"ON": true, "USING": true, "WHERE": true, "GROUP": true, "ORDER": true,
+	"LIMIT": true, "HAVING": true, "UNION": true, "EXCEPT": true, "INTERSECT": true,
+	"FOR": true, "LOCK": true, "WINDOW": true, "INTO": true, "SET": true,
+	"PROCEDURE": true, "JOIN": true, "STRAIGHT_JOIN": true, "LEFT": true,
+	"RIGHT": true, "INNER": true, "CROSS": true, "NATURAL": true, "IN": true,
+}
+
+var sqlLockWords = map[string]bool{
+	"READ":         true,
+	"WRITE":        true,
+	"LOCAL":        true,
+	"LOW_PRIORITY": true,
+}
+
+// options between SELECT and the select list, STRAIGHT_JOIN is one of them
+var sqlSelectOptions = map[string]bool{
+	"ALL": true, "DISTINCT": true, "DISTINCTROW": true, "HIGH_PRIORITY": true,
+	"STRAIGHT_JOIN": true, "SQL_SMALL_RESULT": true, "SQL_BIG_RESULT": true,
+	"SQL_BUFFER_RESULT": true, "SQL_NO_CACHE": true, "SQL_CALC_FOUND_ROWS": true,
+}
+
+// functions with FROM in their arguments, e.g. EXTRACT(YEAR FROM d)
+var sqlFromFunctions = map[string]bool{
+	"EXTRACT":   true,
+	"TRIM":      true,
+	"SUBSTRING": true,
+	"SUBSTR":    true,
+}
+
+// words starting a query in a derived table
+var sqlQueryWords = map[string]bool{
+	"SELECT": true,
+	"WITH":   true,
+	"TABLE":  true,
+	"VALUES": true,
+}
+
+// ScanSQL classifies the statement s.
+func ScanSQL(s string) (*SQLStatement, error) {
+	tokens, err := tokenizeSQL(s)
+	if err != nil {
+		return nil, err
+	}
+	// drop trailing semicolons
+	for len(tokens) > 0 && tokens[len(tokens)-1].kind == 'p' && tokens[len(tokens)-1].text == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty statement")
+	}
+
+	st := new(SQLStatement)
+	for _, t := range tokens {
+		if t.kind == 'p' && t.text == ";" {
+			st.Multi = true
+		}
+	}
+	if tokens[0].kind != 'w' {
+		return nil, errors.New("statement does not start with a keyword")
+	}
+	st.Type = strings.ToUpper(tokens[0].text)
+	if st.Type == "WITH" {
+		depth := 0
+		for _, t := range tokens[1:] {
+			if t.kind == 'p' && t.text == "(" {
+				depth++
+			} else if t.kind == 'p' && t.text == ")" {
+				depth--
+			} else if t.kind == 'w' && depth == 0 {
+				switch kw := strings.ToUpper(t.text); kw {
+				case "SELECT", "INSERT", "REPLACE", "UPDATE", "DELETE":
+					st.Type = kw
+				}
+				if st.Type != "WITH" {
+					break
+				}
+			}
+		}
+	}
+
+	sc := &sqlScan{st: st, tokens: tokens}
+	sc.scan(0, len(tokens))
+	return st, nil
+}
+
+type sqlScan struct {
+	st     *SQLStatement
+	tokens []sqlToken
+}
+
+// word returns tokens[i] in upper case if it is a word, "" otherwise.
+func (sc *sqlScan) word(i int) string {
+	if i < 0 || i >= len(sc.tokens) || sc.tokens[i].kind != 'w' {
+		return ""
+	}
+	return strings.ToUpper(sc.tokens[i].text)
+}
+
+func (sc *sqlScan) punct(i int, p string) bool {
+	return i >= 0 && i < len(sc.tokens) && sc.tokens[i].kind == 'p' && sc.tokens[i].text == p
+}
+
+// group returns the index of the parenthesis closing the one at tokens[i],
+// end if it is not closed before end.
+func (sc *sqlScan) group(i, end int) int {
+	depth := 0
+	for ; i < end; i++ {
+		if sc.punct(i, "(") {
+			depth++
+		} else if sc.punct(i, ")") {
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return end
+}
+
+// skipGroup returns the index after the group starting at tokens[i].
+func (sc *sqlScan) skipGroup(i, end int) int {
+	if i = sc.group(i, end); i < end {
+		i++
+	}
+	return i
+}
+
+// scan looks for table references in tokens[i:end].
+func (sc *sqlScan) scan(i, end int) {
+	st := sc.st
+	// enclosing parentheses, true for arguments of sqlFromFunctions
+	var fn []bool
+	for ; i < end; i++ {
+		t := sc.tokens[i]
+		if t.kind == 'p' {
+			switch t.text {
+			case "(":
+				fn = append(fn, sqlFromFunctions[sc.word(i-1)])
+			case ")":
+				if len(fn) > 0 {
+					fn = fn[:len(fn)-1]
+				}
+			}
+			continue
+		}
+		if t.kind != 'w' {
+			continue
+		}
+		kw := strings.ToUpper(t.text)
+		switch kw {
+		case "OUTFILE", "DUMPFILE", "LOAD_FILE", "INFILE":
+			st.File = true
+		}
+		strict := false
+		switch kw {
+		case "INSERT", "REPLACE", "DESC", "DESCRIBE", "EXPLAIN", "TRUNCATE":
+			if i != 0 {
+				continue
+			}
+		case "UPDATE":
+			// ON DUPLICATE KEY UPDATE, SELECT ... FOR UPDATE, ON UPDATE
+			// CURRENT_TIMESTAMP
+			switch sc.word(i - 1) {
+			case "KEY", "FOR", "ON":
+				continue
+			}
+			strict = true
+		case "FROM":
+			// IS NOT DISTINCT FROM
+			if (len(fn) > 0 && fn[len(fn)-1]) || sc.word(i-1) == "DISTINCT" {
+				continue
+			}
+			strict = true
+		case "JOIN":
+			strict = true
+		case "STRAIGHT_JOIN":
+			j := i - 1
+			for sqlSelectOptions[sc.word(j)] {
+				j--
+			}
+			if sc.word(j) == "SELECT" {
+				continue
+			}
+			strict = true
+		case "USING":
+			// join conditions are read by tables, a USING left is the
+			// table list of a multi-table DELETE
+			if st.Type != "DELETE" {
+				continue
+			}
+			strict = true
+		case "TO":
+			if st.Type != "RENAME" {
+				continue
+			}
+		case "LIKE":
+			if st.Type != "CREATE" {
+				continue
+			}
+		default:
+			if !sqlTableKeywords[kw] {
+				continue
+			}
+		}
+		if strict {
+			i = sc.tables(i+1, end) - 1
+		} else {
+			i = sc.tableList(i+1, end) - 1
+		}
+	}
+}
+
+// tableList reads a comma separated list of table names starting at
+// tokens[i] and returns the index of the first token after the list. It is
+// used after keywords like INTO or TABLE, which are not followed by joins.
+func (sc *sqlScan) tableList(i, end int) int {
+	for i < end && sqlTableModifiers[sc.word(i)] {
+		i++
+	}
+	for i < end {
+		name, next := readTableName(sc.tokens[:end], i)
+		if name == "" {
+			return i
+		}
+		sc.st.Tables = append(sc.st.Tables, name)
+		i = sc.alias(next, end)
+		// lock type of LOCK TABLES
+		for i < end && sqlLockWords[sc.word(i)] {
+			i++
+		}
+		if !sc.punct(i, ",") {
+			return i
+		}
+		i++
+	}
+	return i
+}
+
+// tables reads the table references of FROM, JOIN, UPDATE or USING
+// starting at tokens[i], including parenthesized references, derived
+// tables and joins, and returns the index of the first token after them.
+// Anything not understood marks the statement Incomplete.
+func (sc *sqlScan) tables(i, end int) int {
+	for i < end && sqlTableModifiers[sc.word(i)] {
+		i++
+	}
+	if sc.word(i) == "DUAL" {
+		return i + 1
+	}
+	for i < end {
+		next, ok := sc.tableFactor(i, end)
+		if !ok {
+			sc.st.Incomplete = true
+			return i
+		}
+		i = next
+		// joins, each takes at most one ON or USING condition
+		pending := 0
+		for {
+			if w := sc.word(i); pending > 0 && w == "ON" {
+				i = sc.condition(i+1, end)
+				pending--
+				continue
+			} else if pending > 0 && w == "USING" && sc.punct(i+1, "(") {
+				i = sc.skipGroup(i+1, end)
+				pending--
+				continue
+			}
+			j := sc.join(i)
+			if j == i {
+				break
+			}
+			if i, ok = sc.tableFactor(j, end); !ok {
+				sc.st.Incomplete = true
+				return j
+			}
+			pending++
+		}
+		if !sc.punct(i, ",") {
+			break
+		}
+		i++
+	}
+	// the list must end where no table reference can follow
+	if i < end && !sc.punct(i, ")") && !sc.punct(i, ";") {
+		if w := sc.word(i); !sqlClauseWords[w] && !sqlTableKeywords[w] {
+			sc.st.Incomplete = true
+		}
+	}
+	return i
+}
+
+// tableFactor reads a table, a parenthesized table reference or a derived
+// table with its alias at tokens[i].
+func (sc *sqlScan) tableFactor(i, end int) (int, bool) {
+	if sc.word(i) == "LATERAL" && sc.punct(i+1, "(") {
+		i++
+	}
+	if sc.punct(i, "(") {
+		close := sc.group(i, end)
+		derived := sqlQueryWords[sc.word(i+1)]
+		if derived {
+			sc.scan(i+1, close)
+		} else {
+			sc.scan(sc.tables(i+1, close), close)
+		}
+		i = sc.alias(sc.skipGroup(i, end), end)
+		// column names of a derived table
+		if derived && sc.punct(i, "(") {
+			i = sc.skipGroup(i, end)
+		}
+		return i, true
+	}
+
+	name, next := readTableName(sc.tokens[:end], i)
+	if name == "" {
+		return i, false
+	}
+	sc.st.Tables = append(sc.st.Tables, name)
+	i = next
+	if sc.word(i) == "PARTITION" && sc.punct(i+1, "(") {
+		i = sc.skipGroup(i+1, end)
+	}
+	i = sc.alias(i, end)
+	// index hints
+	for {
+		switch sc.word(i) {
+		case "USE", "FORCE", "IGNORE":
+		default:
+			return i, true
+		}
+		if w := sc.word(i + 1); w != "INDEX" && w != "KEY" {
+			return i, true
+		}
+		i += 2
+		for i < end && sc.tokens[i].kind == 'w' {
+			i++
+		}
+		if sc.punct(i, "(") {
+			i = sc.skipGroup(i, end)
+		}
+	}
+}
+
+// alias skips an optional alias at tokens[i].
+func (sc *sqlScan) alias(i, end int) int {
+	if sc.word(i) == "AS" {
+		if i+1 < end && sc.tokens[i+1].kind != 'p' {
+			return i + 2
+		}
+		return i + 1
+	}
+	if i < end && (sc.tokens[i].kind == 'i' ||
+		(sc.tokens[i].kind == 'w' && !sqlReservedWords[sc.word(i)] && !sqlTableKeywords[sc.word(i)])) {
+		i++
+	}
+	return i
+}
+
+// join returns the index after the join keywords at tokens[i], i if there
+// are none.
+func (sc *sqlScan) join(i int) int {
+	if sc.word(i) == "STRAIGHT_JOIN" {
+		return i + 1
+	}
+	j := i
+	if sc.word(j) == "NATURAL" {
+		j++
+	}
+	switch sc.word(j) {
+	case "LEFT", "RIGHT", "INNER", "CROSS":
+		j++
+	}
+	if sc.word(j) == "OUTER" {
+		j++
+	}
+	if sc.word(j) != "JOIN" {
+		return i
+	}
+	return j + 1
+}
+
+// condition scans the join condition starting at tokens[i] and returns the
+// index of the first token after it.
+func (sc *sqlScan) condition(i, end int) int {
+	start := i
+	for i < end {
+		if sc.punct(i, "(") {
+			i = sc.skipGroup(i, end)
+			continue
+		}
+		if sc.punct(i, ",") || sc.punct(i, ")") || sc.punct(i, ";") {
+			break
+		}
+		// LEFT( and RIGHT( are functions
+		if sqlClauseWords[sc.word(i)] && !sc.punct(i+1, "(") {
+			break
+		}
+		i++
+	}
+	sc.scan(start, i)
+	return i
+}
+
+func readTableName(tokens []sqlToken, i int) (string, int) {
+	part := func(i int) (string, bool) {
+		if i >= len(tokens) {
+			return "", false
+		}
+		t := tokens[i]
+		if t.kind == 'i' {
+			return t.text, true
+		}
+		if t.kind == 'w' && !sqlReservedWords[strings.ToUpper(t.text)] && !sqlTableKeywords[strings.ToUpper(t.text)] &&
+			!strings.HasPrefix(t.text, "@") {
+			return t.text, true
+		}
+		return "", false
+	}
+	name, ok := part(i)
+	if !ok {
+		return "", i
+	}
+	i++
+	if i+1 < len(tokens) && tokens[i].kind == 'p' && tokens[i].text == "." {
+		if table, ok := part(i + 1); ok {
+			return name + "." + table, i + 2
+		}
+	}
+	return name, i
+}
+
+// QualifyTable returns table in lower case, with schema database if it has
+// none.
+func QualifyTable(database, table string) string {
+	table = strings.ToLower(table)
+	if strings.IndexByte(table, '.') < 0 {
+		table = strings.ToLower(database) + "." + table
+	}
+	return table
+}
+
+// MatchTable reports if the qualified table matches one of patterns, which
+// are qualified with database.
+func MatchTable(database string, patterns []string, table string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(QualifyTable(database, pattern), table); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsFold reports if list contains s ignoring case.
+func ContainsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
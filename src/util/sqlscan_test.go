@@ -0,0 +1,72 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScanSQL(t *testing.T) {
+	tests := []struct {
+		sql        string
+		typ        string
+		tables     []string
+		multi      bool
+		incomplete bool
+	}{
+		{"SELECT a,b FROM t WHERE id=1", "SELECT", []string{"t"}, false, false},
+		{"select * from `db`.`t` a join u as b on a.id=b.id;", "SELECT", []string{"db.t", "u"}, false, false},
+		{"SELECT * FROM t1, t2 x WHERE x.a IN (SELECT a FROM t3)", "SELECT", []string{"t1", "t2", "t3"}, false, false},
+		{"INSERT INTO `bus_authorized`(`id`,`title`) VALUES (1,'a;b') ON DUPLICATE KEY UPDATE `title`=VALUES(title)",
+			"INSERT", []string{"bus_authorized"}, false, false},
+		{"REPLACE sync_vars(name, value) VALUES ('a','b')", "REPLACE", []string{"sync_vars"}, false, false},
+		{"UPDATE low_priority t SET a=1 WHERE b='x'", "UPDATE", []string{"t"}, false, false},
+		{"DELETE FROM t WHERE id IN (1,2)", "DELETE", []string{"t"}, false, false},
+		{"SELECT 1; DROP TABLE t", "SELECT", []string{"t"}, true, false},
+		{"TRUNCATE TABLE t", "TRUNCATE", []string{"t"}, false, false},
+		{"RENAME TABLE a TO b, c TO d", "RENAME", []string{"a", "b", "c", "d"}, false, false},
+		{"LOCK TABLES a READ, b WRITE", "LOCK", []string{"a", "b"}, false, false},
+		{"SELECT * FROM t ORDER BY a DESC, b FOR UPDATE", "SELECT", []string{"t"}, false, false},
+		{"WITH x AS (SELECT * FROM t) DELETE FROM u", "DELETE", []string{"t", "u"}, false, false},
+		{"SHOW GLOBAL VARIABLES LIKE 'max_allowed_packet'", "SHOW", nil, false, false},
+		{"-- comment\nSELECT 1 # trailing", "SELECT", nil, false, false},
+		{"SELECT * FROM t1 STRAIGHT_JOIN sync_vars", "SELECT", []string{"t1", "sync_vars"}, false, false},
+		{"SELECT STRAIGHT_JOIN * FROM t", "SELECT", []string{"t"}, false, false},
+		{"SELECT * FROM (sync_vars)", "SELECT", []string{"sync_vars"}, false, false},
+		{"SELECT * FROM t1, (sync_vars)", "SELECT", []string{"t1", "sync_vars"}, false, false},
+		{"SELECT * FROM (t1 JOIN (t2, t3) ON 1)", "SELECT", []string{"t1", "t2", "t3"}, false, false},
+		{"DELETE FROM t USING t, sync_vars", "DELETE", []string{"t", "t", "sync_vars"}, false, false},
+		{"DELETE FROM t USING (t, sync_vars)", "DELETE", []string{"t", "t", "sync_vars"}, false, false},
+		{"DELETE t1 FROM t1 LEFT JOIN t2 USING (id) WHERE t2.id IS NULL", "DELETE", []string{"t1", "t2"}, false, false},
+		{"SELECT * FROM t1 JOIN t2 ON LEFT(t1.a, 1)=t2.a, sync_vars", "SELECT", []string{"t1", "t2", "sync_vars"}, false, false},
+		{"SELECT * FROM t1 PARTITION (p) USE INDEX (i), sync_vars", "SELECT", []string{"t1", "sync_vars"}, false, false},
+		{"SELECT * FROM t1 FORCE INDEX FOR JOIN (i) , sync_vars s", "SELECT", []string{"t1", "sync_vars"}, false, false},
+		{"SELECT x.a FROM (SELECT a FROM t1) AS x (a), sync_vars", "SELECT", []string{"t1", "sync_vars"}, false, false},
+		{"SELECT EXTRACT(YEAR FROM d), TRIM('x' FROM s) FROM t", "SELECT", []string{"t"}, false, false},
+		{"UPDATE t1 JOIN t2 ON t1.id=t2.id SET t1.a=t2.a", "UPDATE", []string{"t1", "t2"}, false, false},
+		{"INSERT INTO c (a,b) SELECT 'x',s.b FROM (SELECT 1 AS a UNION ALL SELECT 2) AS s JOIN t AS c ON c.a<=>s.a AND NOT (c.b IS NOT DISTINCT FROM s.b) WHERE c.v>s.v",
+			"INSERT", []string{"c", "t"}, false, false},
+		{"SELECT 1 FROM DUAL", "SELECT", nil, false, false},
+		{"SELECT * FROM @t", "SELECT", nil, false, true},
+		{"SELECT * FROM t1 x y, sync_vars", "SELECT", []string{"t1"}, false, true},
+		{"SELECT * FROM t1 USE INDEX (i) PARTITION (p), sync_vars", "SELECT", []string{"t1"}, false, true},
+		{"SELECT * FROM t1 JOIN - sync_vars", "SELECT", []string{"t1"}, false, true},
+	}
+	for _, test := range tests {
+		st, err := ScanSQL(test.sql)
+		if err != nil {
+			t.Errorf("ScanSQL(%q): %v", test.sql, err)
+			continue
+		}
+		if st.Type != test.typ || st.Multi != test.multi || st.Incomplete != test.incomplete ||
+			!reflect.DeepEqual(st.Tables, test.tables) {
+			t.Errorf("ScanSQL(%q) = %+v", test.sql, st)
+		}
+	}
+
+	for _, s := range []string{"", ";", "SELECT 'a", "SELECT /*!50000 1 */", "/* x */",
+		"SELECT * FROM bus_a /*M!, sync_vars */", "SELECT 1 /*M!100000 FROM sync_vars */", "SELECT /*+ BKA(t) */ 1"} {
+		if _, err := ScanSQL(s); err == nil {
+			t.Errorf("ScanSQL(%q) should fail", s)
+		}
+	}
+}